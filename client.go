@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"flag"
 	"log"
@@ -16,10 +17,12 @@ func main() {
 
 	flag.Parse()
 
-	// Create stream and configure it as a client connection.
-	jid := must(xmpp.ParseJID(*jid)).(xmpp.JID)
-	stream := must(xmpp.NewStream(jid.Domain+":5222", &xmpp.StreamConfig{LogStanzas: true})).(*xmpp.Stream)
-	client := must(xmpp.NewClientXMPP(stream, jid, *password, &xmpp.ClientConfig{InsecureSkipVerify: true})).(*xmpp.XMPP)
+	// Connect to the home server and log in.
+	config := &xmpp.DialConfig{
+		Stream: &xmpp.StreamConfig{LogStanzas: true},
+		Client: &xmpp.ClientConfig{InsecureSkipVerify: true},
+	}
+	client := must(xmpp.Dial(context.Background(), *jid, *password, config)).(*xmpp.XMPP)
 
 	log.Printf("Connection established for %s\n", client.JID)
 
@@ -52,7 +55,7 @@ func main() {
 	info := &DiscoInfo{}
 	iq := xmpp.IQ{ID: xmpp.UUID4(), Type: "get", To: client.JID.Domain}
 	iq.PayloadEncode(info)
-	reply, _ := client.SendRecv(&iq)
+	reply := must(client.SendRecv(&iq)).(*xmpp.IQ)
 	reply.PayloadDecode(info)
 	log.Printf("* info: %v\n", info)
 
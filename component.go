@@ -19,7 +19,7 @@ func main() {
 	// Create stream and configure it as a component connection.
 	jid := must(xmpp.ParseJID(*jid)).(xmpp.JID)
 	stream := must(xmpp.NewStream(*addr, &xmpp.StreamConfig{LogStanzas: true})).(*xmpp.Stream)
-	comp := must(xmpp.NewComponentXMPP(stream, jid, *secret)).(*xmpp.XMPP)
+	comp := must(xmpp.NewComponentXMPP(stream, jid, *secret, nil)).(*xmpp.XMPP)
 
 	for x := range comp.In {
 		log.Printf("recv: %v", x)
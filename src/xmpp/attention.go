@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+)
+
+const (
+	NSAttention = "urn:xmpp:attention:0"
+)
+
+// XEP-0224: Attention
+
+var ErrAttentionNotSupported = errors.New("recipient does not support attention requests")
+
+// Attach to a message to get the recipient's attention.
+type Attention struct {
+	XMLName xml.Name `xml:"urn:xmpp:attention:0 attention"`
+}
+
+// Ask the JID, usually a full JID, for its attention with a headline message.
+// The body, which may be empty, is shown to the recipient. Return
+// ErrAttentionNotSupported, without sending anything, unless the recipient
+// advertises the feature in disco#info.
+func (x *XMPP) SendAttention(ctx context.Context, to JID, body string) error {
+	info, err := x.DiscoInfo(ctx, to, "")
+	if err != nil {
+		return err
+	}
+	if !info.HasFeature(NSAttention) {
+		return ErrAttentionNotSupported
+	}
+	msg := &Message{ID: x.newID(), To: to.Full(), Type: MessageTypeHeadline, Attention: &Attention{}}
+	if body != "" {
+		msg.Body = []MessageBody{{Value: body}}
+	}
+	return x.write(msg)
+}
+
+// Matcher to identify attention requests.
+var AttentionMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		msg, ok := v.(*Message)
+		return ok && msg.Attention != nil && msg.Type != MessageTypeError
+	},
+)
+
+// Call fn with each attention request, delivered to it instead of In. The
+// feature is advertised in disco#info.
+func (x *XMPP) HandleAttention(fn func(*Message)) FilterID {
+	x.AddDiscoFeature(NSAttention)
+	return x.addHandler(AttentionMatcher, func(v interface{}) {
+		fn(v.(*Message))
+	})
+}
@@ -0,0 +1,34 @@
+package xmpp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAttention(t *testing.T) {
+	alice, bob := newTestXMPPPair()
+	defer alice.stream.Close()
+
+	// Advertise something else so bob answers disco#info.
+	bob.AddDiscoFeature(NSReceipts)
+	if err := alice.SendAttention(context.Background(), bob.JID, "hey"); err != ErrAttentionNotSupported {
+		t.Fatalf("err = %v, want ErrAttentionNotSupported", err)
+	}
+
+	received := make(chan *Message, 1)
+	bob.HandleAttention(func(msg *Message) {
+		received <- msg
+	})
+	if err := alice.SendAttention(context.Background(), bob.JID, "hey"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg.Type != MessageTypeHeadline || len(msg.Body) != 1 || msg.Body[0].Value != "hey" {
+			t.Errorf("unexpected attention message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attention request not received")
+	}
+}
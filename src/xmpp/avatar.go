@@ -0,0 +1,198 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NSAvatarData     = "urn:xmpp:avatar:data"
+	NSAvatarMetadata = "urn:xmpp:avatar:metadata"
+)
+
+// How long AvatarEvents waits for a contact's avatar image.
+const avatarTimeout = time.Minute
+
+// XEP-0084: User Avatar
+type avatarData struct {
+	XMLName xml.Name `xml:"urn:xmpp:avatar:data data"`
+	Data    string   `xml:",chardata"`
+}
+
+// Avatar metadata, published to announce a new avatar. No infos means the
+// avatar was removed.
+type AvatarMetadata struct {
+	XMLName xml.Name     `xml:"urn:xmpp:avatar:metadata metadata"`
+	Infos   []AvatarInfo `xml:"info"`
+}
+
+// Describes an avatar image. ID is the hex SHA-1 of the image data.
+type AvatarInfo struct {
+	ID     string `xml:"id,attr"`
+	Type   string `xml:"type,attr"`
+	Bytes  int    `xml:"bytes,attr"`
+	Width  int    `xml:"width,attr,omitempty"`
+	Height int    `xml:"height,attr,omitempty"`
+	URL    string `xml:"url,attr,omitempty"`
+}
+
+// Return the avatar id for the image data.
+func AvatarID(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Publish the image, e.g. of type "image/png", as the user's avatar,
+// returning its id. The data is published before the metadata announcing it.
+func (x *XMPP) PublishAvatar(ctx context.Context, data []byte, mimeType string) (string, error) {
+	id := AvatarID(data)
+	item := &avatarData{Data: base64.StdEncoding.EncodeToString(data)}
+	if _, err := x.pubSubPublish(ctx, JID{}, NSAvatarData, id, item); err != nil {
+		return "", err
+	}
+	metadata := &AvatarMetadata{Infos: []AvatarInfo{{ID: id, Type: mimeType, Bytes: len(data)}}}
+	if _, err := x.pubSubPublish(ctx, JID{}, NSAvatarMetadata, id, metadata); err != nil {
+		return "", err
+	}
+	x.cacheAvatar(id, data)
+	return id, nil
+}
+
+// Tell contacts the user no longer has an avatar.
+func (x *XMPP) RemoveAvatar(ctx context.Context) error {
+	_, err := x.pubSubPublish(ctx, JID{}, NSAvatarMetadata, pepCurrentItem, &AvatarMetadata{})
+	return err
+}
+
+// Retrieve the image data of the contact's avatar with the id. Avatars are
+// cached by id so an unchanged avatar is only retrieved once.
+func (x *XMPP) Avatar(ctx context.Context, jid JID, id string) ([]byte, error) {
+	if data, ok := x.cachedAvatar(id); ok {
+		return data, nil
+	}
+	item := &avatarData{}
+	if err := x.pubSubItem(ctx, jid, NSAvatarData, id, item); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(item.Data), ""))
+	if err != nil {
+		return nil, err
+	}
+	if AvatarID(data) != id {
+		return nil, fmt.Errorf("Unexpected: avatar data doesn't match id %s", id)
+	}
+	x.cacheAvatar(id, data)
+	return data, nil
+}
+
+func (x *XMPP) cachedAvatar(id string) ([]byte, bool) {
+	x.avatarLock.Lock()
+	defer x.avatarLock.Unlock()
+	data, ok := x.avatars[id]
+	return data, ok
+}
+
+func (x *XMPP) cacheAvatar(id string, data []byte) {
+	x.avatarLock.Lock()
+	defer x.avatarLock.Unlock()
+	if x.avatars == nil {
+		x.avatars = make(map[string][]byte)
+	}
+	x.avatars[id] = data
+}
+
+// A contact's new avatar. Info and Data are zero if the avatar was removed.
+// Data is nil if the image is only available from Info.URL.
+type AvatarEvent struct {
+	From JID
+	Info AvatarInfo
+	Data []byte
+}
+
+// Matcher instance to match <message/> stanzas with an avatar metadata event.
+var AvatarEventMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		msg, ok := v.(*Message)
+		return ok && msg.Event != nil && msg.Event.Items != nil && msg.Event.Items.Node == NSAvatarMetadata
+	},
+)
+
+// Subscribe to contacts' avatars. When a contact announces a new avatar its
+// image is retrieved, unless already cached, and delivered on the returned
+// channel instead of In. Images that can't be retrieved within a minute are
+// logged and skipped. Interest is advertised as for PEPEvents. The channel
+// is closed when the filter is removed with RemoveFilter or the stream dies.
+func (x *XMPP) AvatarEvents() (FilterID, <-chan *AvatarEvent) {
+	x.AddDiscoFeature(NSAvatarMetadata + "+notify")
+	events := make(chan *AvatarEvent)
+	id, ch := x.AddFilter(AvatarEventMatcher)
+	go func() {
+		// Images are retrieved in their own goroutines; the reply can't be
+		// received while this filter is waiting to deliver the next event.
+		// Retrievals still running when the filter is removed are cancelled.
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		defer func() {
+			cancel()
+			wg.Wait()
+			close(events)
+		}()
+		for v := range ch {
+			msg := v.(*Message)
+			from, err := ParseJID(msg.From)
+			if err != nil {
+				continue
+			}
+			for _, item := range msg.Event.Items.Items {
+				metadata := &AvatarMetadata{}
+				if err := item.PayloadDecode(metadata); err != nil {
+					continue
+				}
+				info := avatarInfo(metadata)
+				if info == nil {
+					events <- &AvatarEvent{From: from}
+					continue
+				}
+				if info.URL != "" {
+					events <- &AvatarEvent{From: from, Info: *info}
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(ctx, avatarTimeout)
+					defer cancel()
+					data, err := x.Avatar(ctx, from, info.ID)
+					if err != nil {
+						x.logger().Error("Failed to retrieve avatar. ", err)
+						return
+					}
+					events <- &AvatarEvent{From: from, Info: *info, Data: data}
+				}()
+			}
+		}
+	}()
+	return id, events
+}
+
+// Return the info of the avatar published in the data node, the first
+// without a URL. If every info has a URL the first is returned; nil means the
+// avatar was removed.
+func avatarInfo(metadata *AvatarMetadata) *AvatarInfo {
+	for i := range metadata.Infos {
+		if metadata.Infos[i].URL == "" {
+			return &metadata.Infos[i]
+		}
+	}
+	if len(metadata.Infos) > 0 {
+		return &metadata.Infos[0]
+	}
+	return nil
+}
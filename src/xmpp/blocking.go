@@ -0,0 +1,155 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+)
+
+const (
+	NSBlocking = "urn:xmpp:blocking"
+)
+
+// XEP-0191: Blocking Command
+
+// Returned when the server doesn't support the blocking command.
+var ErrBlockingNotSupported = errors.New("server does not support blocking")
+
+type blockList struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking blocklist"`
+	Items   []blockItem `xml:"item"`
+}
+
+type block struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking block"`
+	Items   []blockItem `xml:"item"`
+}
+
+type unblock struct {
+	XMLName xml.Name    `xml:"urn:xmpp:blocking unblock"`
+	Items   []blockItem `xml:"item"`
+}
+
+type blockItem struct {
+	JID string `xml:"jid,attr"`
+}
+
+// Block all communication with the JID.
+func (x *XMPP) Block(ctx context.Context, jid JID) error {
+	return x.blockingSet(ctx, &block{Items: []blockItem{{jid.Full()}}})
+}
+
+// Stop blocking the JID.
+func (x *XMPP) Unblock(ctx context.Context, jid JID) error {
+	return x.blockingSet(ctx, &unblock{Items: []blockItem{{jid.Full()}}})
+}
+
+// Stop blocking everyone.
+func (x *XMPP) UnblockAll(ctx context.Context) error {
+	return x.blockingSet(ctx, &unblock{})
+}
+
+// Retrieve the JIDs currently blocked.
+func (x *XMPP) BlockList(ctx context.Context) ([]JID, error) {
+
+	if err := x.checkBlocking(ctx); err != nil {
+		return nil, err
+	}
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet}
+	req.PayloadEncode(&blockList{})
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &blockList{}
+	if err := resp.PayloadDecode(list); err != nil {
+		return nil, err
+	}
+	return blockItemJIDs(list.Items)
+}
+
+// Call fn, in a dedicated goroutine, for each block or unblock push from the
+// server, sent when the block list is changed by any of the user's resources.
+// blocked is false for an unblock push; an unblock push with no JIDs means
+// everyone was unblocked. The push is acknowledged automatically.
+func (x *XMPP) HandleBlockPush(fn func(blocked bool, jids []JID)) FilterID {
+	return x.addResponder(x.blockPushMatcher(), func(v interface{}) {
+		iq := v.(*IQ)
+		x.write(iq.Reply(nil))
+		var items []blockItem
+		blocked := iq.PayloadName().Local == "block"
+		if blocked {
+			push := &block{}
+			if err := iq.PayloadDecode(push); err != nil {
+				return
+			}
+			items = push.Items
+		} else {
+			push := &unblock{}
+			if err := iq.PayloadDecode(push); err != nil {
+				return
+			}
+			items = push.Items
+		}
+		jids, err := blockItemJIDs(items)
+		if err != nil {
+			x.logger().Error("Invalid block push. ", err)
+			return
+		}
+		fn(blocked, jids)
+	})
+}
+
+// Matcher for <iq type="set"/> block and unblock pushes from the user's
+// account.
+func (x *XMPP) blockPushMatcher() Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeSet {
+				return false
+			}
+			if iq.From != "" && iq.From != x.JID.Bare() {
+				return false
+			}
+			name := iq.PayloadName()
+			return name == xml.Name{NSBlocking, "block"} || name == xml.Name{NSBlocking, "unblock"}
+		},
+	)
+}
+
+func (x *XMPP) blockingSet(ctx context.Context, payload interface{}) error {
+	if err := x.checkBlocking(ctx); err != nil {
+		return err
+	}
+	req := &IQ{ID: x.newID(), Type: IQTypeSet}
+	req.PayloadEncode(payload)
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Return ErrBlockingNotSupported if the server doesn't advertise blocking.
+func (x *XMPP) checkBlocking(ctx context.Context) error {
+	ok, err := x.ServerSupports(ctx, NSBlocking)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBlockingNotSupported
+	}
+	return nil
+}
+
+func blockItemJIDs(items []blockItem) ([]JID, error) {
+	jids := make([]JID, 0, len(items))
+	for _, item := range items {
+		jid, err := ParseJID(item.JID)
+		if err != nil {
+			return nil, err
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
@@ -0,0 +1,66 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+const (
+	NSBookmarks = "storage:bookmarks"
+)
+
+// XEP-0048: Bookmarks, kept in private XML storage (XEP-0049).
+type Bookmarks struct {
+	XMLName     xml.Name      `xml:"storage:bookmarks storage"`
+	Conferences []Conference  `xml:"conference"`
+	URLs        []BookmarkURL `xml:"url"`
+}
+
+// A bookmarked multi-user chat room.
+type Conference struct {
+	Name     string `xml:"name,attr,omitempty"`
+	JID      string `xml:"jid,attr"`
+	Autojoin bool   `xml:"autojoin,attr,omitempty"`
+	Nick     string `xml:"nick,omitempty"`
+	Password string `xml:"password,omitempty"`
+}
+
+// A bookmarked web page.
+type BookmarkURL struct {
+	Name string `xml:"name,attr,omitempty"`
+	URL  string `xml:"url,attr"`
+}
+
+// Retrieve the user's bookmarked rooms.
+func (x *XMPP) GetBookmarks(ctx context.Context) ([]Conference, error) {
+	bookmarks, err := x.getBookmarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bookmarks.Conferences, nil
+}
+
+// Replace the user's bookmarked rooms with the list. Bookmarked web pages are
+// kept.
+func (x *XMPP) SetBookmarks(ctx context.Context, conferences []Conference) error {
+	bookmarks, err := x.getBookmarks(ctx)
+	if err != nil {
+		return err
+	}
+	bookmarks.Conferences = conferences
+	return x.PrivateSet(ctx, bookmarks)
+}
+
+func (x *XMPP) getBookmarks(ctx context.Context) (*Bookmarks, error) {
+	bookmarks := &Bookmarks{}
+	ext, err := x.privateGet(ctx, xml.Name{NSBookmarks, "storage"})
+	if err != nil {
+		return nil, err
+	}
+	if ext != nil {
+		if err := ext.Decode(bookmarks); err != nil {
+			return nil, err
+		}
+	}
+	return bookmarks, nil
+}
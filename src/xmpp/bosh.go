@@ -0,0 +1,391 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	nsHTTPBind = "http://jabber.org/protocol/httpbind"
+	nsXBOSH    = "urn:xmpp:xbosh"
+)
+
+// How long the server may hold a request open, in seconds.
+const boshWait = 60
+
+// Create a XML stream over BOSH (XEP-0124, XEP-0206). The url is the server's
+// HTTP binding endpoint. The resulting Stream is used with NewClientXMPP in the
+// same way as a TCP one. Use an https:// url for an encrypted connection;
+// config.TLSConfig, if set, is used for it.
+func NewBOSHStream(rawurl string, config *StreamConfig) (*Stream, error) {
+
+	if config == nil {
+		config = &StreamConfig{}
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &Stream{config: config}
+	stream.logger().Info("Connecting to ", rawurl)
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config.TLSConfig}
+	conn := &boshConn{
+		url:      u,
+		client:   &http.Client{Transport: transport, Timeout: (boshWait + 30) * time.Second},
+		requests: 2,
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	conn.readCond = sync.NewCond(&conn.lock)
+
+	var rid [8]byte
+	if _, err := rand.Read(rid[:]); err != nil {
+		return nil, err
+	}
+	// Keep well clear of the largest rid the server must accept.
+	conn.rid = binary.BigEndian.Uint64(rid[:]) >> 12
+
+	return stream, stream.start(conn, u.Host)
+}
+
+// The <body/> wrapper of every BOSH request and response.
+type boshBody struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	Content  string   `xml:"content,attr,omitempty"`
+	RID      uint64   `xml:"rid,attr,omitempty"`
+	SID      string   `xml:"sid,attr,omitempty"`
+	To       string   `xml:"to,attr,omitempty"`
+	From     string   `xml:"from,attr,omitempty"`
+	Ver      string   `xml:"ver,attr,omitempty"`
+	Wait     string   `xml:"wait,attr,omitempty"`
+	Hold     string   `xml:"hold,attr,omitempty"`
+	Requests string   `xml:"requests,attr,omitempty"`
+	AuthID   string   `xml:"authid,attr,omitempty"`
+	Type     string   `xml:"type,attr,omitempty"`
+	Cond     string   `xml:"condition,attr,omitempty"`
+	Lang     string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Version  string   `xml:"urn:xmpp:xbosh version,attr,omitempty"`
+	Restart  string   `xml:"urn:xmpp:xbosh restart,attr,omitempty"`
+	Payload  []byte   `xml:",innerxml"`
+}
+
+// A BOSH session presented as a net.Conn. Writes are queued and sent in the
+// next request; the connection keeps a request open at all times so the
+// server can push stanzas, without exceeding the number of simultaneous
+// requests the server allows. Reads return the content of the responses, in
+// rid order, with the stream tags the rest of the package expects added.
+type boshConn struct {
+	url    *url.URL
+	client *http.Client
+
+	// Session parameters, set once the session is created.
+	to       string
+	sid      string
+	rid      uint64
+	requests int
+
+	lock sync.Mutex
+
+	// Elements waiting to be sent, and flags for a pending restart or
+	// terminate request.
+	queue     [][]byte
+	restart   bool
+	terminate bool
+
+	// Received data not yet read, and the error to return once it's gone.
+	readBuf  []byte
+	readErr  error
+	readCond *sync.Cond
+
+	// Signals the request loop that something was queued.
+	notify chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Response to a request, tagged with the request's rid.
+type boshResult struct {
+	rid  uint64
+	body *boshBody
+	err  error
+}
+
+func (b *boshConn) frameStart(start *xml.StartElement) error {
+
+	// Restarts are requested from the session; the response is turned into a
+	// new stream header by the request loop.
+	if b.sid != "" {
+		b.lock.Lock()
+		b.restart = true
+		b.lock.Unlock()
+		b.signal()
+		return nil
+	}
+
+	body := &boshBody{
+		Content: "text/xml; charset=utf-8",
+		RID:     b.rid,
+		Ver:     "1.11",
+		Wait:    strconv.Itoa(boshWait),
+		Hold:    "1",
+		Lang:    "en",
+		Version: "1.0",
+	}
+	for _, attr := range start.Attr {
+		if attr.Name == (xml.Name{"", "to"}) {
+			b.to = attr.Value
+		}
+	}
+	body.To = b.to
+	b.rid++
+
+	resp, err := b.post(body)
+	if err != nil {
+		return err
+	}
+	if resp.SID == "" {
+		return errors.New("BOSH session response is missing the sid")
+	}
+	b.sid = resp.SID
+	if n, err := strconv.Atoi(resp.Requests); err == nil && n > 0 {
+		b.requests = n
+	}
+
+	b.deliver(resp, true)
+	go b.loop()
+	return nil
+}
+
+func (b *boshConn) frameEnd() error {
+	b.lock.Lock()
+	b.terminate = true
+	b.lock.Unlock()
+	b.signal()
+	return nil
+}
+
+func (b *boshConn) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Send requests and collect responses until the session ends.
+func (b *boshConn) loop() {
+
+	defer b.Close()
+
+	results := make(chan boshResult)
+	outstanding := 0
+	terminated := false
+
+	// Responses are processed in rid order.
+	nextRID := b.rid
+	restarts := make(map[uint64]bool)
+	received := make(map[uint64]boshResult)
+
+	for {
+		// Send whatever's queued, or an empty poll if nothing's open, as long
+		// as the server's limit on simultaneous requests allows.
+		for !terminated && outstanding < b.requests {
+			b.lock.Lock()
+			if outstanding > 0 && len(b.queue) == 0 && !b.restart && !b.terminate {
+				b.lock.Unlock()
+				break
+			}
+			body := &boshBody{RID: b.rid, SID: b.sid, Payload: bytes.Join(b.queue, nil)}
+			if b.restart {
+				body.To = b.to
+				body.Lang = "en"
+				body.Restart = "true"
+				restarts[b.rid] = true
+			}
+			if b.terminate {
+				body.Type = "terminate"
+				terminated = true
+			}
+			b.queue, b.restart, b.terminate = nil, false, false
+			b.lock.Unlock()
+
+			b.rid++
+			outstanding++
+			go func() {
+				resp, err := b.post(body)
+				select {
+				case results <- boshResult{body.RID, resp, err}:
+				case <-b.closed:
+				}
+			}()
+		}
+
+		select {
+		case <-b.notify:
+		case r := <-results:
+			outstanding--
+			received[r.rid] = r
+			for {
+				r, ok := received[nextRID]
+				if !ok {
+					break
+				}
+				delete(received, nextRID)
+				if r.err != nil {
+					b.fail(r.err)
+					return
+				}
+				if !b.deliver(r.body, restarts[nextRID]) {
+					return
+				}
+				delete(restarts, nextRID)
+				nextRID++
+			}
+			if terminated && outstanding == 0 {
+				b.fail(io.EOF)
+				return
+			}
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// Make the response's content available to Read. Returns false if the
+// session has ended.
+func (b *boshConn) deliver(body *boshBody, header bool) bool {
+
+	buf := new(bytes.Buffer)
+	if header {
+		attrs := []xml.Attr{
+			{xml.Name{"", "xmlns"}, nsClient},
+			{xml.Name{"xmlns", "stream"}, nsStreams},
+			{xml.Name{"", "version"}, "1.0"},
+		}
+		if body.From != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"", "from"}, body.From})
+		}
+		if body.AuthID != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"", "id"}, body.AuthID})
+		}
+		writeXMLStartElement(buf, &xml.StartElement{xml.Name{"stream", "stream"}, attrs})
+	}
+	buf.Write(body.Payload)
+
+	terminated := body.Type == "terminate"
+	if terminated {
+		buf.WriteString("</stream:stream>")
+	}
+
+	b.lock.Lock()
+	b.readBuf = append(b.readBuf, buf.Bytes()...)
+	if terminated && b.readErr == nil {
+		b.readErr = io.EOF
+	}
+	b.readCond.Broadcast()
+	b.lock.Unlock()
+	return !terminated
+}
+
+// End the session with the error, returned by Read once everything received
+// has been read.
+func (b *boshConn) fail(err error) {
+	b.lock.Lock()
+	if b.readErr == nil {
+		b.readErr = err
+	}
+	b.readCond.Broadcast()
+	b.lock.Unlock()
+}
+
+// Send a request and decode the response.
+func (b *boshConn) post(body *boshBody) (*boshBody, error) {
+
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Post(b.url.String(), "text/xml; charset=utf-8", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("BOSH request failed: %s", resp.Status)
+	}
+
+	r := &boshBody{}
+	if err := xml.NewDecoder(resp.Body).Decode(r); err != nil {
+		return nil, err
+	}
+	if r.Type == "terminate" && r.Cond != "" {
+		return nil, fmt.Errorf("BOSH session terminated: %s", r.Cond)
+	}
+	return r, nil
+}
+
+func (b *boshConn) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for len(b.readBuf) == 0 && b.readErr == nil {
+		b.readCond.Wait()
+	}
+	if len(b.readBuf) == 0 {
+		return 0, b.readErr
+	}
+	n := copy(p, b.readBuf)
+	b.readBuf = b.readBuf[n:]
+	return n, nil
+}
+
+// Queue b, a complete top-level element, for the next request.
+func (b *boshConn) Write(p []byte) (int, error) {
+	select {
+	case <-b.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	data := qualifyClientElement(append([]byte(nil), p...))
+	b.lock.Lock()
+	b.queue = append(b.queue, data)
+	b.lock.Unlock()
+	b.signal()
+	return len(p), nil
+}
+
+func (b *boshConn) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.fail(io.ErrClosedPipe)
+	})
+	return nil
+}
+
+func (b *boshConn) LocalAddr() net.Addr                { return boshAddr{b.url} }
+func (b *boshConn) RemoteAddr() net.Addr               { return boshAddr{b.url} }
+func (b *boshConn) SetDeadline(t time.Time) error      { return nil }
+func (b *boshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (b *boshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// The address of a BOSH connection is the endpoint's URL.
+type boshAddr struct {
+	url *url.URL
+}
+
+func (a boshAddr) Network() string { return "bosh" }
+func (a boshAddr) String() string  { return a.url.String() }
@@ -0,0 +1,71 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBOSHStream(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var body boshBody
+		if err := xml.Unmarshal(data, &body); err != nil {
+			t.Errorf("bad request body: %v", err)
+			return
+		}
+		switch {
+		case body.SID == "":
+			w.Write([]byte(`<body xmlns="http://jabber.org/protocol/httpbind" xmlns:stream="http://etherx.jabber.org/streams" sid="s1" requests="2" from="example.com" authid="a1">` +
+				`<stream:features><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></stream:features></body>`))
+		case bytes.Contains(body.Payload, []byte("ping")):
+			w.Write([]byte(`<body xmlns="http://jabber.org/protocol/httpbind"><message xmlns="jabber:client" from="example.com"><body>pong</body></message></body>`))
+		case body.Type == "terminate":
+			w.Write([]byte(`<body xmlns="http://jabber.org/protocol/httpbind" type="terminate"/>`))
+		default:
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte(`<body xmlns="http://jabber.org/protocol/httpbind"/>`))
+		}
+	}))
+	defer server.Close()
+
+	stream, err := NewBOSHStream(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if err := startClient(stream, JID{Node: "alice", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	f := features{}
+	if err := stream.Decode(&f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.Bind == nil {
+		t.Errorf("features = %+v, want bind", f)
+	}
+
+	if err := stream.Send(&Message{To: "example.com", Body: []MessageBody{{Value: "ping"}}}); err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{}
+	if err := stream.Decode(&msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Body) != 1 || msg.Body[0].Value != "pong" {
+		t.Errorf("message = %+v, want pong", msg)
+	}
+
+	if err := stream.SendEnd(&xml.EndElement{xml.Name{"stream", "stream"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Next(); err == nil {
+		t.Error("stream not ended after terminate")
+	}
+}
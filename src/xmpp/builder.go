@@ -0,0 +1,182 @@
+package xmpp
+
+import (
+	"time"
+)
+
+// Builds a Message. Create one with XMPP.NewMessage.
+type MessageBuilder struct {
+	msg      Message
+	originID bool
+}
+
+// Start building a message to the JID. The message is given a new id and is
+// from the XMPP instance's JID unless set otherwise.
+func (x *XMPP) NewMessage(to JID) *MessageBuilder {
+	return &MessageBuilder{msg: Message{ID: x.newID(), To: to.Full(), From: x.JID.Full()}}
+}
+
+func (b *MessageBuilder) ID(id string) *MessageBuilder {
+	b.msg.ID = id
+	return b
+}
+
+func (b *MessageBuilder) From(from JID) *MessageBuilder {
+	b.msg.From = from.Full()
+	return b
+}
+
+// Set the message type, one of the MessageType constants.
+func (b *MessageBuilder) Type(msgType string) *MessageBuilder {
+	b.msg.Type = msgType
+	return b
+}
+
+// Add a body. Call more than once to add bodies in several languages.
+func (b *MessageBuilder) Body(text string) *MessageBuilder {
+	b.msg.Body = append(b.msg.Body, MessageBody{Value: text})
+	return b
+}
+
+// Add a body in the given language.
+func (b *MessageBuilder) BodyLang(lang, text string) *MessageBuilder {
+	b.msg.Body = append(b.msg.Body, MessageBody{Lang: lang, Value: text})
+	return b
+}
+
+// Add an XHTML-IM body, the XHTML to go inside its <body/>. A plain body
+// must be added as well.
+func (b *MessageBuilder) HTML(xhtml string) *MessageBuilder {
+	if b.msg.HTML == nil {
+		b.msg.HTML = &XHTMLIM{}
+	}
+	b.msg.HTML.Bodies = append(b.msg.HTML.Bodies, XHTMLBody{Content: xhtml})
+	return b
+}
+
+// Attach an out of band URL with an optional description.
+func (b *MessageBuilder) OOB(url, desc string) *MessageBuilder {
+	b.msg.AttachURL(url, desc)
+	return b
+}
+
+func (b *MessageBuilder) Subject(subject string) *MessageBuilder {
+	b.msg.Subject = subject
+	return b
+}
+
+// Set the conversation thread the message belongs to. parent, the thread it
+// was started from, may be empty.
+func (b *MessageBuilder) Thread(id, parent string) *MessageBuilder {
+	b.msg.Thread = &Thread{ID: id, Parent: parent}
+	return b
+}
+
+// Mark the message as a correction of the message with the id. See
+// XMPP.Correct, which also checks the id is of the last message sent.
+func (b *MessageBuilder) Replace(id string) *MessageBuilder {
+	b.msg.Replace = &Replace{ID: id}
+	return b
+}
+
+// Include an origin id (XEP-0359), the same as the message's id, so the
+// message can be recognised when it comes back from an archive or a MUC room.
+func (b *MessageBuilder) OriginID() *MessageBuilder {
+	b.originID = true
+	return b
+}
+
+// Set the nickname the user would like to be known by, e.g. in a first
+// message to someone new.
+func (b *MessageBuilder) Nick(nick string) *MessageBuilder {
+	b.msg.Nick = nick
+	return b
+}
+
+func (b *MessageBuilder) Lang(lang string) *MessageBuilder {
+	b.msg.Lang = lang
+	return b
+}
+
+// Return the message. The builder may be reused; later changes don't affect
+// messages already built.
+func (b *MessageBuilder) Build() *Message {
+	msg := b.msg
+	msg.Body = append([]MessageBody(nil), b.msg.Body...)
+	msg.OOB = append([]OOB(nil), b.msg.OOB...)
+	if b.msg.HTML != nil {
+		msg.HTML = &XHTMLIM{Bodies: append([]XHTMLBody(nil), b.msg.HTML.Bodies...)}
+	}
+	if b.originID {
+		msg.OriginID = &OriginID{ID: msg.ID}
+	}
+	return &msg
+}
+
+// Builds a Presence. Create one with XMPP.NewPresence.
+type PresenceBuilder struct {
+	p Presence
+}
+
+// Start building a presence. It's given a new id and is from the XMPP
+// instance's JID unless set otherwise. Without a To it's broadcast to the
+// user's contacts.
+func (x *XMPP) NewPresence() *PresenceBuilder {
+	return &PresenceBuilder{Presence{ID: x.newID(), From: x.JID.Full()}}
+}
+
+func (b *PresenceBuilder) ID(id string) *PresenceBuilder {
+	b.p.ID = id
+	return b
+}
+
+func (b *PresenceBuilder) From(from JID) *PresenceBuilder {
+	b.p.From = from.Full()
+	return b
+}
+
+func (b *PresenceBuilder) To(to JID) *PresenceBuilder {
+	b.p.To = to.Full()
+	return b
+}
+
+// Set the presence type, one of the PresenceType constants.
+func (b *PresenceBuilder) Type(presenceType string) *PresenceBuilder {
+	b.p.Type = presenceType
+	return b
+}
+
+// Set the availability, one of the PresenceShow constants.
+func (b *PresenceBuilder) Show(show PresenceShow) *PresenceBuilder {
+	b.p.Show = show
+	return b
+}
+
+func (b *PresenceBuilder) Status(status string) *PresenceBuilder {
+	b.p.Status = status
+	return b
+}
+
+func (b *PresenceBuilder) Priority(priority int8) *PresenceBuilder {
+	b.p.Priority = priority
+	return b
+}
+
+// Set the nickname the user would like to be known by, sent in subscription
+// requests.
+func (b *PresenceBuilder) Nick(nick string) *PresenceBuilder {
+	b.p.Nick = nick
+	return b
+}
+
+// Advertise that the user has been idle since the time.
+func (b *PresenceBuilder) IdleSince(since time.Time) *PresenceBuilder {
+	b.p.SetIdleSince(since)
+	return b
+}
+
+// Return the presence. The builder may be reused.
+func (b *PresenceBuilder) Build() *Presence {
+	p := b.p
+	return &p
+}
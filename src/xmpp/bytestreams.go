@@ -0,0 +1,615 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	NSBytestreams = "http://jabber.org/protocol/bytestreams"
+
+	// Port of a streamhost that doesn't give one.
+	StreamHostDefaultPort = 1080
+)
+
+// XEP-0065: SOCKS5 Bytestreams
+type bytestreamQuery struct {
+	XMLName        xml.Name        `xml:"http://jabber.org/protocol/bytestreams query"`
+	SID            string          `xml:"sid,attr,omitempty"`
+	Mode           string          `xml:"mode,attr,omitempty"`
+	StreamHosts    []StreamHost    `xml:"streamhost"`
+	StreamHostUsed *streamHostUsed `xml:"streamhost-used"`
+	Activate       string          `xml:"activate,omitempty"`
+}
+
+// A SOCKS5 server offered for a bytestream, either the initiator itself or a
+// proxy.
+type StreamHost struct {
+	JID  string `xml:"jid,attr"`
+	Host string `xml:"host,attr"`
+	Port int    `xml:"port,attr,omitempty"`
+}
+
+type streamHostUsed struct {
+	JID string `xml:"jid,attr"`
+}
+
+// Bytestream configuration, for SOCKS5 bytestreams and the in-band
+// bytestreams used in their place when no streamhost is reachable.
+type BytestreamConfig struct {
+	// Address to listen on for direct connections from the recipient, e.g.
+	// ":7777" or ":0" for any port. Empty means only proxies are offered.
+	Listen string
+
+	// Hosts offered for direct connections, at the port listened on. Defaults
+	// to the listening address or, if that's unspecified, the addresses of
+	// the local network interfaces.
+	Hosts []string
+
+	// Proxies to offer. If nil, the server's proxies are discovered.
+	Proxies []StreamHost
+
+	// Don't discover the server's proxies when Proxies is nil.
+	NoProxyDiscovery bool
+
+	// Time allowed to connect to each streamhost. 0 means 10 seconds.
+	ConnectTimeout time.Duration
+
+	// Block size of in-band bytestreams. 0 means IBBDefaultBlockSize.
+	IBBBlockSize int
+}
+
+func (config *BytestreamConfig) connectTimeout() time.Duration {
+	if config.ConnectTimeout > 0 {
+		return config.ConnectTimeout
+	}
+	return 10 * time.Second
+}
+
+// Returned when there's no streamhost to offer: nothing to listen on and no
+// proxies.
+var ErrNoStreamHosts = errors.New("no SOCKS5 bytestream streamhosts")
+
+// An incoming bytestream, over SOCKS5 or in-band. Read it until io.EOF, then
+// close it.
+type Bytestream struct {
+	From JID
+	SID  string
+	io.ReadCloser
+}
+
+// Return the SOCKS5 destination address identifying a bytestream: the hex
+// SHA-1 of the session id and the initiator's and target's full JIDs.
+func socks5Address(sid string, initiator, target JID) string {
+	sum := sha1.Sum([]byte(sid + initiator.Full() + target.Full()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Open a bytestream to the entity. SOCKS5 is tried first, direct then via a
+// proxy, falling back to an in-band bytestream if the recipient can't
+// connect to any streamhost. Closing the writer closes the stream. An
+// in-band bytestream's writes also fail once the context is done, as for
+// OpenIBB.
+func (x *XMPP) OpenBytestream(ctx context.Context, to JID) (io.WriteCloser, error) {
+	return x.sendBytestream(ctx, to, UUID4())
+}
+
+func (x *XMPP) sendBytestream(ctx context.Context, to JID, sid string) (io.WriteCloser, error) {
+	conn, err := x.openSOCKS5(ctx, to, sid)
+	if err == nil {
+		return conn, nil
+	}
+	if serr, ok := err.(*StanzaError); ok && serr.Condition != ErrorItemNotFound {
+		return nil, err
+	}
+	x.logger().Info("Using in-band bytestream. ", err)
+	return x.openIBB(ctx, to, sid, x.bytestreamConfig().IBBBlockSize)
+}
+
+// Negotiate a SOCKS5 bytestream as the initiator.
+func (x *XMPP) openSOCKS5(ctx context.Context, to JID, sid string) (net.Conn, error) {
+	config := x.bytestreamConfig()
+	addr := socks5Address(sid, x.JID, to)
+
+	var hosts []StreamHost
+	var direct chan net.Conn
+	if config.Listen != "" {
+		l, err := net.Listen("tcp", config.Listen)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		hosts = append(hosts, directStreamHosts(l, x.JID.Full(), config.Hosts)...)
+		direct = make(chan net.Conn, 1)
+		go acceptSOCKS5(l, addr, config.connectTimeout(), direct)
+	}
+	hosts = append(hosts, x.bytestreamProxies(ctx, config)...)
+	if len(hosts) == 0 {
+		return nil, ErrNoStreamHosts
+	}
+
+	req, err := x.newIQSet(to, &bytestreamQuery{SID: sid, Mode: "tcp", StreamHosts: hosts})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	query := &bytestreamQuery{}
+	if err := resp.PayloadDecode(query); err != nil {
+		return nil, err
+	}
+	if query.StreamHostUsed == nil {
+		return nil, fmt.Errorf("Unexpected: no streamhost-used")
+	}
+	used := query.StreamHostUsed.JID
+
+	// The recipient connected to us directly.
+	if used == x.JID.Full() && direct != nil {
+		select {
+		case conn := <-direct:
+			return conn, nil
+		case <-time.After(config.connectTimeout()):
+			return nil, fmt.Errorf("Unexpected: no direct connection from %s", to)
+		}
+	}
+
+	for _, host := range hosts {
+		if host.JID != used || host.JID == x.JID.Full() {
+			continue
+		}
+		conn, err := dialSOCKS5(host, addr, config.connectTimeout())
+		if err != nil {
+			return nil, err
+		}
+		activate := &IQ{ID: x.newID(), Type: IQTypeSet, To: host.JID}
+		activate.PayloadEncode(&bytestreamQuery{SID: sid, Activate: to.Full()})
+		if _, err := x.SendRecvContext(ctx, activate); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("Unexpected: unknown streamhost %s", used)
+}
+
+// Call fn, in a new goroutine, with each bytestream another entity opens,
+// other than those negotiated with stream initiation. If no streamhost is
+// reachable the initiator is expected to open an in-band bytestream instead,
+// which is also passed to fn. Both are advertised in disco#info.
+func (x *XMPP) HandleBytestream(fn func(*Bytestream)) FilterID {
+	x.AddDiscoFeature(NSBytestreams)
+	x.AddDiscoFeature(NSIBB)
+	x.installBytestreams()
+	return x.addResponder(
+		x.bytestreamOpenMatcher(false),
+		func(v interface{}) {
+			iq := v.(*IQ)
+			query, from, ok := x.bytestreamRequest(iq)
+			if !ok {
+				return
+			}
+			if conn := x.connectStreamHosts(iq, query, from); conn != nil {
+				go fn(&Bytestream{From: from, SID: query.SID, ReadCloser: conn})
+				return
+			}
+			ch, cancel := x.expectIBB(from, query.SID)
+			x.writeError(iq, ErrorTypeCancel, ErrorItemNotFound)
+			go func() {
+				timer := time.AfterFunc(x.bytestreamConfig().connectTimeout(), cancel)
+				defer timer.Stop()
+				if s, ok := <-ch; ok {
+					fn(&Bytestream{From: from, SID: query.SID, ReadCloser: s})
+				}
+			}()
+		},
+	)
+}
+
+// A bytestream negotiated beforehand, waiting to be opened.
+type expectedBytestream struct {
+	ch        chan *Bytestream
+	cancelIBB func()
+}
+
+// Wait for the entity to open a bytestream, SOCKS5 or in-band, with the
+// session id. The returned channel receives the stream once it's open, or is
+// closed if the wait is cancelled with the returned function.
+func (x *XMPP) expectBytestream(from JID, sid string) (chan *Bytestream, func()) {
+	x.installBytestreams()
+	key := bytestreamKey{from.Full(), sid}
+	ibb, cancelIBB := x.expectIBB(from, sid)
+	e := &expectedBytestream{ch: make(chan *Bytestream, 1), cancelIBB: cancelIBB}
+	x.bytestreamLock.Lock()
+	x.bytestreamExpected[key] = e
+	x.bytestreamLock.Unlock()
+
+	go func() {
+		s, ok := <-ibb
+		if !ok {
+			return
+		}
+		if x.takeExpectedBytestream(key) != e {
+			s.Close()
+			return
+		}
+		e.ch <- &Bytestream{From: from, SID: sid, ReadCloser: s}
+		close(e.ch)
+	}()
+
+	cancel := func() {
+		if x.takeExpectedBytestream(key) == e {
+			cancelIBB()
+			close(e.ch)
+		}
+	}
+	return e.ch, cancel
+}
+
+func (x *XMPP) takeExpectedBytestream(key bytestreamKey) *expectedBytestream {
+	x.bytestreamLock.Lock()
+	defer x.bytestreamLock.Unlock()
+	e := x.bytestreamExpected[key]
+	delete(x.bytestreamExpected, key)
+	return e
+}
+
+// Install the handler for SOCKS5 bytestreams negotiated beforehand. Done the
+// first time bytestreams are used.
+func (x *XMPP) installBytestreams() {
+	x.bytestreamOnce.Do(func() {
+		x.bytestreamLock.Lock()
+		x.bytestreamExpected = make(map[bytestreamKey]*expectedBytestream)
+		x.bytestreamLock.Unlock()
+		x.addResponder(x.bytestreamOpenMatcher(true), func(v interface{}) {
+			iq := v.(*IQ)
+			query, from, ok := x.bytestreamRequest(iq)
+			if !ok {
+				return
+			}
+			key := bytestreamKey{iq.From, query.SID}
+			conn := x.connectStreamHosts(iq, query, from)
+			if conn == nil {
+				// Still expecting an in-band bytestream in its place.
+				x.writeError(iq, ErrorTypeCancel, ErrorItemNotFound)
+				return
+			}
+			e := x.takeExpectedBytestream(key)
+			if e == nil {
+				conn.Close()
+				return
+			}
+			e.cancelIBB()
+			e.ch <- &Bytestream{From: from, SID: query.SID, ReadCloser: conn}
+			close(e.ch)
+		})
+	})
+}
+
+// Matcher for <iq type="set"/> bytestream requests offering streamhosts,
+// either those negotiated beforehand or, if expected is false, the rest.
+func (x *XMPP) bytestreamOpenMatcher(expected bool) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeSet || iq.PayloadName() != (xml.Name{NSBytestreams, "query"}) {
+				return false
+			}
+			query := &bytestreamQuery{}
+			if iq.PayloadDecode(query) != nil || query.Activate != "" {
+				return false
+			}
+			x.bytestreamLock.Lock()
+			_, ok = x.bytestreamExpected[bytestreamKey{iq.From, query.SID}]
+			x.bytestreamLock.Unlock()
+			return ok == expected
+		},
+	)
+}
+
+// Decode a bytestream request, replying with an error if it can't be used.
+func (x *XMPP) bytestreamRequest(iq *IQ) (*bytestreamQuery, JID, bool) {
+	query := &bytestreamQuery{}
+	if err := iq.PayloadDecode(query); err != nil || query.SID == "" {
+		x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+		return nil, JID{}, false
+	}
+	if query.Mode == "udp" {
+		x.writeError(iq, ErrorTypeCancel, ErrorFeatureNotImplemented)
+		return nil, JID{}, false
+	}
+	from, err := ParseJID(iq.From)
+	if err != nil {
+		x.writeError(iq, ErrorTypeModify, ErrorJIDMalformed)
+		return nil, JID{}, false
+	}
+	return query, from, true
+}
+
+// Connect, as the target, to the first reachable streamhost and tell the
+// initiator which was used. Returns nil, without replying, if none is
+// reachable.
+func (x *XMPP) connectStreamHosts(iq *IQ, query *bytestreamQuery, from JID) net.Conn {
+	target := x.JID
+	if iq.To != "" {
+		if jid, err := ParseJID(iq.To); err == nil {
+			target = jid
+		}
+	}
+	addr := socks5Address(query.SID, from, target)
+	timeout := x.bytestreamConfig().connectTimeout()
+	for _, host := range query.StreamHosts {
+		conn, err := dialSOCKS5(host, addr, timeout)
+		if err != nil {
+			x.logger().Debug("Can't connect to streamhost ", host.JID, ". ", err)
+			continue
+		}
+		resp := iq.Reply(&bytestreamQuery{SID: query.SID, StreamHostUsed: &streamHostUsed{JID: host.JID}})
+		if err := x.write(resp); err != nil {
+			conn.Close()
+			return nil
+		}
+		return conn
+	}
+	return nil
+}
+
+// Return the proxies to offer: the configured ones or, unless disabled, the
+// server's, discovered the first time they're needed.
+func (x *XMPP) bytestreamProxies(ctx context.Context, config *BytestreamConfig) []StreamHost {
+	if config.Proxies != nil || config.NoProxyDiscovery {
+		return config.Proxies
+	}
+	x.bytestreamProxyLock.Lock()
+	defer x.bytestreamProxyLock.Unlock()
+	if x.bytestreamProxyList != nil {
+		return x.bytestreamProxyList
+	}
+	hosts := x.discoverProxies(ctx)
+	// Discovery cut short isn't remembered.
+	if ctx.Err() == nil {
+		x.bytestreamProxyList = hosts
+	}
+	return hosts
+}
+
+// Find the server's SOCKS5 bytestream proxies.
+func (x *XMPP) discoverProxies(ctx context.Context) []StreamHost {
+	hosts := []StreamHost{}
+	items, err := x.discoItems(ctx, x.JID.Domain, "", "")
+	if err != nil {
+		return hosts
+	}
+	for _, item := range items.Item {
+		info, err := x.discoInfo(ctx, item.JID, "", "")
+		if err != nil || !isBytestreamProxy(info) {
+			continue
+		}
+		req := &IQ{ID: x.newID(), Type: IQTypeGet, To: item.JID}
+		req.PayloadEncode(&bytestreamQuery{})
+		resp, err := x.SendRecvContext(ctx, req)
+		if err != nil {
+			continue
+		}
+		query := &bytestreamQuery{}
+		if err := resp.PayloadDecode(query); err != nil {
+			continue
+		}
+		hosts = append(hosts, query.StreamHosts...)
+	}
+	return hosts
+}
+
+func isBytestreamProxy(info *DiscoInfo) bool {
+	for _, identity := range info.Identity {
+		if identity.Category == "proxy" && identity.Type == "bytestreams" {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *XMPP) bytestreamConfig() *BytestreamConfig {
+	if x.bytestreams == nil {
+		return &BytestreamConfig{}
+	}
+	return x.bytestreams
+}
+
+// Return the streamhosts for direct connections to the listener.
+func directStreamHosts(l net.Listener, jid string, hosts []string) []StreamHost {
+	addr := l.Addr().(*net.TCPAddr)
+	if len(hosts) == 0 {
+		if !addr.IP.IsUnspecified() {
+			hosts = []string{addr.IP.String()}
+		} else if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range addrs {
+				if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+					hosts = append(hosts, ipnet.IP.String())
+				}
+			}
+		}
+	}
+	streamHosts := make([]StreamHost, 0, len(hosts))
+	for _, host := range hosts {
+		streamHosts = append(streamHosts, StreamHost{JID: jid, Host: host, Port: addr.Port})
+	}
+	return streamHosts
+}
+
+// Dial the streamhost and request a connection to the address.
+func dialSOCKS5(host StreamHost, addr string, timeout time.Duration) (net.Conn, error) {
+	port := host.Port
+	if port == 0 {
+		port = StreamHostDefaultPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host.Host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := socks5Connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Accept connections on the listener until one for the address has been
+// sent to ch or the listener is closed.
+func acceptSOCKS5(l net.Listener, addr string, timeout time.Duration, ch chan net.Conn) {
+	var once sync.Once
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn.SetDeadline(time.Now().Add(timeout))
+			requested, err := socks5Serve(conn)
+			if err != nil || requested != addr {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			sent := false
+			once.Do(func() {
+				ch <- conn
+				sent = true
+			})
+			if !sent {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// SOCKS5 (RFC 1928) constants used by bytestreams.
+const (
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5CmdConnect     = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomainName = 3
+	socks5AddrIPv6       = 4
+	socks5Succeeded      = 0
+	socks5Refused        = 5
+	socks5NoMethods      = 0xff
+)
+
+// Ask the SOCKS5 server for a connection to the domain name address, port 0.
+func socks5Connect(conn net.Conn, addr string) error {
+	if _, err := conn.Write([]byte{socks5Version, 1, socks5NoAuth}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != socks5NoAuth {
+		return fmt.Errorf("Unexpected: SOCKS5 method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomainName, byte(len(addr))}
+	req = append(req, addr...)
+	req = append(req, 0, 0)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != socks5Version || head[1] != socks5Succeeded {
+		return fmt.Errorf("Unexpected: SOCKS5 reply %d", head[1])
+	}
+	_, err := readSOCKS5Addr(conn, head[3])
+	return err
+}
+
+// Serve a SOCKS5 connect request, sent by a bytestream's target, returning
+// the requested domain name address.
+func socks5Serve(conn net.Conn) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version || !bytesContain(methods, socks5NoAuth) {
+		conn.Write([]byte{socks5Version, socks5NoMethods})
+		return "", fmt.Errorf("Unexpected: SOCKS5 methods %v", methods)
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", err
+	}
+	addr, err := readSOCKS5Addr(conn, req[3])
+	if err != nil {
+		return "", err
+	}
+	if req[1] != socks5CmdConnect || req[3] != socks5AddrDomainName {
+		conn.Write([]byte{socks5Version, socks5Refused, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("Unexpected: SOCKS5 request %d", req[1])
+	}
+	reply := []byte{socks5Version, socks5Succeeded, 0, socks5AddrDomainName, byte(len(addr))}
+	reply = append(reply, addr...)
+	reply = append(reply, 0, 0)
+	if _, err := conn.Write(reply); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// Read a SOCKS5 address and port of the type, returning the address.
+func readSOCKS5Addr(r io.Reader, addrType byte) (string, error) {
+	var n int
+	switch addrType {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomainName:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		n = int(size[0])
+	default:
+		return "", fmt.Errorf("Unexpected: SOCKS5 address type %d", addrType)
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	if addrType == socks5AddrDomainName {
+		return string(buf[:n]), nil
+	}
+	return net.IP(buf[:n]).String(), nil
+}
+
+func bytesContain(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
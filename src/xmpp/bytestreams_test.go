@@ -0,0 +1,73 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func testBytestream(t *testing.T, config *BytestreamConfig) {
+	alice, bob := newTestXMPPPair()
+	defer alice.stream.Close()
+	alice.bytestreams = config
+	bob.bytestreams = &BytestreamConfig{ConnectTimeout: config.ConnectTimeout}
+
+	received := make(chan []byte)
+	bob.HandleBytestream(func(s *Bytestream) {
+		defer s.Close()
+		if s.From != alice.JID {
+			t.Errorf("unexpected from %v", s.From)
+		}
+		data, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	})
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	w, err := alice.OpenBytestream(context.Background(), bob.JID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, expected %d", len(got), len(data))
+	}
+}
+
+func TestBytestreamDirect(t *testing.T) {
+	testBytestream(t, &BytestreamConfig{Listen: "127.0.0.1:0", NoProxyDiscovery: true})
+}
+
+func TestBytestreamFallbackToIBB(t *testing.T) {
+	// A proxy that isn't listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	testBytestream(t, &BytestreamConfig{
+		Proxies:      []StreamHost{{JID: "proxy.example.com", Host: "127.0.0.1", Port: port}},
+		IBBBlockSize: 1024,
+	})
+}
+
+func TestSOCKS5Address(t *testing.T) {
+	// SHA-1 of "vxf9n471bn46requester@example.com/footarget@example.org/bar".
+	initiator := JID{Node: "requester", Domain: "example.com", Resource: "foo"}
+	target := JID{Node: "target", Domain: "example.org", Resource: "bar"}
+	addr := socks5Address("vxf9n471bn46", initiator, target)
+	if addr != "98b8d688d0f5d895fd41c5e7309a2e9e33ba32ff" {
+		t.Errorf("unexpected address %s", addr)
+	}
+}
@@ -0,0 +1,209 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	NSCaps = "http://jabber.org/protocol/caps"
+)
+
+// XEP-0115: Entity Capabilities
+
+// The <c/> element attached to presence.
+type EntityCaps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+	Ext     string   `xml:"ext,attr,omitempty"`
+}
+
+// Entity capabilities for an XMPP instance. Once a node is set, a <c/> element
+// is attached to every outgoing broadcast presence that doesn't already have
+// one. It also caches the disco#info of remote entities by ver.
+type Caps struct {
+	x     *XMPP
+	lock  sync.Mutex
+	node  string
+	cache map[string]*DiscoInfo
+}
+
+// Return the XMPP instance's entity capabilities.
+func (x *XMPP) Caps() *Caps {
+	return x.caps
+}
+
+// Set the node, a URI identifying the software, e.g.
+// "https://example.com/client". Setting a node also makes the XMPP instance
+// answer disco#info requests, see AddDiscoFeature.
+func (c *Caps) SetNode(node string) {
+	c.lock.Lock()
+	c.node = node
+	c.lock.Unlock()
+
+	c.x.discoLock.Lock()
+	defer c.x.discoLock.Unlock()
+	c.x.answerDiscoInfo()
+}
+
+// Return the verification string for our current identities and features.
+func (c *Caps) Ver() string {
+	return CapsVer(c.x.localDiscoInfo())
+}
+
+// Return the <c/> element for our capabilities, or nil if no node is set.
+func (c *Caps) Element() *EntityCaps {
+	c.lock.Lock()
+	node := c.node
+	c.lock.Unlock()
+	if node == "" {
+		return nil
+	}
+	return &EntityCaps{Hash: "sha-1", Node: node, Ver: c.Ver()}
+}
+
+// Return the cached disco#info for the verification string.
+func (c *Caps) Lookup(ver string) (*DiscoInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	info, ok := c.cache[ver]
+	return info, ok
+}
+
+// Return a copy of the presence with our <c/> element attached, if needed.
+func (c *Caps) attach(p *Presence) *Presence {
+	if p.Type != "" || p.To != "" || p.Caps != nil {
+		return p
+	}
+	e := c.Element()
+	if e == nil {
+		return p
+	}
+	cp := *p
+	cp.Caps = e
+	return &cp
+}
+
+// Return the disco#info for the capabilities advertised by from, querying the
+// entity only if it's not already cached. Only valid results that match their
+// sha-1 verification string are cached; others are returned but queried again
+// next time.
+func (x *XMPP) CapsInfo(ctx context.Context, from string, caps *EntityCaps) (*DiscoInfo, error) {
+
+	if info, ok := x.caps.Lookup(caps.Ver); ok {
+		return info, nil
+	}
+
+	info, err := x.discoInfo(ctx, from, "", caps.Node+"#"+caps.Ver)
+	if err != nil {
+		return nil, err
+	}
+
+	if caps.Hash == "sha-1" && validCapsInfo(info) && CapsVer(info) == caps.Ver {
+		x.caps.lock.Lock()
+		x.caps.cache[caps.Ver] = info
+		x.caps.lock.Unlock()
+	}
+
+	return info, nil
+}
+
+// Generate the sha-1 verification string for the disco#info, including
+// extended information forms as XEP-0115 section 5.4 specifies. Forms without
+// a hidden FORM_TYPE field are left out.
+func CapsVer(info *DiscoInfo) string {
+
+	identities := make([]string, 0, len(info.Identity))
+	for _, i := range info.Identity {
+		identities = append(identities, i.Category+"/"+i.Type+"/"+i.Lang+"/"+i.Name)
+	}
+	sort.Strings(identities)
+
+	features := info.Features()
+	sort.Strings(features)
+
+	s := strings.Join(identities, "<") + "<"
+	if len(features) > 0 {
+		s += strings.Join(features, "<") + "<"
+	}
+
+	forms := capsForms(info)
+	sort.Slice(forms, func(i, j int) bool {
+		return forms[i].FormType() < forms[j].FormType()
+	})
+	for _, form := range forms {
+		s += form.FormType() + "<"
+		fields := make([]FormField, 0, len(form.Fields))
+		for _, field := range form.Fields {
+			if field.Var != "FORM_TYPE" {
+				fields = append(fields, field)
+			}
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Var < fields[j].Var
+		})
+		for _, field := range fields {
+			s += field.Var + "<"
+			values := append([]string(nil), field.Values...)
+			sort.Strings(values)
+			for _, value := range values {
+				s += value + "<"
+			}
+		}
+	}
+
+	sum := sha1.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Return the forms that take part in the verification string.
+func capsForms(info *DiscoInfo) []*Form {
+	var forms []*Form
+	for i := range info.Forms {
+		field := info.Forms[i].Field("FORM_TYPE")
+		if field != nil && field.Type == FormFieldHidden {
+			forms = append(forms, &info.Forms[i])
+		}
+	}
+	return forms
+}
+
+// Return false if the disco#info can't be trusted to match its verification
+// string: it has duplicate identities or features, or several forms or values
+// for a FORM_TYPE.
+func validCapsInfo(info *DiscoInfo) bool {
+
+	seen := make(map[string]bool)
+	for _, i := range info.Identity {
+		key := i.Category + "/" + i.Type + "/" + i.Lang + "/" + i.Name
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+
+	seen = make(map[string]bool)
+	for _, f := range info.Feature {
+		if seen[f.Var] {
+			return false
+		}
+		seen[f.Var] = true
+	}
+
+	seen = make(map[string]bool)
+	for _, form := range capsForms(info) {
+		if len(form.Values("FORM_TYPE")) != 1 || seen[form.FormType()] {
+			return false
+		}
+		seen[form.FormType()] = true
+	}
+
+	return true
+}
@@ -0,0 +1,61 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+// Simple generation example from XEP-0115, section 5.2.
+func TestCapsVer(t *testing.T) {
+	info := &DiscoInfo{
+		Identity: []DiscoIdentity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		Feature: []DiscoFeature{
+			{Var: "http://jabber.org/protocol/muc"},
+			{Var: "http://jabber.org/protocol/disco#info"},
+			{Var: "http://jabber.org/protocol/caps"},
+			{Var: "http://jabber.org/protocol/disco#items"},
+		},
+	}
+	if ver := CapsVer(info); ver != "QgayPKawpkPSDYmwT/WM94uAlu0=" {
+		t.Fatal(ver)
+	}
+}
+
+// Complex generation example from XEP-0115, section 5.3, with the fields
+// reordered.
+func TestCapsVerForms(t *testing.T) {
+	info := &DiscoInfo{}
+	err := xml.Unmarshal([]byte(`<query xmlns="http://jabber.org/protocol/disco#info">
+		<identity xml:lang="en" category="client" name="Psi 0.11" type="pc"/>
+		<identity xml:lang="el" category="client" name="Ψ 0.11" type="pc"/>
+		<feature var="http://jabber.org/protocol/caps"/>
+		<feature var="http://jabber.org/protocol/disco#info"/>
+		<feature var="http://jabber.org/protocol/disco#items"/>
+		<feature var="http://jabber.org/protocol/muc"/>
+		<x xmlns="jabber:x:data" type="result">
+			<field var="os"><value>Mac</value></field>
+			<field var="FORM_TYPE" type="hidden"><value>urn:xmpp:dataforms:softwareinfo</value></field>
+			<field var="ip_version"><value>ipv6</value><value>ipv4</value></field>
+			<field var="os_version"><value>10.5.1</value></field>
+			<field var="software"><value>Psi</value></field>
+			<field var="software_version"><value>0.11</value></field>
+		</x>
+		<x xmlns="jabber:x:data" type="result">
+			<field var="ignored"><value>no FORM_TYPE</value></field>
+		</x>
+	</query>`), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver := CapsVer(info); ver != "q07IKJEyjvHSyhy//CH0CxmKi8w=" {
+		t.Error(ver)
+	}
+	if !validCapsInfo(info) {
+		t.Error("valid disco#info refused")
+	}
+
+	info.Forms = append(info.Forms, info.Forms[0])
+	if validCapsInfo(info) {
+		t.Error("disco#info with two forms of a FORM_TYPE accepted")
+	}
+}
@@ -0,0 +1,90 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+const (
+	NSCarbons = "urn:xmpp:carbons:2"
+	NSForward = "urn:xmpp:forward:0"
+)
+
+// XEP-0280: Message Carbons
+
+// Direction of a carbon copied message.
+type CarbonDirection string
+
+const (
+	// Sent by another of the user's resources.
+	CarbonSent CarbonDirection = "sent"
+	// Received by another of the user's resources.
+	CarbonReceived CarbonDirection = "received"
+)
+
+// A <sent/> or <received/> carbon wrapper.
+type Carbon struct {
+	Forwarded *Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// XEP-0297: Stanza Forwarding
+type Forwarded struct {
+	XMLName xml.Name `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay   `xml:"urn:xmpp:delay delay"`
+	Message *Message `xml:"message"`
+}
+
+type carbonsEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 enable"`
+}
+
+type carbonsDisable struct {
+	XMLName xml.Name `xml:"urn:xmpp:carbons:2 disable"`
+}
+
+// Ask the server to send us carbon copies of messages sent and received by
+// the user's other resources. Carbon copies are unwrapped and delivered as
+// ordinary messages with Message.Carbon set.
+func (x *XMPP) EnableCarbons(ctx context.Context) error {
+	return x.setCarbons(ctx, &carbonsEnable{})
+}
+
+// Stop receiving carbon copies.
+func (x *XMPP) DisableCarbons(ctx context.Context) error {
+	return x.setCarbons(ctx, &carbonsDisable{})
+}
+
+func (x *XMPP) setCarbons(ctx context.Context, payload interface{}) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeSet}
+	req.PayloadEncode(payload)
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Return the message forwarded by a carbon copy, or msg itself if it isn't a
+// carbon. Carbons are only accepted from the user's own account; anyone else
+// could use them to forge messages.
+func (x *XMPP) unwrapCarbon(msg *Message) *Message {
+
+	var carbon *Carbon
+	var direction CarbonDirection
+	switch {
+	case msg.CarbonSent != nil:
+		carbon, direction = msg.CarbonSent, CarbonSent
+	case msg.CarbonReceived != nil:
+		carbon, direction = msg.CarbonReceived, CarbonReceived
+	default:
+		return msg
+	}
+
+	if msg.From != "" && msg.From != x.JID.Bare() {
+		return msg
+	}
+	if carbon.Forwarded == nil || carbon.Forwarded.Message == nil {
+		return msg
+	}
+
+	inner := carbon.Forwarded.Message
+	inner.Carbon = direction
+	return inner
+}
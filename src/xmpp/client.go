@@ -2,30 +2,171 @@ package xmpp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"log"
+	"time"
 )
 
 // Config structure used to create a new XMPP client connection.
 type ClientConfig struct {
 	// Don't upgrade the connection to TLS, even if the server supports it. If
-	// the server *requires* TLS then this option is ignored.
+	// the server *requires* TLS then NewClientXMPP fails instead.
 	NoTLS bool
 
 	// Skip verification of the server's certificate chain. Probably only
-	// useful during development.
+	// useful during development. Ignored if TLSConfig is set.
 	InsecureSkipVerify bool
+
+	// Certificate authorities to verify the server's certificate with,
+	// instead of the system's. Ignored if TLSConfig is set.
+	RootCAs *x509.CertPool
+
+	// TLS configuration used when the stream is upgraded with STARTTLS. If
+	// nil, a default configuration is used. If it has a client certificate
+	// and the server offers SASL EXTERNAL, the certificate is used to
+	// authenticate instead of the password.
+	TLSConfig *tls.Config
+
+	// Log in with SASL ANONYMOUS instead of a password. The JID passed to
+	// NewClientXMPP needs only the domain; the server assigns the rest,
+	// which is set as XMPP.JID. Fails with ErrNoSASLMechanism if the server
+	// doesn't allow anonymous logins.
+	Anonymous bool
+
+	// Compress the stream with zlib (XEP-0138) if the server supports it.
+	// Off by default: compressing data alongside encryption can leak what's
+	// being sent, as in the CRIME attack on TLS.
+	Compression bool
+
+	// How bytestreams for file transfer are opened. Nil means no direct
+	// connections, only the server's proxies or in-band bytestreams.
+	Bytestreams *BytestreamConfig
+
+	// SASL mechanisms that may be used, in order of preference, e.g.
+	// []string{"SCRAM-SHA-1"} to never send the password in the clear. The
+	// first one that the server offers is used; authentication fails with
+	// ErrNoSASLMechanism if there's none. Unsupported mechanisms are ignored.
+	// Defaults to SCRAM-SHA-1 then PLAIN, preceded by EXTERNAL if TLSConfig
+	// has a client certificate. Ignored if Anonymous is set.
+	SASLMechanisms []string
+
+	// Enable stream management (XEP-0198), if the server supports it, so
+	// the stream can be resumed with ResumeClientXMPP after a lost
+	// connection.
+	StreamManagement bool
+
+	// How often to request an acknowledgement of sent stanzas when stream
+	// management is enabled. Defaults to 30 seconds.
+	StreamManagementAckInterval time.Duration
+
+	// Ping (XEP-0199) the server at this interval and close the stream if it
+	// doesn't reply within the interval. 0 disables keepalive pings.
+	KeepaliveInterval time.Duration
+
+	// Write a single space to the stream whenever nothing else has been
+	// written for this long, to keep NAT mappings and proxies from dropping
+	// an idle connection. 0 disables whitespace keepalives.
+	WhitespaceKeepaliveInterval time.Duration
+
+	// Limit the rate stanzas sent on Out are written to the stream, to stay
+	// within the server's traffic policy. Up to RateLimitBurst stanzas may be
+	// sent at once, then RateLimit per second. Order is preserved. Stanzas
+	// written with Send and internal replies aren't limited. 0 means
+	// unlimited.
+	RateLimit      float64
+	RateLimitBurst int
+
+	// Automatically send a delivery receipt (XEP-0184) for incoming messages
+	// that request one.
+	AutoReceipts bool
+
+	// Set the from attribute of outgoing IQ, Message and Presence stanzas to
+	// the client's full JID when it's empty. Servers fill it in themselves,
+	// so this is rarely needed.
+	StampFrom bool
+
+	// Buffer sizes of the In and Out channels. Unbuffered by default.
+	InBuffer  int
+	OutBuffer int
+
+	// What to do with an incoming stanza when In is full. Defaults to
+	// OverflowBlock.
+	InOverflow OverflowPolicy
+
+	// Follow up to this many see-other-host stream errors, reconnecting to
+	// the host the server names and starting over, as load-balanced clusters
+	// ask. Stream.Redirected reports whether it happened. 0 returns the
+	// *StreamError instead.
+	MaxRedirects int
+
+	// Called with every element written to or read from the stream, e.g. to
+	// export metrics; sent is false for received elements. It's called by
+	// the goroutines reading and writing, possibly at the same time, so it
+	// must be safe for concurrent use and not block.
+	OnStanza func(v interface{}, sent bool)
+
+	// Deliver top-level elements the package doesn't know, and that no type
+	// is registered for with RegisterElement, to filters and In as
+	// *RawStanza. They're skipped by default.
+	RawUnknownElements bool
+
+	// Generate the ids of stanzas the package sends, e.g. for SendRecv's
+	// requests and the message and presence builders, to correlate them in
+	// logs. Ids must be unique for the life of the account, not just of the
+	// stream, so replies still in flight across a reconnect aren't taken for
+	// new ones. UUID4 by default. NewIQGet and NewIQSet aren't tied to an
+	// XMPP instance and always use UUID4.
+	IDGenerator func() string
+
+	// Called with the new XMPP before its goroutines start; set by
+	// ReconnectingClient for ReconnectConfig.OnConnect.
+	onStart func(*XMPP)
 }
 
 // Create a client XMPP over the stream.
 func NewClientXMPP(stream *Stream, jid JID, password string, config *ClientConfig) (*XMPP, error) {
+	return newClientXMPP(stream, jid, password, config, nil)
+}
+
+// Create a client XMPP over the stream, resuming the stream management
+// session of prev, an XMPP whose connection has been lost. Stanzas that prev
+// sent but the server never acknowledged are sent again. If the server can't
+// resume the session a new one is started as NewClientXMPP would; in that case
+// unacknowledged stanzas are not resent.
+func ResumeClientXMPP(stream *Stream, prev *XMPP, password string, config *ClientConfig) (*XMPP, error) {
+	return newClientXMPP(stream, prev.JID, password, config, prev)
+}
+
+func newClientXMPP(stream *Stream, jid JID, password string, config *ClientConfig, prev *XMPP) (*XMPP, error) {
 
 	if config == nil {
 		config = &ClientConfig{}
 	}
 
+	for redirects := 0; ; redirects++ {
+		x, err := negotiateClient(stream, jid, password, config, prev)
+		serr, ok := err.(*StreamError)
+		if !ok || serr.Condition != StreamErrorSeeOtherHost || serr.SeeOtherHost == "" || redirects >= config.MaxRedirects {
+			return x, err
+		}
+		if _, framed := stream.conn.(streamFramer); framed {
+			return nil, err
+		}
+		stream.logger().Info("Redirected to ", serr.SeeOtherHost)
+		if err := stream.redirect(serr.SeeOtherHost, jid.Domain); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Negotiate the stream, from its start until it's ready for stanzas.
+func negotiateClient(stream *Stream, jid JID, password string, config *ClientConfig, prev *XMPP) (*XMPP, error) {
+
+	compressed := false
+	newID := config.idGenerator()
+
 	for {
 
 		if err := startClient(stream, jid); err != nil {
@@ -39,9 +180,12 @@ func NewClientXMPP(stream *Stream, jid JID, password string, config *ClientConfi
 		}
 
 		// TLS?
-		if f.StartTLS != nil && (f.StartTLS.Required != nil || !config.NoTLS) {
-			log.Println("Start TLS")
-			if err := startTLS(stream, config); err != nil {
+		if f.StartTLS != nil && f.StartTLS.Required != nil && config.NoTLS {
+			return nil, errors.New("server requires TLS but NoTLS is set")
+		}
+		if f.StartTLS != nil && !config.NoTLS && !stream.isTLS() {
+			stream.logger().Info("Start TLS")
+			if err := startTLS(stream, jid.Domain, config); err != nil {
 				return nil, err
 			}
 			continue // Restart
@@ -49,35 +193,106 @@ func NewClientXMPP(stream *Stream, jid JID, password string, config *ClientConfi
 
 		// Authentication
 		if f.Mechanisms != nil {
-			log.Println("Authenticating")
-			if err := authenticate(stream, f.Mechanisms.Mechanisms, jid.Node, password); err != nil {
+			stream.logger().Info("Authenticating")
+			if err := authenticate(stream, f.Mechanisms.Mechanisms, jid.Node, password, config); err != nil {
 				return nil, err
 			}
 			continue // Restart
 		}
 
+		// Compression, once authenticated. A refusal isn't fatal; the stream
+		// continues uncompressed.
+		if f.Compression != nil && config.Compression && !compressed && stringSliceContains(f.Compression.Methods, "zlib") {
+			stream.logger().Info("Starting compression")
+			compressed = true
+			err := startCompression(stream)
+			if err == nil {
+				continue // Restart
+			}
+			if _, ok := err.(*compressFailure); !ok {
+				return nil, err
+			}
+			stream.logger().Error(err)
+		}
+
+		// Resume a previous stream management session instead of binding.
+		if f.StreamManagement != nil && prev != nil && prev.Resumable() {
+			stream.logger().Info("Resuming stream.")
+			x, err := resumeStream(stream, prev)
+			if err == nil {
+				configureClient(x, config)
+				x.start()
+				return x, nil
+			}
+			if _, ok := err.(*smFailure); !ok {
+				return nil, err
+			}
+			stream.logger().Error("Stream resumption failed. ", err)
+		}
+
 		// Bind resource.
 		if f.Bind != nil {
-			log.Println("Binding resource.")
-			boundJID, err := bindResource(stream, jid)
+			stream.logger().Info("Binding resource.")
+			boundJID, err := bindResource(stream, jid, newID)
 			if err != nil {
 				return nil, err
 			}
 			jid = boundJID
 		}
 
-		// Session.
-		if f.Session != nil {
-			log.Println("Establishing session.")
-			if err := establishSession(stream, jid.Domain); err != nil {
+		// Session. Only needed by legacy servers; modern servers either don't
+		// advertise it or mark it optional.
+		if f.Session != nil && f.Session.Optional == nil {
+			stream.logger().Info("Establishing session.")
+			if err := establishSession(stream, jid.Domain, newID); err != nil {
 				return nil, err
 			}
 		}
 
-		break
+		x := newXMPP(jid, stream)
+
+		// Stream management.
+		if f.StreamManagement != nil && config.StreamManagement {
+			stream.logger().Info("Enabling stream management.")
+			sm, err := enableStreamManagement(stream)
+			if _, ok := err.(*smFailure); ok {
+				stream.logger().Error("Stream management not enabled. ", err)
+			} else if err != nil {
+				return nil, err
+			}
+			x.sm = sm
+		}
+		if x.sm != nil && config.StreamManagementAckInterval > 0 {
+			x.sm.ackInterval = config.StreamManagementAckInterval
+		}
+		configureClient(x, config)
+
+		x.start()
+		return x, nil
 	}
+}
 
-	return newXMPP(jid, stream), nil
+// Return the IDGenerator, or UUID4 if it's not set.
+func (config *ClientConfig) idGenerator() func() string {
+	if config.IDGenerator != nil {
+		return config.IDGenerator
+	}
+	return UUID4
+}
+
+// Apply the config's runtime options to a new, unstarted XMPP.
+func configureClient(x *XMPP, config *ClientConfig) {
+	x.keepaliveInterval = config.KeepaliveInterval
+	x.whitespaceInterval = config.WhitespaceKeepaliveInterval
+	x.setRateLimit(config.RateLimit, config.RateLimitBurst)
+	x.autoReceipts = config.AutoReceipts
+	x.stampFrom = config.StampFrom
+	x.bytestreams = config.Bytestreams
+	x.onStanza = config.OnStanza
+	x.rawUnknown = config.RawUnknownElements
+	x.idGenerator = config.idGenerator()
+	x.onStart = config.onStart
+	x.setChannels(config.InBuffer, config.OutBuffer, config.InOverflow)
 }
 
 func startClient(stream *Stream, jid JID) error {
@@ -87,11 +302,14 @@ func startClient(stream *Stream, jid JID) error {
 		[]xml.Attr{
 			xml.Attr{xml.Name{"", "xmlns"}, nsClient},
 			xml.Attr{xml.Name{"xmlns", "stream"}, nsStreams},
-			xml.Attr{xml.Name{"", "from"}, jid.Full()},
 			xml.Attr{xml.Name{"", "to"}, jid.Domain},
 			xml.Attr{xml.Name{"", "version"}, "1.0"},
 		},
 	}
+	// There's no account to claim before registration.
+	if jid.Node != "" {
+		start.Attr = append(start.Attr, xml.Attr{xml.Name{"", "from"}, jid.Full()})
+	}
 
 	rstart, err := stream.SendStart(&start)
 	if err != nil {
@@ -103,91 +321,68 @@ func startClient(stream *Stream, jid JID) error {
 	return nil
 }
 
-func startTLS(stream *Stream, config *ClientConfig) error {
+// Upgrade the stream to TLS with STARTTLS, verifying the server's certificate
+// for the domain unless the stream or TLS config says otherwise.
+func startTLS(stream *Stream, domain string, config *ClientConfig) error {
 
 	if err := stream.Send(&tlsStart{}); err != nil {
 		return err
 	}
 
-	p := tlsProceed{}
-	if err := stream.Decode(&p, nil); err != nil {
+	// The server either tells us to proceed or that negotiation failed, in
+	// which case it will also close the stream.
+	se, err := stream.Next()
+	if err != nil {
 		return err
 	}
-
-	tlsConfig := tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, ServerName: stream.config.ConnectionDomain}
-	return stream.UpgradeTLS(&tlsConfig)
-}
-
-type tlsStart struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
-}
-
-type tlsProceed struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls proceed"`
-}
-
-func authenticate(stream *Stream, mechanisms []string, user, password string) error {
-	for _, handler := range authHandlers {
-		if !stringSliceContains(mechanisms, handler.Mechanism) {
-			continue
-		}
-		if err := handler.Fn(stream, user, password); err == nil {
-			log.Printf("Authentication (%s) successful", handler.Mechanism)
-			return nil
-		}
+	if se.Name != (xml.Name{nsTLS, "proceed"}) {
+		stream.Skip()
+		return fmt.Errorf("STARTTLS failed: %s", se.Name.Local)
 	}
-	return errors.New("no supported SASL mechanism found")
-}
-
-type authHandler struct {
-	Mechanism string
-	Fn        func(*Stream, string, string) error
-}
-
-var authHandlers = []authHandler{
-	{"PLAIN", authenticatePlain},
-}
-
-func authenticatePlain(stream *Stream, user, password string) error {
-	auth := saslAuth{Mechanism: "PLAIN", Text: saslEncodePlain(user, password)}
-	if err := stream.Send(&auth); err != nil {
+	if err := stream.Skip(); err != nil {
 		return err
 	}
-	return authenticateResponse(stream)
+
+	return upgradeTLS(stream, config.tlsConfig(stream, domain))
 }
 
-func authenticateResponse(stream *Stream) error {
-	se, err := stream.Next()
-	if err != nil {
-		return err
+// Return the TLS config to connect to the domain's server with.
+func (config *ClientConfig) tlsConfig(stream *Stream, domain string) *tls.Config {
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{RootCAs: config.RootCAs, InsecureSkipVerify: config.InsecureSkipVerify}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = stream.config.ConnectionDomain
 	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = domain
+	}
+	return tlsConfig
+}
 
-	switch se.Name.Local {
-	case "success":
-		if err := stream.Skip(); err != nil {
-			return err
-		}
-		return nil
-	case "failure":
-		f := new(saslFailure)
-		if err := stream.Decode(f, se); err != nil {
-			return err
-		}
-		return fmt.Errorf("Authentication failed: %s", f.Reason.Local)
-	default:
-		return fmt.Errorf("Unexpected: %s", se.Name)
+// Upgrade the stream to TLS, explaining a certificate for the wrong server
+// rather than leaving it as a bare handshake failure.
+func upgradeTLS(stream *Stream, tlsConfig *tls.Config) error {
+	err := stream.UpgradeTLS(tlsConfig)
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return fmt.Errorf("server certificate is not valid for %s: %w", tlsConfig.ServerName, err)
 	}
+	return err
 }
 
-type saslAuth struct {
-	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
-	Mechanism string   `xml:"mechanism,attr"`
-	Text      string   `xml:",chardata"`
+type tlsStart struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
 }
 
-func bindResource(stream *Stream, jid JID) (JID, error) {
+// Bind a resource to the stream and return the full JID assigned by the
+// server. If jid has no resource the server generates one.
+func bindResource(stream *Stream, jid JID, newID func() string) (JID, error) {
 
-	req := IQ{ID: UUID4(), Type: "set"}
+	req := IQ{ID: newID(), Type: IQTypeSet}
 	if jid.Resource == "" {
 		req.PayloadEncode(bindIQ{})
 	} else {
@@ -198,15 +393,25 @@ func bindResource(stream *Stream, jid JID) (JID, error) {
 	}
 
 	resp := IQ{}
-	err := stream.Decode(&resp, nil)
-	if err != nil {
+	if err := stream.Decode(&resp, nil); err != nil {
 		return JID{}, err
 	}
+	if resp.Error != nil {
+		return JID{}, resp.Error
+	}
+	if resp.ID != req.ID || resp.Type != IQTypeResult {
+		return JID{}, fmt.Errorf("unexpected bind response: %s %s", resp.Type, resp.ID)
+	}
+
 	bindResp := bindIQ{}
-	resp.PayloadDecode(&bindResp)
+	if err := resp.PayloadDecode(&bindResp); err != nil {
+		return JID{}, err
+	}
+	if bindResp.JID == "" {
+		return JID{}, errors.New("bind response is missing the JID")
+	}
 
-	boundJID, err := ParseJID(bindResp.JID)
-	return boundJID, nil
+	return ParseJID(bindResp.JID)
 }
 
 type bindIQ struct {
@@ -215,9 +420,9 @@ type bindIQ struct {
 	JID      string   `xml:"jid,omitempty"`
 }
 
-func establishSession(stream *Stream, domain string) error {
+func establishSession(stream *Stream, domain string, newID func() string) error {
 
-	req := IQ{ID: UUID4(), Type: "set", To: domain}
+	req := IQ{ID: newID(), Type: IQTypeSet, To: domain}
 	req.PayloadEncode(&session{})
 	if err := stream.Send(req); err != nil {
 		return err
@@ -228,6 +433,8 @@ func establishSession(stream *Stream, domain string) error {
 		return err
 	} else if resp.Error != nil {
 		return resp.Error
+	} else if resp.ID != req.ID || resp.Type != IQTypeResult {
+		return fmt.Errorf("unexpected session response: %s %s", resp.Type, resp.ID)
 	}
 
 	return nil
@@ -243,15 +450,19 @@ func stringSliceContains(l []string, m string) bool {
 }
 
 type features struct {
-	XMLName    xml.Name     `xml:"http://etherx.jabber.org/streams features"`
-	StartTLS   *tlsStartTLS `xml:"starttls"`
-	Mechanisms *mechanisms  `xml:"mechanisms"`
-	Bind       *bind        `xml:"bind"`
-	Session    *session     `xml:"session"`
+	XMLName          xml.Name     `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS         *tlsStartTLS `xml:"starttls"`
+	Mechanisms       *mechanisms  `xml:"mechanisms"`
+	Bind             *bind        `xml:"bind"`
+	Session          *session     `xml:"session"`
+	StreamManagement *smFeature   `xml:"urn:xmpp:sm:3 sm"`
+
+	Compression *compressionFeature `xml:"http://jabber.org/features/compress compression"`
 }
 
 type session struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	XMLName  xml.Name  `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Optional *optional `xml:"optional"`
 }
 
 type bind struct {
@@ -271,10 +482,4 @@ type tlsStartTLS struct {
 
 type required struct{}
 
-type saslFailure struct {
-	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
-	Reason  xml.Name `xml:",any"`
-}
-
-// BUG(matt): authentication incorrectly reports, "No supported SASL mechanism
-// found", for authentication attemtps that fail due to invalid credentials.
+type optional struct{}
@@ -0,0 +1,27 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSConfigServerName(t *testing.T) {
+	stream := &Stream{config: &StreamConfig{}}
+	config := &ClientConfig{}
+	if name := config.tlsConfig(stream, "example.com").ServerName; name != "example.com" {
+		t.Errorf("expected the JID domain, got %q", name)
+	}
+
+	stream.config.ConnectionDomain = "xmpp.example.net"
+	if name := config.tlsConfig(stream, "example.com").ServerName; name != "xmpp.example.net" {
+		t.Errorf("expected the connection domain, got %q", name)
+	}
+
+	config.TLSConfig = &tls.Config{ServerName: "other.example.org"}
+	if name := config.tlsConfig(stream, "example.com").ServerName; name != "other.example.org" {
+		t.Errorf("expected the TLS config's name, got %q", name)
+	}
+	if config.TLSConfig.ServerName != "other.example.org" {
+		t.Error("TLS config was modified")
+	}
+}
@@ -5,10 +5,74 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"time"
 )
 
-// Create a component XMPP connection over the stream.
-func NewComponentXMPP(stream *Stream, jid JID, secret string) (*XMPP, error) {
+// Config structure used to create a new XMPP component connection.
+type ComponentConfig struct {
+	// Write a single space to the stream whenever nothing else has been
+	// written for this long. 0 disables whitespace keepalives.
+	WhitespaceKeepaliveInterval time.Duration
+
+	// Limit the rate stanzas sent on Out are written to the stream, as
+	// ClientConfig.RateLimit. 0 means unlimited.
+	RateLimit      float64
+	RateLimitBurst int
+
+	// Buffer sizes of the In and Out channels. Unbuffered by default.
+	InBuffer  int
+	OutBuffer int
+
+	// What to do with an incoming stanza when In is full. Defaults to
+	// OverflowBlock.
+	InOverflow OverflowPolicy
+
+	// Don't set the from attribute of outgoing IQ, Message and Presence
+	// stanzas. By default it's set to the component's JID when empty, as
+	// most servers require components to address their stanzas.
+	NoStampFrom bool
+
+	// How bytestreams for file transfer are opened, as
+	// ClientConfig.Bytestreams.
+	Bytestreams *BytestreamConfig
+
+	// Called with every element written to or read from the stream, as
+	// ClientConfig.OnStanza.
+	OnStanza func(v interface{}, sent bool)
+
+	// Deliver unknown top-level elements as *RawStanza, as
+	// ClientConfig.RawUnknownElements.
+	RawUnknownElements bool
+
+	// Generate stanza ids, as ClientConfig.IDGenerator.
+	IDGenerator func() string
+
+	// Limit what each sender, by full JID, may send the component: at most
+	// MaxStanzasPerSecond stanzas in any second, and at most MaxPendingIQs
+	// IQ requests the component hasn't yet answered. A stanza over either
+	// limit is answered with a policy-violation error instead of being
+	// received. A request left unanswered for a minute stops counting. Stats
+	// reports how many were refused. 0 means unlimited.
+	MaxStanzasPerSecond int
+	MaxPendingIQs       int
+}
+
+// Returned by NewComponentXMPP when the server rejects the handshake, usually
+// because the secret is wrong. The server's *StreamError is wrapped too.
+var ErrHandshakeFailed = errors.New("xmpp: component handshake failed")
+
+// Create a component XMPP connection over the stream. The JID is the
+// component's domain, e.g. rabbithole.wonderland.lit; it has no localpart or
+// resource.
+func NewComponentXMPP(stream *Stream, jid JID, secret string, config *ComponentConfig) (*XMPP, error) {
+
+	if config == nil {
+		config = &ComponentConfig{}
+	}
+
+	if jid.Node != "" || jid.Resource != "" {
+		return nil, fmt.Errorf("component JID must be a domain: %s", jid)
+	}
 
 	streamID, err := startComponent(stream, jid)
 	if err != nil {
@@ -19,7 +83,18 @@ func NewComponentXMPP(stream *Stream, jid JID, secret string) (*XMPP, error) {
 		return nil, err
 	}
 
-	return newXMPP(jid, stream), nil
+	x := newXMPP(jid, stream)
+	x.setChannels(config.InBuffer, config.OutBuffer, config.InOverflow)
+	x.whitespaceInterval = config.WhitespaceKeepaliveInterval
+	x.setRateLimit(config.RateLimit, config.RateLimitBurst)
+	x.stampFrom = !config.NoStampFrom
+	x.bytestreams = config.Bytestreams
+	x.onStanza = config.OnStanza
+	x.rawUnknown = config.RawUnknownElements
+	x.idGenerator = config.IDGenerator
+	x.limits = newSenderLimiter(config.MaxStanzasPerSecond, config.MaxPendingIQs)
+	x.start()
+	return x, nil
 }
 
 func startComponent(stream *Stream, jid JID) (string, error) {
@@ -29,7 +104,7 @@ func startComponent(stream *Stream, jid JID) (string, error) {
 		[]xml.Attr{
 			xml.Attr{xml.Name{"", "xmlns"}, nsComponentAccept},
 			xml.Attr{xml.Name{"xmlns", "stream"}, nsStreams},
-			xml.Attr{xml.Name{"", "to"}, jid.Full()},
+			xml.Attr{xml.Name{"", "to"}, jid.Domain},
 		},
 	}
 
@@ -56,20 +131,21 @@ func startComponent(stream *Stream, jid JID) (string, error) {
 	return streamID, nil
 }
 
+// Authenticate with the XEP-0114 handshake and wait for the server to confirm
+// it with an empty <handshake/>.
 func handshake(stream *Stream, streamID, secret string) error {
 
-	hash := sha1.New()
-	hash.Write([]byte(streamID))
-	hash.Write([]byte(secret))
-
 	// Send handshake.
-	handshake := saslHandshake{Value: fmt.Sprintf("%x", hash.Sum(nil))}
+	handshake := saslHandshake{Value: handshakeDigest(streamID, secret)}
 	if err := stream.Send(&handshake); err != nil {
 		return err
 	}
 
-	// Get handshake response.
+	// Get handshake response. A rejection is a stream error.
 	start, err := stream.Next()
+	if serr, ok := err.(*StreamError); ok && serr.Condition == StreamErrorNotAuthorized {
+		return fmt.Errorf("%w: %w", ErrHandshakeFailed, serr)
+	}
 	if err != nil {
 		return err
 	}
@@ -79,6 +155,14 @@ func handshake(stream *Stream, streamID, secret string) error {
 	return stream.Skip()
 }
 
+// Return the handshake's hex SHA-1 digest of the stream id and secret.
+func handshakeDigest(streamID, secret string) string {
+	hash := sha1.New()
+	hash.Write([]byte(streamID))
+	hash.Write([]byte(secret))
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
 type saslHandshake struct {
 	XMLName xml.Name `xml:"jabber:component:accept handshake"`
 	Value   string   `xml:",chardata"`
@@ -0,0 +1,89 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// Play a server's component port on conn: accept the handshake if it's for
+// the secret, then echo the from of the first stanza.
+func serveComponent(t *testing.T, conn net.Conn, secret string, froms chan<- string) {
+	defer conn.Close()
+	dec := xml.NewDecoder(conn)
+	if _, err := nextStart(dec); err != nil {
+		t.Error(err)
+		return
+	}
+	fmt.Fprint(conn, `<stream:stream xmlns:stream="http://etherx.jabber.org/streams" xmlns="jabber:component:accept" id="3BF96D32" from="gw.example.com">`)
+
+	var h saslHandshake
+	if err := dec.Decode(&h); err != nil {
+		t.Error(err)
+		return
+	}
+	if h.Value != handshakeDigest("3BF96D32", secret) {
+		fmt.Fprint(conn, `<stream:error><not-authorized xmlns="urn:ietf:params:xml:ns:xmpp-streams"/></stream:error></stream:stream>`)
+		return
+	}
+	fmt.Fprint(conn, `<handshake/>`)
+
+	var msg Message
+	if err := dec.Decode(&msg); err != nil {
+		t.Error(err)
+		return
+	}
+	froms <- msg.From
+	io.Copy(io.Discard, conn)
+}
+
+func nextStart(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+func TestComponentHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	froms := make(chan string, 1)
+	go serveComponent(t, server, "secret", froms)
+
+	stream := &Stream{config: &StreamConfig{}}
+	stream.setConn(client)
+	x, err := NewComponentXMPP(stream, JID{Domain: "gw.example.com"}, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	x.Out <- Message{To: "alice@example.com"}
+	if from := <-froms; from != "gw.example.com" {
+		t.Errorf("from = %q, want the component's domain", from)
+	}
+}
+
+func TestComponentHandshakeFailed(t *testing.T) {
+	client, server := net.Pipe()
+	go serveComponent(t, server, "secret", nil)
+
+	stream := &Stream{config: &StreamConfig{}}
+	stream.setConn(client)
+	defer stream.Close()
+	_, err := NewComponentXMPP(stream, JID{Domain: "gw.example.com"}, "wrong", nil)
+	if !errors.Is(err, ErrHandshakeFailed) {
+		t.Errorf("err = %v, want ErrHandshakeFailed", err)
+	}
+	var serr *StreamError
+	if !errors.As(err, &serr) || serr.Condition != StreamErrorNotAuthorized {
+		t.Errorf("err = %v, want a not-authorized stream error", err)
+	}
+}
@@ -0,0 +1,108 @@
+package xmpp
+
+import (
+	"compress/zlib"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	nsCompress        = "http://jabber.org/protocol/compress"
+	nsCompressFeature = "http://jabber.org/features/compress"
+)
+
+// XEP-0138: Stream Compression
+
+type compressionFeature struct {
+	XMLName xml.Name `xml:"http://jabber.org/features/compress compression"`
+	Methods []string `xml:"method"`
+}
+
+type compress struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/compress compress"`
+	Method  string   `xml:"method"`
+}
+
+type compressFailure struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/compress failure"`
+	Condition struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (f *compressFailure) Error() string {
+	return fmt.Sprintf("Stream compression failed: %s", f.Condition.XMLName.Local)
+}
+
+// Negotiate zlib compression and switch the stream over to it. A
+// *compressFailure means the server refused, in which case the stream carries
+// on uncompressed. The stream must be restarted after success.
+func startCompression(stream *Stream) error {
+
+	if err := stream.Send(&compress{Method: "zlib"}); err != nil {
+		return err
+	}
+
+	se, err := stream.Next()
+	if err != nil {
+		return err
+	}
+	switch se.Name {
+	case xml.Name{nsCompress, "compressed"}:
+		if err := stream.Skip(); err != nil {
+			return err
+		}
+	case xml.Name{nsCompress, "failure"}:
+		f := &compressFailure{}
+		if err := stream.Decode(f, se); err != nil {
+			return err
+		}
+		return f
+	default:
+		stream.Skip()
+		return fmt.Errorf("Unexpected: %s", se.Name)
+	}
+
+	stream.setConn(newZlibConn(stream.conn))
+	return nil
+}
+
+// A net.Conn that compresses everything written to it with zlib, flushing
+// after each write, and decompresses everything read from it.
+type zlibConn struct {
+	net.Conn
+
+	// Created on the first read, as it reads the zlib header.
+	r io.ReadCloser
+
+	wlock sync.Mutex
+	w     *zlib.Writer
+}
+
+func newZlibConn(conn net.Conn) *zlibConn {
+	return &zlibConn{Conn: conn, w: zlib.NewWriter(conn)}
+}
+
+func (c *zlibConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		r, err := zlib.NewReader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.r = r
+	}
+	return c.r.Read(p)
+}
+
+func (c *zlibConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
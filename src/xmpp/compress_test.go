@@ -0,0 +1,26 @@
+package xmpp
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestZlibConn(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := newZlibConn(a), newZlibConn(b)
+	defer client.Close()
+	defer server.Close()
+
+	// Each write is flushed, so it can be read before the next is sent.
+	for _, msg := range []string{"<presence/>", "<message><body>hello</body></message>"} {
+		go client.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Errorf("expected %q, got %q", msg, buf)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+const (
+	NSCorrection = "urn:xmpp:message-correct:0"
+)
+
+// XEP-0308: Last Message Correction
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	ID      string   `xml:"id,attr"`
+}
+
+// Returned by Correct when the message to correct isn't the last one sent to
+// the recipient.
+var ErrCorrectionNotLast = errors.New("only the last message sent to a recipient can be corrected")
+
+// Return the id of the message this one corrects, or "" if it isn't a
+// correction.
+func (msg *Message) CorrectedID() string {
+	if msg.Replace == nil {
+		return ""
+	}
+	return msg.Replace.ID
+}
+
+// Send msg as a correction of the message with the id. Only the last message
+// with a body sent to msg.To can be corrected; later corrections also refer to
+// that original message's id.
+func (x *XMPP) Correct(id string, msg *Message) error {
+	x.lastMessageLock.Lock()
+	last := x.lastMessageIDs[msg.To]
+	x.lastMessageLock.Unlock()
+	if id == "" || id != last {
+		return ErrCorrectionNotLast
+	}
+
+	correction := *msg
+	correction.Replace = &Replace{ID: id}
+	if correction.ID == "" {
+		correction.ID = x.newID()
+	}
+	return x.Send(&correction)
+}
+
+// Record the id of a message with a body that was written, as the one that may
+// be corrected.
+func (x *XMPP) trackMessage(v interface{}) {
+	var msg *Message
+	switch m := v.(type) {
+	case Message:
+		msg = &m
+	case *Message:
+		msg = m
+	default:
+		return
+	}
+	if msg.ID == "" || len(msg.Body) == 0 || msg.Replace != nil {
+		return
+	}
+
+	x.lastMessageLock.Lock()
+	defer x.lastMessageLock.Unlock()
+	if x.lastMessageIDs == nil {
+		x.lastMessageIDs = make(map[string]string)
+	}
+	x.lastMessageIDs[msg.To] = msg.ID
+}
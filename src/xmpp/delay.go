@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const (
+	NSDelay       = "urn:xmpp:delay"
+	NSLegacyDelay = "jabber:x:delay"
+)
+
+// XEP-0203: Delayed Delivery
+type Delay struct {
+	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"`
+	Reason  string   `xml:",chardata"`
+}
+
+// XEP-0091: Legacy Delayed Delivery
+type LegacyDelay struct {
+	XMLName xml.Name `xml:"jabber:x:delay x"`
+	From    string   `xml:"from,attr,omitempty"`
+	Stamp   string   `xml:"stamp,attr"`
+	Reason  string   `xml:",chardata"`
+}
+
+// Return the time the stanza was originally sent.
+func (d *Delay) Time() (time.Time, error) {
+	return time.Parse(time.RFC3339, d.Stamp)
+}
+
+// Return the time the stanza was originally sent.
+func (d *LegacyDelay) Time() (time.Time, error) {
+	return time.ParseInLocation("20060102T15:04:05", d.Stamp, time.UTC)
+}
+
+// Set msg.Delay from the delay elements, preferring the current XEP-0203
+// element over the legacy one. Unparseable stamps are ignored.
+func parseMessageDelay(msg *Message) {
+	if msg.Delay != nil {
+		return
+	}
+	if msg.DelayInfo != nil {
+		if t, err := msg.DelayInfo.Time(); err == nil {
+			msg.Delay = &t
+			return
+		}
+	}
+	if msg.LegacyDelay != nil {
+		if t, err := msg.LegacyDelay.Time(); err == nil {
+			msg.Delay = &t
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMessageDelay(t *testing.T) {
+	want := time.Date(2002, 9, 10, 23, 8, 25, 0, time.UTC)
+
+	msg := &Message{DelayInfo: &Delay{Stamp: "2002-09-10T23:08:25Z"}}
+	parseMessageDelay(msg)
+	if msg.Delay == nil || !msg.Delay.Equal(want) {
+		t.Errorf("delay = %v, want %v", msg.Delay, want)
+	}
+
+	msg = &Message{LegacyDelay: &LegacyDelay{Stamp: "20020910T23:08:25"}}
+	parseMessageDelay(msg)
+	if msg.Delay == nil || !msg.Delay.Equal(want) {
+		t.Errorf("legacy delay = %v, want %v", msg.Delay, want)
+	}
+
+	msg = &Message{}
+	parseMessageDelay(msg)
+	if msg.Delay != nil {
+		t.Errorf("live message has delay %v", msg.Delay)
+	}
+}
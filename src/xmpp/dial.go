@@ -0,0 +1,46 @@
+package xmpp
+
+import (
+	"context"
+)
+
+// Config structure used by Dial. Nil fields use the defaults.
+type DialConfig struct {
+	Stream *StreamConfig
+	Client *ClientConfig
+}
+
+// Connect to the JID's home server, found with HomeServerAddrs, and log in,
+// negotiating TLS, authentication, resource binding and any session as
+// NewClientXMPP does. The XMPP returned is started and ready to use. The
+// context bounds connecting and logging in only; cancelling it later doesn't
+// affect the XMPP.
+func Dial(ctx context.Context, jid, password string, config *DialConfig) (*XMPP, error) {
+
+	if config == nil {
+		config = &DialConfig{}
+	}
+
+	j, err := ParseJID(jid)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := newClientStream(ctx, j, config.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	// Negotiation blocks reading the stream, so abandon it by closing the
+	// connection.
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	x, err := NewClientXMPP(stream, j, password, config.Client)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return x, nil
+}
@@ -1,6 +1,7 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 	"strings"
 )
@@ -19,9 +20,31 @@ type Disco struct {
 // IQ get/result payload for "info" requests.
 type DiscoInfo struct {
 	XMLName  xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
-	Node     string          `xml:"node,attr"`
+	Node     string          `xml:"node,attr,omitempty"`
 	Identity []DiscoIdentity `xml:"identity"`
 	Feature  []DiscoFeature  `xml:"feature"`
+
+	// Extended information, XEP-0128.
+	Forms []Form `xml:"jabber:x:data x"`
+}
+
+// Return the features' var attributes.
+func (info *DiscoInfo) Features() []string {
+	features := make([]string, 0, len(info.Feature))
+	for _, f := range info.Feature {
+		features = append(features, f.Var)
+	}
+	return features
+}
+
+// Return true if the feature is advertised.
+func (info *DiscoInfo) HasFeature(feature string) bool {
+	for _, f := range info.Feature {
+		if f.Var == feature {
+			return true
+		}
+	}
+	return false
 }
 
 // Identity
@@ -29,6 +52,7 @@ type DiscoIdentity struct {
 	Category string `xml:"category,attr"`
 	Type     string `xml:"type,attr"`
 	Name     string `xml:"name,attr"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
 }
 
 // Feature
@@ -39,7 +63,7 @@ type DiscoFeature struct {
 // IQ get/result payload for "items" requests.
 type DiscoItems struct {
 	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
-	Node    string      `xml:"node,attr"`
+	Node    string      `xml:"node,attr,omitempty"`
 	Item    []DiscoItem `xml:"item"`
 }
 
@@ -51,49 +75,155 @@ type DiscoItem struct {
 }
 
 // Request information about the service identified by 'to'.
-func (disco *Disco) Info(to, from string) (*DiscoInfo, error) {
+func (disco *Disco) Info(ctx context.Context, to, from string) (*DiscoInfo, error) {
+	return disco.XMPP.discoInfo(ctx, to, from, "")
+}
+
+// Request items in the service identified by 'to'.
+func (disco *Disco) Items(ctx context.Context, to, from, node string) (*DiscoItems, error) {
+	return disco.XMPP.discoItems(ctx, to, from, node)
+}
+
+// Request information about the entity, or one of its nodes if node is not
+// empty.
+func (x *XMPP) DiscoInfo(ctx context.Context, to JID, node string) (*DiscoInfo, error) {
+	return x.discoInfo(ctx, to.Full(), "", node)
+}
+
+// Request the items of the entity, or of one of its nodes if node is not
+// empty.
+func (x *XMPP) DiscoItems(ctx context.Context, to JID, node string) (*DiscoItems, error) {
+	return x.discoItems(ctx, to.Full(), "", node)
+}
+
+func (x *XMPP) discoInfo(ctx context.Context, to, from, node string) (*DiscoInfo, error) {
 
 	if from == "" {
-		from = disco.XMPP.JID.Full()
+		from = x.JID.Full()
 	}
 
-	req := &IQ{ID: UUID4(), Type: IQTypeGet, To: to, From: from}
-	req.PayloadEncode(&DiscoInfo{})
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: to, From: from}
+	req.PayloadEncode(&DiscoInfo{Node: node})
 
-	resp, err := disco.XMPP.SendRecv(req)
+	resp, err := x.SendRecvContext(ctx, req)
 	if err != nil {
 		return nil, err
-	} else if resp.Error != nil {
-		return nil, resp.Error
 	}
 
 	info := &DiscoInfo{}
-	resp.PayloadDecode(info)
+	if err := resp.PayloadDecode(info); err != nil {
+		return nil, err
+	}
 
-	return info, err
+	return info, nil
 }
 
-// Request items in the service identified by 'to'.
-func (disco *Disco) Items(to, from, node string) (*DiscoItems, error) {
+func (x *XMPP) discoItems(ctx context.Context, to, from, node string) (*DiscoItems, error) {
 
 	if from == "" {
-		from = disco.XMPP.JID.Full()
+		from = x.JID.Full()
 	}
 
-	req := &IQ{ID: UUID4(), Type: IQTypeGet, To: to, From: from}
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: to, From: from}
 	req.PayloadEncode(&DiscoItems{Node: node})
 
-	resp, err := disco.XMPP.SendRecv(req)
+	resp, err := x.SendRecvContext(ctx, req)
 	if err != nil {
 		return nil, err
-	} else if resp.Error != nil {
-		return nil, resp.Error
 	}
 
 	items := &DiscoItems{}
-	resp.PayloadDecode(items)
+	if err := resp.PayloadDecode(items); err != nil {
+		return nil, err
+	}
 
-	return items, err
+	return items, nil
+}
+
+// Advertise the feature in replies to disco#info requests. The first call to
+// AddDiscoFeature or AddDiscoIdentity makes the XMPP instance answer
+// disco#info requests itself; they are no longer delivered to In.
+func (x *XMPP) AddDiscoFeature(feature string) {
+	x.discoLock.Lock()
+	defer x.discoLock.Unlock()
+	if !stringSliceContains(x.discoFeatures, feature) {
+		x.discoFeatures = append(x.discoFeatures, feature)
+	}
+	x.answerDiscoInfo()
+}
+
+// Advertise the identity in replies to disco#info requests. If no identity is
+// added, a client/pc identity is used. See AddDiscoFeature.
+func (x *XMPP) AddDiscoIdentity(identity DiscoIdentity) {
+	x.discoLock.Lock()
+	defer x.discoLock.Unlock()
+	x.discoIdentities = append(x.discoIdentities, identity)
+	x.answerDiscoInfo()
+}
+
+// Return our own disco#info, as sent in replies.
+func (x *XMPP) localDiscoInfo() *DiscoInfo {
+	x.discoLock.Lock()
+	defer x.discoLock.Unlock()
+
+	info := &DiscoInfo{}
+	info.Identity = append(info.Identity, x.discoIdentities...)
+	if len(info.Identity) == 0 {
+		info.Identity = []DiscoIdentity{{Category: "client", Type: "pc"}}
+	}
+	info.Feature = []DiscoFeature{{Var: NSDiscoInfo}}
+	for _, f := range x.discoFeatures {
+		if f != NSDiscoInfo {
+			info.Feature = append(info.Feature, DiscoFeature{Var: f})
+		}
+	}
+	return info
+}
+
+// Install the disco#info responder, once. Must be called with discoLock held.
+func (x *XMPP) answerDiscoInfo() {
+	if x.discoAnswering {
+		return
+	}
+	x.discoAnswering = true
+	x.addResponder(x.discoInfoRequestMatcher(), func(v interface{}) {
+		iq := v.(*IQ)
+		req := &DiscoInfo{}
+		iq.PayloadDecode(req)
+		info := x.localDiscoInfo()
+		info.Node = req.Node
+		x.write(iq.Reply(info))
+	})
+}
+
+// Matcher for disco#info requests we can answer.
+func (x *XMPP) discoInfoRequestMatcher() Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeGet {
+				return false
+			}
+			if iq.PayloadName() != (xml.Name{NSDiscoInfo, "query"}) {
+				return false
+			}
+			req := &DiscoInfo{}
+			if err := iq.PayloadDecode(req); err != nil {
+				return false
+			}
+			return x.answersDiscoNode(req.Node)
+		},
+	)
+}
+
+// Return true if we answer disco#info requests for the node: no node or our
+// entity capabilities node.
+func (x *XMPP) answersDiscoNode(node string) bool {
+	if node == "" {
+		return true
+	}
+	c := x.Caps().Element()
+	return c != nil && node == c.Node+"#"+c.Ver
 }
 
 var discoNamespacePrefix = strings.Split(NSDiscoInfo, "#")[0]
@@ -109,3 +239,24 @@ var DiscoPayloadMatcher = MatcherFunc(
 		return ns == discoNamespacePrefix
 	},
 )
+
+// Return true if the user's server advertises the feature. The server's
+// disco#info is requested the first time and remembered for the rest of the
+// stream.
+func (x *XMPP) ServerSupports(ctx context.Context, feature string) (bool, error) {
+	x.discoLock.Lock()
+	info := x.serverInfo
+	x.discoLock.Unlock()
+
+	if info == nil {
+		var err error
+		info, err = x.DiscoInfo(ctx, JID{Domain: x.JID.Domain}, "")
+		if err != nil {
+			return false, err
+		}
+		x.discoLock.Lock()
+		x.serverInfo = info
+		x.discoLock.Unlock()
+	}
+	return info.HasFeature(feature), nil
+}
@@ -1,6 +1,7 @@
 package xmpp
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -9,24 +10,47 @@ import (
 const (
 	// Standard port for XMPP clients to connect to.
 	ClientPort = 5222
+
+	// Usual port for XMPP clients to connect to with direct TLS.
+	ClientDirectTLSPort = 5223
 )
 
+// Returned when the domain's SRV records say it offers no XMPP client service.
+var ErrNoClientService = errors.New("xmpp: domain offers no client service")
+
 // Perform a DNS SRV lookup and return an ordered list of "host:port" TCP
-// addresses for the JID's home server. If no SRV records are found then assume
-// the JID's domain is also the home server.
+// addresses for the JID's home server. The list is ordered by SRV priority and
+// weight. If no SRV records are found then assume the JID's domain is also the
+// home server.
 func HomeServerAddrs(jid JID) (addr []string, err error) {
+	return lookupHomeServer("xmpp-client", jid, ClientPort)
+}
+
+// Return the home server addresses for direct TLS connections (XEP-0368), as
+// HomeServerAddrs but from the xmpps-client SRV records and port 5223.
+func HomeServerDirectTLSAddrs(jid JID) (addr []string, err error) {
+	return lookupHomeServer("xmpps-client", jid, ClientDirectTLSPort)
+}
+
+func lookupHomeServer(service string, jid JID, port int) (addr []string, err error) {
 
 	// DNS lookup.
-	_, addrs, _ := net.LookupSRV("xmpp-client", "tcp", jid.Domain)
+	_, addrs, _ := net.LookupSRV(service, "tcp", jid.Domain)
 
 	// If there's nothing in DNS then assume the JID's domain and the standard
 	// port will work.
 	if len(addrs) == 0 {
-		addr = []string{fmt.Sprintf("%s:%d", jid.Domain, ClientPort)}
+		addr = []string{fmt.Sprintf("%s:%d", jid.Domain, port)}
 		return
 	}
 
-	// Build list of "host:port" strings.
+	// A single record with a target of "." means there's no service.
+	if len(addrs) == 1 && addrs[0].Target == "." {
+		return nil, ErrNoClientService
+	}
+
+	// Build list of "host:port" strings. LookupSRV has already ordered the
+	// records.
 	for _, a := range addrs {
 		target := strings.TrimRight(a.Target, ".")
 		addr = append(addr, fmt.Sprintf("%s:%d", target, a.Port))
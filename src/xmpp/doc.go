@@ -8,7 +8,11 @@ document form the messages processed by either end of the connection.
 An XML stream is then configured for an XMPP conversation, as either a client
 (chat, etc) or component (a sort of server plugin).
 
-Create a client:
+Connect and log in as a client in one go, with the defaults:
+
+	X, err := xmpp.Dial(ctx, "alice@wonderland.lit/some-resource", "password", nil)
+
+Or create a client step by step:
 
 	jid, err := xmpp.ParseJID("alice@wonderland.lit/some-resource")
 	addr, err := xmpp.HomeServerAddrs(jid)
@@ -19,7 +23,7 @@ Create a component:
 
 	jid, err := xmpp.ParseJID("rabbithole.wonderland.lit")
 	stream, err := xmpp.NewStream("localhost:5347", nil)
-	X, err := xmpp.NewComponentXMPP(stream, jid, "secret")
+	X, err := xmpp.NewComponentXMPP(stream, jid, "secret", nil)
 
 Outgoing XMPP stanzas are sent to the XMPP instance's Out channel, e.g. a
 client typically announces its presence on the XMPP network as soon as it's
@@ -28,9 +32,10 @@ connected:
 	X.Out <- xmpp.Presence{}
 
 Incoming messages are handled by consuming the XMPP instance's In channel.  The
-channel is sent all XMPP stanzas as well as terminating error (io.EOF for clean
-shutdown or any other error for something unexpected). The channel is also
-closed after an error.
+channel is sent all XMPP stanzas as well as terminating error (ErrStreamClosed
+for clean shutdown, a *StreamError if the server ended the stream because of
+an error, a *ConnectionError if the connection failed, or any other error for
+something unexpected). The channel is also closed after an error.
 
 XMPP defines four types of stanza: <error/>, <iq/>, <message/> and <presence/>
 represented by Error, IQ, Message (shown below) and Presence structs
@@ -47,6 +52,10 @@ respectively.
 		}
 	}
 
+Methods that wait for a reply from the network, such as GetRoster or
+DiscoInfo, take a context.Context first. Cancelling it, or its deadline
+passing, abandons the wait and returns ctx.Err().
+
 Note: A "bound" JID is negotatiated during XMPP setup and may be different to
 the JID passed to the New(Client|Component)XMPP() call. Always use the XMPP
 instance's JID attribute in any stanzas.
@@ -0,0 +1,49 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sync"
+)
+
+// Types registered to decode top-level elements, by qualified name.
+var (
+	elementLock  sync.RWMutex
+	elementTypes = make(map[xml.Name]reflect.Type)
+)
+
+// Register a type for top-level stream elements with the qualified name, for
+// protocols the package doesn't know about. Each matching element is decoded
+// into a new value of the prototype's type, and a pointer to it is delivered
+// to filters or In like any stanza. The prototype may be a value or a pointer.
+// Registering a name again replaces the previous type.
+func RegisterElement(name xml.Name, prototype interface{}) {
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	elementLock.Lock()
+	defer elementLock.Unlock()
+	elementTypes[name] = t
+}
+
+// An unknown top-level element, one with no type registered for it, delivered
+// as is when the RawUnknownElements config option is set. Otherwise such
+// elements are skipped.
+type RawStanza struct {
+	XMLName  xml.Name
+	Attr     []xml.Attr `xml:",any,attr"`
+	InnerXML []byte     `xml:",innerxml"`
+}
+
+// Return a pointer to a new value of the type registered for the name, or nil
+// if there isn't one.
+func newRegisteredElement(name xml.Name) interface{} {
+	elementLock.RLock()
+	t, ok := elementTypes[name]
+	elementLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return reflect.New(t).Interface()
+}
@@ -0,0 +1,97 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	NSEntityTime = "urn:xmpp:time"
+)
+
+// XEP-0202: Entity Time
+type EntityTime struct {
+	XMLName xml.Name `xml:"urn:xmpp:time time"`
+	TZO     string   `xml:"tzo,omitempty"`
+	UTC     string   `xml:"utc,omitempty"`
+}
+
+// Matcher for <iq type="get"/> entity time requests.
+var EntityTimeMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok || iq.Type != IQTypeGet {
+			return false
+		}
+		return iq.PayloadName() == xml.Name{NSEntityTime, "time"}
+	},
+)
+
+// Request the entity's current time. The time is returned in the entity's
+// time zone, which is also returned on its own. The zone only knows the
+// entity's offset from UTC, not its name.
+func (x *XMPP) EntityTime(ctx context.Context, jid JID) (time.Time, *time.Location, error) {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: jid.Full()}
+	req.PayloadEncode(&EntityTime{})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	et := &EntityTime{}
+	if err := resp.PayloadDecode(et); err != nil {
+		return time.Time{}, nil, err
+	}
+	t, err := time.Parse(time.RFC3339, et.UTC)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	loc, err := parseTZO(et.TZO)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return t.In(loc), loc, nil
+}
+
+// Answer entity time requests with the local clock. Installed for every XMPP
+// instance.
+func (x *XMPP) answerEntityTime() {
+	x.addResponder(EntityTimeMatcher, func(v interface{}) {
+		x.write(v.(*IQ).Reply(newEntityTime(time.Now())))
+	})
+}
+
+func newEntityTime(t time.Time) *EntityTime {
+	return &EntityTime{
+		TZO: t.Format("-07:00"),
+		UTC: t.UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+}
+
+// Parse a time zone offset, "Z" or "[+-]hh:mm", into a fixed zone.
+func parseTZO(tzo string) (*time.Location, error) {
+	if tzo == "Z" || tzo == "+00:00" || tzo == "-00:00" {
+		return time.UTC, nil
+	}
+	if len(tzo) != 6 || (tzo[0] != '+' && tzo[0] != '-') || tzo[3] != ':' {
+		return nil, fmt.Errorf("invalid time zone offset %q", tzo)
+	}
+	hours, err := strconv.Atoi(tzo[1:3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone offset %q", tzo)
+	}
+	minutes, err := strconv.Atoi(tzo[4:6])
+	if err != nil || minutes >= 60 {
+		return nil, fmt.Errorf("invalid time zone offset %q", tzo)
+	}
+	offset := hours*3600 + minutes*60
+	if tzo[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(tzo, offset), nil
+}
@@ -0,0 +1,37 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTZO(t *testing.T) {
+	for tzo, offset := range map[string]int{
+		"Z":      0,
+		"+00:00": 0,
+		"+05:30": 5*3600 + 30*60,
+		"-06:00": -6 * 3600,
+	} {
+		loc, err := parseTZO(tzo)
+		if err != nil {
+			t.Errorf("%s: %v", tzo, err)
+			continue
+		}
+		if _, got := time.Date(2020, 1, 1, 0, 0, 0, 0, loc).Zone(); got != offset {
+			t.Errorf("%s: expected offset %d, got %d", tzo, offset, got)
+		}
+	}
+	for _, tzo := range []string{"", "+5:30", "05:30", "+05:60", "+0530"} {
+		if _, err := parseTZO(tzo); err == nil {
+			t.Errorf("%q: expected an error", tzo)
+		}
+	}
+}
+
+func TestNewEntityTime(t *testing.T) {
+	loc := time.FixedZone("", -6*3600)
+	et := newEntityTime(time.Date(2006, 12, 19, 11, 58, 35, 0, loc))
+	if et.TZO != "-06:00" || et.UTC != "2006-12-19T17:58:35.000Z" {
+		t.Errorf("unexpected %+v", et)
+	}
+}
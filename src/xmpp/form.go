@@ -0,0 +1,122 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	NSDataForms = "jabber:x:data"
+)
+
+// Form types.
+const (
+	FormTypeForm   = "form"
+	FormTypeSubmit = "submit"
+	FormTypeCancel = "cancel"
+	FormTypeResult = "result"
+)
+
+// Form field types.
+const (
+	FormFieldBoolean     = "boolean"
+	FormFieldFixed       = "fixed"
+	FormFieldHidden      = "hidden"
+	FormFieldJIDMulti    = "jid-multi"
+	FormFieldJIDSingle   = "jid-single"
+	FormFieldListMulti   = "list-multi"
+	FormFieldListSingle  = "list-single"
+	FormFieldTextMulti   = "text-multi"
+	FormFieldTextPrivate = "text-private"
+	FormFieldTextSingle  = "text-single"
+)
+
+// XEP-0004: Data Forms
+type Form struct {
+	XMLName      xml.Name    `xml:"jabber:x:data x"`
+	Type         string      `xml:"type,attr"`
+	Title        string      `xml:"title,omitempty"`
+	Instructions []string    `xml:"instructions,omitempty"`
+	Fields       []FormField `xml:"field"`
+}
+
+type FormField struct {
+	Var      string       `xml:"var,attr,omitempty"`
+	Type     string       `xml:"type,attr,omitempty"`
+	Label    string       `xml:"label,attr,omitempty"`
+	Desc     string       `xml:"desc,omitempty"`
+	Required *struct{}    `xml:"required"`
+	Values   []string     `xml:"value"`
+	Options  []FormOption `xml:"option"`
+}
+
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// Return the first value of the field, or "" if it has none.
+func (f *FormField) Value() string {
+	if len(f.Values) == 0 {
+		return ""
+	}
+	return f.Values[0]
+}
+
+// Return the field with the var, or nil if there is none.
+func (f *Form) Field(name string) *FormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Return the first value of the field with the var, or "" if there is none.
+func (f *Form) Value(name string) string {
+	if field := f.Field(name); field != nil {
+		return field.Value()
+	}
+	return ""
+}
+
+// Return all values of the field with the var.
+func (f *Form) Values(name string) []string {
+	if field := f.Field(name); field != nil {
+		return field.Values
+	}
+	return nil
+}
+
+// Set the values of the field with the var, adding the field if needed.
+func (f *Form) Set(name string, values ...string) {
+	if field := f.Field(name); field != nil {
+		field.Values = values
+		return
+	}
+	f.Fields = append(f.Fields, FormField{Var: name, Values: values})
+}
+
+// Return the value of the hidden FORM_TYPE field.
+func (f *Form) FormType() string {
+	return f.Value("FORM_TYPE")
+}
+
+// Create a submit form from a received form template. Every field of the
+// template except fixed ones is copied along with its default values, ready
+// for the values to be changed with Set.
+func NewSubmitForm(template *Form) *Form {
+	form := &Form{Type: FormTypeSubmit}
+	for _, field := range template.Fields {
+		if field.Var == "" || field.Type == FormFieldFixed {
+			continue
+		}
+		submit := FormField{Var: field.Var}
+		if field.Type == FormFieldHidden {
+			submit.Type = FormFieldHidden
+		}
+		submit.Values = append([]string(nil), field.Values...)
+		form.Fields = append(form.Fields, submit)
+	}
+	return form
+}
@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestNewSubmitForm(t *testing.T) {
+	const template = `<x xmlns="jabber:x:data" type="form">` +
+		`<title>Configuration</title>` +
+		`<field var="FORM_TYPE" type="hidden"><value>http://jabber.org/protocol/muc#roomconfig</value></field>` +
+		`<field type="fixed"><value>Room settings</value></field>` +
+		`<field var="muc#roomconfig_roomname" type="text-single" label="Name"><required/></field>` +
+		`<field var="muc#roomconfig_whois" type="list-single"><value>moderators</value>` +
+		`<option label="Moderators"><value>moderators</value></option>` +
+		`<option label="Anyone"><value>anyone</value></option></field>` +
+		`</x>`
+
+	var form Form
+	if err := xml.Unmarshal([]byte(template), &form); err != nil {
+		t.Fatal(err)
+	}
+	if form.FormType() != "http://jabber.org/protocol/muc#roomconfig" {
+		t.Errorf("FORM_TYPE = %q", form.FormType())
+	}
+	if f := form.Field("muc#roomconfig_roomname"); f == nil || f.Required == nil {
+		t.Errorf("roomname field not required: %+v", f)
+	}
+	if f := form.Field("muc#roomconfig_whois"); f == nil || len(f.Options) != 2 {
+		t.Errorf("whois field options: %+v", f)
+	}
+
+	submit := NewSubmitForm(&form)
+	submit.Set("muc#roomconfig_roomname", "Lobby")
+
+	want := []FormField{
+		{Var: "FORM_TYPE", Type: FormFieldHidden, Values: []string{"http://jabber.org/protocol/muc#roomconfig"}},
+		{Var: "muc#roomconfig_roomname", Values: []string{"Lobby"}},
+		{Var: "muc#roomconfig_whois", Values: []string{"moderators"}},
+	}
+	if submit.Type != FormTypeSubmit || !reflect.DeepEqual(submit.Fields, want) {
+		t.Errorf("submit form = %+v, want fields %+v", submit, want)
+	}
+}
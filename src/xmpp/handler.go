@@ -0,0 +1,44 @@
+package xmpp
+
+// Typed stanza handlers, an alternative to consuming the In channel.
+//
+// Each handler is a filter with its own goroutine, so stanzas of a type with
+// a registered handler are no longer delivered to In while stanzas without
+// one still are. Remove a handler by passing the returned FilterID to
+// RemoveFilter.
+
+// Call fn for every incoming <message/>.
+func (x *XMPP) HandleMessage(fn func(*Message)) FilterID {
+	return x.addHandler(
+		MatcherFunc(func(v interface{}) bool {
+			_, ok := v.(*Message)
+			return ok
+		}),
+		func(v interface{}) { fn(v.(*Message)) },
+	)
+}
+
+// Call fn for every incoming <iq type="get"/> and <iq type="set"/> request.
+// Responses are left for SendRecv or, if unmatched, In. Requests the package
+// answers itself, e.g. pings, disco#info and those of handlers such as
+// HandleLastActivity, aren't passed to fn.
+func (x *XMPP) HandleIQ(fn func(*IQ)) FilterID {
+	return x.addHandler(
+		MatcherFunc(func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			return ok && (iq.Type == IQTypeGet || iq.Type == IQTypeSet)
+		}),
+		func(v interface{}) { fn(v.(*IQ)) },
+	)
+}
+
+// Call fn for every incoming <presence/>.
+func (x *XMPP) HandlePresence(fn func(*Presence)) FilterID {
+	return x.addHandler(
+		MatcherFunc(func(v interface{}) bool {
+			_, ok := v.(*Presence)
+			return ok
+		}),
+		func(v interface{}) { fn(v.(*Presence)) },
+	)
+}
@@ -0,0 +1,572 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	NSIBB = "http://jabber.org/protocol/ibb"
+
+	// Block size used by OpenIBB when none is given.
+	IBBDefaultBlockSize = 4096
+
+	// The largest block size the protocol allows.
+	IBBMaxBlockSize = 65535
+
+	// Blocks of data an IBBStream holds for Read before it stops
+	// acknowledging more.
+	ibbBufferBlocks = 16
+
+	// Longest wait for the other end to acknowledge a block or a close.
+	ibbAckTimeout = time.Minute
+)
+
+// XEP-0047: In-Band Bytestreams
+type ibbOpen struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/ibb open"`
+	BlockSize int      `xml:"block-size,attr"`
+	SID       string   `xml:"sid,attr"`
+	Stanza    string   `xml:"stanza,attr,omitempty"`
+}
+
+type ibbData struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb data"`
+	Seq     uint16   `xml:"seq,attr"`
+	SID     string   `xml:"sid,attr"`
+	Data    string   `xml:",chardata"`
+}
+
+type ibbClose struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/ibb close"`
+	SID     string   `xml:"sid,attr"`
+}
+
+// Returned by an IBBStream's Read when data arrives out of sequence.
+var ErrIBBSequence = errors.New("in-band bytestream data out of sequence")
+
+// Returned by an IBBStream's Read when a block is larger than the negotiated
+// block size or isn't valid base64.
+var ErrIBBBadData = errors.New("in-band bytestream data invalid")
+
+// Returned by an IBBStream's Read when the sender sent more data than the
+// stream buffers without waiting for it to be read.
+var ErrIBBBufferFull = errors.New("in-band bytestream buffer full")
+
+// Identifies a bytestream: the other entity's JID and the session id.
+type bytestreamKey struct {
+	peer string
+	sid  string
+}
+
+// An incoming in-band bytestream. Data is buffered as it arrives; Read returns
+// it and then io.EOF once the sender closes the stream. Once 16 blocks are
+// waiting to be read the next isn't acknowledged until Read makes room, so
+// the sender waits; one that sends more regardless ends the stream with
+// ErrIBBBufferFull.
+type IBBStream struct {
+	From      JID
+	SID       string
+	BlockSize int
+
+	x       *XMPP
+	key     bytestreamKey
+	lock    sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	seq     uint16
+	err     error
+	unacked *IQ // Data request to acknowledge once there's room.
+}
+
+func newIBBStream(x *XMPP, key bytestreamKey, from JID, open *ibbOpen) *IBBStream {
+	s := &IBBStream{From: from, SID: open.SID, BlockSize: open.BlockSize, x: x, key: key}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+func (s *IBBStream) Read(p []byte) (int, error) {
+	s.lock.Lock()
+	for s.buf.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		err := s.err
+		s.lock.Unlock()
+		return 0, err
+	}
+	n, err := s.buf.Read(p)
+	var ack *IQ
+	if s.unacked != nil && s.buf.Len() < s.maxBuffered() {
+		ack, s.unacked = s.unacked, nil
+	}
+	s.lock.Unlock()
+	if ack != nil {
+		s.x.write(ack.Reply(nil))
+	}
+	return n, err
+}
+
+// Close the stream, telling the sender. Data not yet read is discarded.
+// Waits up to a minute for the sender to acknowledge; see CloseContext.
+func (s *IBBStream) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ibbAckTimeout)
+	defer cancel()
+	return s.CloseContext(ctx)
+}
+
+// Close the stream as Close, waiting for the sender's acknowledgement until
+// the context is done.
+func (s *IBBStream) CloseContext(ctx context.Context) error {
+	if !s.x.removeIBBStream(s.key, s) {
+		return nil
+	}
+	s.finish(io.ErrClosedPipe)
+	req, _ := s.x.newIQSet(s.From, &ibbClose{SID: s.SID})
+	_, err := s.x.SendRecvContext(ctx, req)
+	return err
+}
+
+// The most data held for Read before acknowledgements are held back.
+func (s *IBBStream) maxBuffered() int {
+	return ibbBufferBlocks * s.BlockSize
+}
+
+// Add a block of data, checking its sequence number. iq is the request that
+// carried it, nil for data sent in a message, which can't be held back.
+// Return true if the request should be acknowledged now; otherwise it's
+// acknowledged by Read once there's room.
+func (s *IBBStream) receive(data *ibbData, iq *IQ) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if data.Seq != s.seq {
+		return false, ErrIBBSequence
+	}
+	block, err := base64.StdEncoding.DecodeString(data.Data)
+	if err != nil || len(block) > s.BlockSize {
+		return false, ErrIBBBadData
+	}
+	if s.unacked != nil || (iq == nil && s.buf.Len()+len(block) > s.maxBuffered()) {
+		return false, ErrIBBBufferFull
+	}
+	// Sequence numbers wrap around to 0 after 65535.
+	s.seq++
+	s.buf.Write(block)
+	s.cond.Broadcast()
+	if iq != nil && s.buf.Len() >= s.maxBuffered() {
+		s.unacked = iq
+		return false, nil
+	}
+	return true, nil
+}
+
+// End the stream; Read returns err once the buffer is drained. A request
+// still waiting for its acknowledgement is answered with an error.
+func (s *IBBStream) finish(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	unacked := s.unacked
+	s.unacked = nil
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	if unacked != nil {
+		s.x.writeError(unacked, ErrorTypeCancel, ErrorItemNotFound)
+	}
+}
+
+// Sending side of an in-band bytestream. Data is sent in blocks of the
+// negotiated size, each waiting for the recipient's acknowledgement until
+// ctx, the context the stream was opened with, is done or a minute passes.
+type ibbWriter struct {
+	x         *XMPP
+	ctx       context.Context
+	to        JID
+	sid       string
+	key       bytestreamKey
+	blockSize int
+
+	lock   sync.Mutex
+	buf    []byte
+	seq    uint16
+	closed bool
+}
+
+func (w *ibbWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(p) > 0 {
+		room := w.blockSize - len(w.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+		if len(w.buf) == w.blockSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+		n += room
+	}
+	return n, nil
+}
+
+// Send the buffered data as one block. Must be called with the lock held.
+func (w *ibbWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	req, err := w.x.newIQSet(w.to, &ibbData{
+		Seq:  w.seq,
+		SID:  w.sid,
+		Data: base64.StdEncoding.EncodeToString(w.buf),
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.sendRecv(req); err != nil {
+		return err
+	}
+	w.seq++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Send any buffered data and close the stream.
+func (w *ibbWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.flush()
+	w.closed = true
+	w.x.removeIBBWriter(w.key)
+	req, _ := w.x.newIQSet(w.to, &ibbClose{SID: w.sid})
+	if cerr := w.sendRecv(req); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Send the request and wait for the acknowledgement.
+func (w *ibbWriter) sendRecv(req *IQ) error {
+	ctx, cancel := context.WithTimeout(w.ctx, ibbAckTimeout)
+	defer cancel()
+	_, err := w.x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Open an in-band bytestream to the entity. The block size, up to
+// IBBMaxBlockSize, is the most data sent in each stanza; 0 means
+// IBBDefaultBlockSize. Writes block until the recipient has acknowledged the
+// data. Closing the writer closes the stream. Writes and Close fail once the
+// context is done, or if a block isn't acknowledged within a minute.
+func (x *XMPP) OpenIBB(ctx context.Context, to JID, blockSize int) (io.WriteCloser, error) {
+	return x.openIBB(ctx, to, UUID4(), blockSize)
+}
+
+func (x *XMPP) openIBB(ctx context.Context, to JID, sid string, blockSize int) (*ibbWriter, error) {
+	if blockSize <= 0 {
+		blockSize = IBBDefaultBlockSize
+	}
+	if blockSize > IBBMaxBlockSize {
+		blockSize = IBBMaxBlockSize
+	}
+	x.installIBB()
+	req, err := x.newIQSet(to, &ibbOpen{BlockSize: blockSize, SID: sid})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := x.SendRecvContext(ctx, req); err != nil {
+		return nil, err
+	}
+	w := &ibbWriter{x: x, ctx: ctx, to: to, sid: sid, key: bytestreamKey{to.Full(), sid}, blockSize: blockSize}
+	x.ibbLock.Lock()
+	x.ibbWriters[w.key] = w
+	x.ibbLock.Unlock()
+	return w, nil
+}
+
+// Call fn, in a new goroutine, with each in-band bytestream another entity
+// opens, other than those negotiated with stream initiation. The stream is
+// accepted before fn is called; close it to refuse the data. The feature is
+// advertised in disco#info.
+func (x *XMPP) HandleIBB(fn func(*IBBStream)) FilterID {
+	x.AddDiscoFeature(NSIBB)
+	x.installIBB()
+	return x.addResponder(
+		MatcherFunc(func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeSet || iq.PayloadName() != (xml.Name{NSIBB, "open"}) {
+				return false
+			}
+			open := &ibbOpen{}
+			if iq.PayloadDecode(open) != nil {
+				return false
+			}
+			x.ibbLock.Lock()
+			_, expected := x.ibbExpected[bytestreamKey{iq.From, open.SID}]
+			x.ibbLock.Unlock()
+			return !expected
+		}),
+		func(v interface{}) {
+			if s := x.acceptIBB(v.(*IQ)); s != nil {
+				go fn(s)
+			}
+		},
+	)
+}
+
+// Wait for the entity to open an in-band bytestream with the session id,
+// negotiated beforehand. The returned channel receives the stream once it's
+// open, or is closed if the wait is cancelled with the returned function.
+func (x *XMPP) expectIBB(from JID, sid string) (chan *IBBStream, func()) {
+	x.installIBB()
+	key := bytestreamKey{from.Full(), sid}
+	ch := make(chan *IBBStream, 1)
+	x.ibbLock.Lock()
+	x.ibbExpected[key] = ch
+	x.ibbLock.Unlock()
+	cancel := func() {
+		x.ibbLock.Lock()
+		defer x.ibbLock.Unlock()
+		if x.ibbExpected[key] == ch {
+			delete(x.ibbExpected, key)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// Accept an <open/> request, replying to it. Returns nil if it was refused.
+func (x *XMPP) acceptIBB(iq *IQ) *IBBStream {
+	open := &ibbOpen{}
+	if err := iq.PayloadDecode(open); err != nil {
+		x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+		return nil
+	}
+	if open.Stanza != "" && open.Stanza != "iq" && open.Stanza != "message" {
+		x.writeError(iq, ErrorTypeCancel, ErrorFeatureNotImplemented)
+		return nil
+	}
+	if open.BlockSize <= 0 || open.BlockSize > IBBMaxBlockSize {
+		x.writeError(iq, ErrorTypeModify, ErrorResourceConstraint)
+		return nil
+	}
+	from, err := ParseJID(iq.From)
+	if err != nil {
+		x.writeError(iq, ErrorTypeModify, ErrorJIDMalformed)
+		return nil
+	}
+	key := bytestreamKey{iq.From, open.SID}
+	s := newIBBStream(x, key, from, open)
+
+	x.ibbLock.Lock()
+	if _, ok := x.ibbStreams[key]; ok {
+		x.ibbLock.Unlock()
+		x.writeError(iq, ErrorTypeCancel, ErrorNotAcceptable)
+		return nil
+	}
+	x.ibbStreams[key] = s
+	expected := x.ibbExpected[key]
+	delete(x.ibbExpected, key)
+	x.ibbLock.Unlock()
+
+	x.write(iq.Reply(nil))
+	if expected != nil {
+		expected <- s
+		close(expected)
+	}
+	return s
+}
+
+// Reply to the request with an error.
+func (x *XMPP) writeError(iq *IQ, errorType string, condition ErrorCondition) {
+	x.write(iq.ReplyError(&StanzaError{Type: errorType, Condition: condition}))
+}
+
+// Install the handler for opening, data and close stanzas of streams in
+// progress. Done the first time in-band bytestreams are used.
+func (x *XMPP) installIBB() {
+	x.ibbOnce.Do(func() {
+		x.ibbLock.Lock()
+		x.ibbStreams = make(map[bytestreamKey]*IBBStream)
+		x.ibbWriters = make(map[bytestreamKey]*ibbWriter)
+		x.ibbExpected = make(map[bytestreamKey]chan *IBBStream)
+		x.ibbLock.Unlock()
+		x.addResponder(x.ibbMatcher(), x.handleIBB)
+	})
+}
+
+// Matcher for IBB data and close stanzas, and opens negotiated beforehand.
+func (x *XMPP) ibbMatcher() Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			switch stanza := v.(type) {
+			case *IQ:
+				if stanza.Type != IQTypeSet {
+					return false
+				}
+				switch stanza.PayloadName() {
+				case xml.Name{NSIBB, "data"}, xml.Name{NSIBB, "close"}:
+					return true
+				case xml.Name{NSIBB, "open"}:
+					open := &ibbOpen{}
+					if stanza.PayloadDecode(open) != nil {
+						return false
+					}
+					x.ibbLock.Lock()
+					_, expected := x.ibbExpected[bytestreamKey{stanza.From, open.SID}]
+					x.ibbLock.Unlock()
+					return expected
+				}
+			case *Message:
+				return messageIBBData(stanza) != nil
+			}
+			return false
+		},
+	)
+}
+
+func (x *XMPP) handleIBB(v interface{}) {
+	if msg, ok := v.(*Message); ok {
+		// Data sent in messages can't be refused, so a bad block ends the
+		// stream instead.
+		data := messageIBBData(msg)
+		if s := x.ibbStream(bytestreamKey{msg.From, data.SID}); s != nil {
+			if _, err := s.receive(data, nil); err != nil {
+				x.failIBBStream(s, err)
+			}
+		}
+		return
+	}
+
+	iq := v.(*IQ)
+	switch iq.PayloadName().Local {
+	case "open":
+		x.acceptIBB(iq)
+	case "data":
+		data := &ibbData{}
+		if err := iq.PayloadDecode(data); err != nil {
+			x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+			return
+		}
+		s := x.ibbStream(bytestreamKey{iq.From, data.SID})
+		if s == nil {
+			x.writeError(iq, ErrorTypeCancel, ErrorItemNotFound)
+			return
+		}
+		ack, err := s.receive(data, iq)
+		switch err {
+		case nil:
+			if ack {
+				x.write(iq.Reply(nil))
+			}
+		case ErrIBBSequence:
+			x.writeError(iq, ErrorTypeCancel, ErrorUnexpectedRequest)
+			x.failIBBStream(s, ErrIBBSequence)
+		case ErrIBBBufferFull:
+			x.writeError(iq, ErrorTypeWait, ErrorResourceConstraint)
+			x.failIBBStream(s, ErrIBBBufferFull)
+		default:
+			x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+			x.failIBBStream(s, ErrIBBBadData)
+		}
+	case "close":
+		cl := &ibbClose{}
+		if err := iq.PayloadDecode(cl); err != nil {
+			x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+			return
+		}
+		key := bytestreamKey{iq.From, cl.SID}
+		if s := x.ibbStream(key); s != nil && x.removeIBBStream(key, s) {
+			x.write(iq.Reply(nil))
+			s.finish(io.EOF)
+			return
+		}
+		x.ibbLock.Lock()
+		w := x.ibbWriters[key]
+		delete(x.ibbWriters, key)
+		x.ibbLock.Unlock()
+		if w == nil {
+			x.writeError(iq, ErrorTypeCancel, ErrorItemNotFound)
+			return
+		}
+		x.write(iq.Reply(nil))
+		// The writer holds its lock while waiting for an acknowledgement,
+		// so it's marked closed from another goroutine rather than
+		// blocking the handler.
+		go func() {
+			w.lock.Lock()
+			w.closed = true
+			w.lock.Unlock()
+		}()
+	}
+}
+
+// End a stream the sender broke, telling it the stream is closed.
+func (x *XMPP) failIBBStream(s *IBBStream, err error) {
+	if !x.removeIBBStream(s.key, s) {
+		return
+	}
+	s.finish(err)
+	req, _ := x.newIQSet(s.From, &ibbClose{SID: s.SID})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ibbAckTimeout)
+		defer cancel()
+		x.SendRecvContext(ctx, req)
+	}()
+}
+
+func (x *XMPP) ibbStream(key bytestreamKey) *IBBStream {
+	x.ibbLock.Lock()
+	defer x.ibbLock.Unlock()
+	return x.ibbStreams[key]
+}
+
+// Remove the stream if it's still open. Returns false if it was already
+// removed.
+func (x *XMPP) removeIBBStream(key bytestreamKey, s *IBBStream) bool {
+	x.ibbLock.Lock()
+	defer x.ibbLock.Unlock()
+	if x.ibbStreams[key] != s {
+		return false
+	}
+	delete(x.ibbStreams, key)
+	return true
+}
+
+func (x *XMPP) removeIBBWriter(key bytestreamKey) {
+	x.ibbLock.Lock()
+	defer x.ibbLock.Unlock()
+	delete(x.ibbWriters, key)
+}
+
+// Return the IBB data carried by a message, or nil.
+func messageIBBData(msg *Message) *ibbData {
+	for i := range msg.Extensions {
+		ext := &msg.Extensions[i]
+		if ext.XMLName != (xml.Name{NSIBB, "data"}) {
+			continue
+		}
+		data := &ibbData{}
+		if ext.Decode(data) != nil {
+			return nil
+		}
+		return data
+	}
+	return nil
+}
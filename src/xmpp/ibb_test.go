@@ -0,0 +1,142 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Create two XMPP instances talking directly to each other.
+func newTestXMPPPair() (*XMPP, *XMPP) {
+	a, b := net.Pipe()
+	alice := newXMPP(JID{Node: "alice", Domain: "example.com", Resource: "test"},
+		&Stream{conn: a, dec: xml.NewDecoder(a), config: &StreamConfig{}})
+	bob := newXMPP(JID{Node: "bob", Domain: "example.com", Resource: "test"},
+		&Stream{conn: b, dec: xml.NewDecoder(b), config: &StreamConfig{}})
+	alice.stampFrom = true
+	bob.stampFrom = true
+	go alice.receiver()
+	go bob.receiver()
+	return alice, bob
+}
+
+func TestIBB(t *testing.T) {
+	alice, bob := newTestXMPPPair()
+	defer alice.stream.Close()
+
+	received := make(chan []byte)
+	bob.HandleIBB(func(s *IBBStream) {
+		data, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	})
+
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	w, err := alice.OpenIBB(context.Background(), bob.JID, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestIBBStreamSequence(t *testing.T) {
+	s := newIBBStream(nil, bytestreamKey{}, JID{}, &ibbOpen{BlockSize: 4})
+	if _, err := s.receive(&ibbData{Seq: 0, Data: "YWJj"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.receive(&ibbData{Seq: 2, Data: "YWJj"}, nil); err != ErrIBBSequence {
+		t.Errorf("expected ErrIBBSequence, got %v", err)
+	}
+	if _, err := s.receive(&ibbData{Seq: 1, Data: "YWJjZGVm"}, nil); err != ErrIBBBadData {
+		t.Errorf("expected ErrIBBBadData for an oversized block, got %v", err)
+	}
+
+	s.seq = 65535
+	if _, err := s.receive(&ibbData{Seq: 65535, Data: "YWJj"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.seq != 0 {
+		t.Errorf("expected sequence to wrap to 0, got %d", s.seq)
+	}
+}
+
+func TestIBBStreamBuffer(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	s := newIBBStream(x, bytestreamKey{}, JID{}, &ibbOpen{BlockSize: 1})
+
+	// Blocks are acknowledged until the buffer is full.
+	for i := 0; i < ibbBufferBlocks; i++ {
+		ack, err := s.receive(&ibbData{Seq: uint16(i), Data: "YQ=="}, &IQ{ID: strconv.Itoa(i), Type: IQTypeSet})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i < ibbBufferBlocks-1; ack != want {
+			t.Errorf("block %d: ack = %v, want %v", i, ack, want)
+		}
+	}
+	// A sender that doesn't wait for the acknowledgement overruns it.
+	if _, err := s.receive(&ibbData{Seq: ibbBufferBlocks, Data: "YQ=="}, &IQ{ID: "over", Type: IQTypeSet}); err != ErrIBBBufferFull {
+		t.Errorf("expected ErrIBBBufferFull, got %v", err)
+	}
+
+	// Reading makes room and acknowledges the held back block.
+	acked := make(chan *IQ)
+	go func() {
+		iq := &IQ{}
+		xml.NewDecoder(server).Decode(iq)
+		acked <- iq
+	}()
+	if _, err := s.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if iq := <-acked; iq.ID != strconv.Itoa(ibbBufferBlocks-1) || iq.Type != IQTypeResult {
+		t.Errorf("acknowledged %+v", iq)
+	}
+
+	// Data in messages can't be held back, so it's refused.
+	s = newIBBStream(x, bytestreamKey{}, JID{}, &ibbOpen{BlockSize: 1})
+	for i := 0; i < ibbBufferBlocks; i++ {
+		if _, err := s.receive(&ibbData{Seq: uint16(i), Data: "YQ=="}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.receive(&ibbData{Seq: ibbBufferBlocks, Data: "YQ=="}, nil); err != ErrIBBBufferFull {
+		t.Errorf("expected ErrIBBBufferFull, got %v", err)
+	}
+}
+
+func TestIBBWriterContext(t *testing.T) {
+	alice, bob := newTestXMPPPair()
+	defer alice.stream.Close()
+	bob.HandleIBB(func(s *IBBStream) {
+		ioutil.ReadAll(s)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := alice.OpenIBB(ctx, bob.JID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := w.Write([]byte("efgh")); err != context.Canceled {
+		t.Errorf("Write after cancel: err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,41 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const (
+	NSIdle = "urn:xmpp:idle:1"
+)
+
+// XEP-0319: Last User Interaction in Presence
+type Idle struct {
+	XMLName xml.Name `xml:"urn:xmpp:idle:1 idle"`
+	Since   string   `xml:"since,attr"`
+}
+
+// Create an idle element for a user idle since the time, stamped in UTC.
+func NewIdle(since time.Time) *Idle {
+	return &Idle{Since: since.UTC().Format(time.RFC3339)}
+}
+
+// Return the time the user went idle.
+func (i *Idle) Time() (time.Time, error) {
+	return time.Parse(time.RFC3339, i.Since)
+}
+
+// Advertise that the user has been idle since the time.
+func (p *Presence) SetIdleSince(since time.Time) {
+	p.IdleInfo = NewIdle(since)
+}
+
+// Set p.IdleSince from the idle element. An unparseable stamp is ignored.
+func parsePresenceIdle(p *Presence) {
+	if p.IdleSince != nil || p.IdleInfo == nil {
+		return
+	}
+	if t, err := p.IdleInfo.Time(); err == nil {
+		p.IdleSince = &t
+	}
+}
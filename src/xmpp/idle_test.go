@@ -0,0 +1,29 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestPresenceIdle(t *testing.T) {
+	since := time.Date(2026, 10, 14, 9, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	p := &Presence{}
+	p.SetIdleSince(since)
+	b, err := xml.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<presence><idle xmlns="urn:xmpp:idle:1" since="2026-10-14T07:30:00Z"></idle></presence>`; string(b) != want {
+		t.Errorf("marshaled %s, want %s", b, want)
+	}
+
+	in := &Presence{}
+	if err := xml.Unmarshal(b, in); err != nil {
+		t.Fatal(err)
+	}
+	parsePresenceIdle(in)
+	if in.IdleSince == nil || !in.IdleSince.Equal(since) {
+		t.Errorf("IdleSince = %v, want %v", in.IdleSince, since)
+	}
+}
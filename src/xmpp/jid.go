@@ -3,6 +3,8 @@ package xmpp
 import (
 	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 /*
@@ -29,12 +31,34 @@ func (jid JID) Bare() string {
 	return fmt.Sprintf("%s@%s", jid.Node, jid.Domain)
 }
 
+// Return the "bare" JID, i.e. no resource component, as a JID.
+func (jid JID) BareJID() JID {
+	return JID{Node: jid.Node, Domain: jid.Domain}
+}
+
+// Return true if the JID has no resource component.
+func (jid JID) IsBare() bool {
+	return jid.Resource == ""
+}
+
+// Return true if the JIDs are the same after normalization. The localpart
+// and domain compare case-insensitively, the resource exactly.
+func (jid JID) Equal(other JID) bool {
+	return jid.EqualBare(other) && jid.Resource == other.Resource
+}
+
+// Return true if the JIDs are the same ignoring their resource components.
+func (jid JID) EqualBare(other JID) bool {
+	return strings.EqualFold(jid.Node, other.Node) &&
+		strings.EqualFold(strings.TrimSuffix(jid.Domain, "."), strings.TrimSuffix(other.Domain, "."))
+}
+
 // Return the full JID as a string.
 func (jid JID) Full() string {
 	if jid.Resource == "" {
 		return jid.Bare()
 	}
-	return fmt.Sprintf("%s@%s/%s", jid.Node, jid.Domain, jid.Resource)
+	return fmt.Sprintf("%s/%s", jid.Bare(), jid.Resource)
 }
 
 // Return full JID as a string.
@@ -42,24 +66,64 @@ func (jid JID) String() string {
 	return jid.Full()
 }
 
-// Parse a string into a JID structure.
+// Maximum length in bytes of each JID part (RFC 7622).
+const maxJIDPartLength = 1023
+
+// Parse a string into a JID structure. The domain is normalized to lowercase
+// and malformed JIDs are rejected.
 func ParseJID(s string) (jid JID, err error) {
 
-	if parts := strings.SplitN(s, "/", 2); len(parts) == 1 {
-		s = parts[0]
+	if !utf8.ValidString(s) {
+		return JID{}, fmt.Errorf("invalid JID %q: not valid UTF-8", s)
+	}
+
+	rest := s
+	if parts := strings.SplitN(rest, "/", 2); len(parts) == 1 {
+		rest = parts[0]
 	} else {
-		s = parts[0]
+		rest = parts[0]
 		jid.Resource = parts[1]
+		if jid.Resource == "" {
+			return JID{}, fmt.Errorf("invalid JID %q: empty resource", s)
+		}
 	}
 
-	if parts := strings.SplitN(s, "@", 2); len(parts) != 2 {
+	if parts := strings.SplitN(rest, "@", 2); len(parts) != 2 {
 		jid.Domain = parts[0]
 	} else {
 		jid.Node = parts[0]
 		jid.Domain = parts[1]
+		if jid.Node == "" {
+			return JID{}, fmt.Errorf("invalid JID %q: empty localpart", s)
+		}
+	}
+
+	// A trailing dot is not part of the canonical domain.
+	jid.Domain = strings.ToLower(strings.TrimSuffix(jid.Domain, "."))
+	if jid.Domain == "" {
+		return JID{}, fmt.Errorf("invalid JID %q: empty domain", s)
+	}
+
+	if len(jid.Node) > maxJIDPartLength || len(jid.Domain) > maxJIDPartLength || len(jid.Resource) > maxJIDPartLength {
+		return JID{}, fmt.Errorf("invalid JID %q: part longer than %d bytes", s, maxJIDPartLength)
+	}
+	if strings.IndexFunc(jid.Node, illegalLocalpartRune) >= 0 {
+		return JID{}, fmt.Errorf("invalid JID %q: illegal character in localpart", s)
+	}
+	if strings.IndexFunc(jid.Domain, illegalDomainRune) >= 0 {
+		return JID{}, fmt.Errorf("invalid JID %q: illegal character in domain", s)
+	}
+	if strings.IndexFunc(jid.Resource, unicode.IsControl) >= 0 {
+		return JID{}, fmt.Errorf("invalid JID %q: illegal character in resource", s)
 	}
 
 	return
 }
 
-// BUG(matt): ParseJID should fail for incorrectly formatted JIDs.
+func illegalLocalpartRune(r rune) bool {
+	return strings.ContainsRune("\"&'/:<>@", r) || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func illegalDomainRune(r rune) bool {
+	return r == '@' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
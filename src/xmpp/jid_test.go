@@ -1,6 +1,9 @@
 package xmpp
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestBare(t *testing.T) {
 	if (JID{"node", "domain", "resource"}).Bare() != "node@domain" {
@@ -8,6 +11,29 @@ func TestBare(t *testing.T) {
 	}
 }
 
+func TestBareJID(t *testing.T) {
+	jid := JID{"node", "domain", "resource"}
+	if jid.IsBare() || jid.BareJID() != (JID{"node", "domain", ""}) || !jid.BareJID().IsBare() {
+		t.FailNow()
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := JID{"User", "Example.com", "res"}
+	if !a.Equal(JID{"user", "example.com", "res"}) {
+		t.Error("Equal should ignore localpart and domain case")
+	}
+	if a.Equal(JID{"user", "example.com", "Res"}) {
+		t.Error("Equal should compare resources exactly")
+	}
+	if !a.EqualBare(JID{"user", "example.com", "other"}) {
+		t.Error("EqualBare should ignore resources")
+	}
+	if a.EqualBare(JID{"bob", "example.com", "res"}) {
+		t.Error("EqualBare should compare localparts")
+	}
+}
+
 func TestFull(t *testing.T) {
 	if (JID{"node", "domain", "resource"}).Full() != "node@domain/resource" {
 		t.FailNow()
@@ -18,6 +44,9 @@ func TestFull(t *testing.T) {
 	if (JID{"", "domain", ""}).Full() != "domain" {
 		t.FailNow()
 	}
+	if (JID{"", "domain", "resource"}).Full() != "domain/resource" {
+		t.FailNow()
+	}
 }
 
 func TestParseJID(t *testing.T) {
@@ -34,3 +63,40 @@ func TestParseJID(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestParseJIDNormalize(t *testing.T) {
+	for s, want := range map[string]string{
+		"Node@Example.COM/Res":   "Node@example.com/Res",
+		"example.com.":           "example.com",
+		"domain/resource@x/y":    "domain/resource@x/y",
+		"node@domain/with space": "node@domain/with space",
+	} {
+		jid, err := ParseJID(s)
+		if err != nil {
+			t.Errorf("ParseJID(%q): %v", s, err)
+			continue
+		}
+		if jid.String() != want {
+			t.Errorf("ParseJID(%q) = %q, want %q", s, jid, want)
+		}
+	}
+}
+
+func TestParseJIDInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"node@",
+		"@domain",
+		"node@domain/",
+		"no de@domain",
+		"no<de@domain",
+		"a@b@c",
+		"node@dom ain",
+		"\xff@domain",
+		strings.Repeat("a", 1024) + "@domain",
+	} {
+		if jid, err := ParseJID(s); err == nil {
+			t.Errorf("ParseJID(%q) = %q, want error", s, jid)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+)
+
+const (
+	NSLastActivity = "jabber:iq:last"
+)
+
+// XEP-0012: Last Activity
+type LastActivity struct {
+	XMLName xml.Name `xml:"jabber:iq:last query"`
+	Seconds uint64   `xml:"seconds,attr"`
+	Status  string   `xml:",chardata"`
+}
+
+// Matcher for <iq type="get"/> last activity requests.
+var LastActivityMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok || iq.Type != IQTypeGet {
+			return false
+		}
+		return iq.PayloadName() == xml.Name{NSLastActivity, "query"}
+	},
+)
+
+// Request the entity's last activity. For a bare JID that's how long ago the
+// contact went offline, along with their last unavailable status; for a full
+// JID it's how long the resource has been idle; for a server it's its uptime.
+func (x *XMPP) LastActivity(ctx context.Context, jid JID) (time.Duration, string, error) {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: jid.Full()}
+	req.PayloadEncode(&LastActivity{})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return 0, "", err
+	}
+
+	last := &LastActivity{}
+	if err := resp.PayloadDecode(last); err != nil {
+		return 0, "", err
+	}
+	return time.Duration(last.Seconds) * time.Second, last.Status, nil
+}
+
+// Answer last activity requests with the idle time and status returned by fn,
+// called for each request. The feature is advertised in disco#info. The
+// protocol expects only contacts with a presence subscription to be told;
+// fn is given the requester so it can refuse, by returning false, in which
+// case a forbidden error is sent.
+func (x *XMPP) HandleLastActivity(fn func(from string) (idle time.Duration, status string, ok bool)) FilterID {
+	x.AddDiscoFeature(NSLastActivity)
+	return x.addResponder(LastActivityMatcher, func(v interface{}) {
+		iq := v.(*IQ)
+		idle, status, ok := fn(iq.From)
+		if !ok {
+			x.writeError(iq, ErrorTypeAuth, ErrorForbidden)
+			return
+		}
+		x.write(iq.Reply(&LastActivity{Seconds: uint64(idle / time.Second), Status: status}))
+	})
+}
@@ -0,0 +1,183 @@
+package xmpp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window over which each sender's stanza rate is measured.
+const senderRateWindow = time.Second
+
+// How long a request counts as pending if it's never answered.
+const pendingRequestTTL = time.Minute
+
+// Limits the traffic a component accepts from each sender: the stanzas it
+// sends over a sliding window and the IQ requests it has waiting for a reply.
+// Stanzas over either limit are refused.
+type senderLimiter struct {
+	rate       int // Stanzas per window, 0 for no limit.
+	maxPending int // Unanswered IQ requests, 0 for no limit.
+
+	lock      sync.Mutex
+	senders   map[string]*senderState
+	lastSweep time.Time
+	refused   uint64
+}
+
+type senderState struct {
+	times   []time.Time          // When stanzas within the window arrived.
+	pending map[string]time.Time // When each unanswered request arrived, by id.
+}
+
+// Return a limiter, or nil if neither limit is set.
+func newSenderLimiter(rate, maxPending int) *senderLimiter {
+	if rate <= 0 && maxPending <= 0 {
+		return nil
+	}
+	return &senderLimiter{rate: rate, maxPending: maxPending, senders: make(map[string]*senderState)}
+}
+
+// Return true if the incoming stanza, received at now, is within its sender's
+// limits, counting it towards them.
+func (l *senderLimiter) allow(v interface{}, now time.Time) bool {
+	var from, id string
+	request := false
+	switch s := v.(type) {
+	case *IQ:
+		from, id = s.From, s.ID
+		request = s.Type == IQTypeGet || s.Type == IQTypeSet
+	case *Message:
+		from = s.From
+	case *Presence:
+		from = s.From
+	}
+	if from == "" {
+		return true
+	}
+	from = senderKey(from)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	sender := l.senders[from]
+	if sender == nil {
+		sender = &senderState{pending: make(map[string]time.Time)}
+		l.senders[from] = sender
+	}
+	if l.rate > 0 {
+		sender.prune(now)
+		if len(sender.times) >= l.rate {
+			l.refused++
+			return false
+		}
+		sender.times = append(sender.times, now)
+	}
+	if request && l.maxPending > 0 {
+		sender.expire(now)
+		if len(sender.pending) >= l.maxPending {
+			l.refused++
+			return false
+		}
+		sender.pending[id] = now
+	}
+	return true
+}
+
+// Note an outgoing stanza, which may answer a pending request.
+func (l *senderLimiter) sent(v interface{}) {
+	var iq *IQ
+	switch s := v.(type) {
+	case IQ:
+		iq = &s
+	case *IQ:
+		iq = s
+	default:
+		return
+	}
+	if iq.Type != IQTypeResult && iq.Type != IQTypeError {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if sender := l.senders[senderKey(iq.To)]; sender != nil {
+		delete(sender.pending, iq.ID)
+	}
+}
+
+// Return the number of stanzas refused and of requests waiting for a reply.
+func (l *senderLimiter) counts() (refused uint64, pending int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, sender := range l.senders {
+		pending += len(sender.pending)
+	}
+	return l.refused, pending
+}
+
+// Forget senders with nothing in the window or pending, once per window.
+func (l *senderLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < senderRateWindow {
+		return
+	}
+	l.lastSweep = now
+	for from, sender := range l.senders {
+		sender.prune(now)
+		sender.expire(now)
+		if len(sender.times) == 0 && len(sender.pending) == 0 {
+			delete(l.senders, from)
+		}
+	}
+}
+
+// Drop the arrival times that have left the window.
+func (s *senderState) prune(now time.Time) {
+	i := 0
+	for i < len(s.times) && now.Sub(s.times[i]) >= senderRateWindow {
+		i++
+	}
+	s.times = s.times[i:]
+}
+
+// Forget the requests that have waited longer than pendingRequestTTL for a
+// reply, which may never come.
+func (s *senderState) expire(now time.Time) {
+	for id, arrived := range s.pending {
+		if now.Sub(arrived) >= pendingRequestTTL {
+			delete(s.pending, id)
+		}
+	}
+}
+
+// Return the JID normalized, so a reply to a sender is matched with its
+// request however the JID's case differs.
+func senderKey(jid string) string {
+	j, err := ParseJID(jid)
+	if err != nil {
+		return jid
+	}
+	j.Node = strings.ToLower(j.Node)
+	return j.Full()
+}
+
+// Refuse a stanza over its sender's limits with a policy-violation error.
+// Errors are never answered.
+func (x *XMPP) refuseStanza(v interface{}) {
+	x.logger().Error("Sender over limits, refusing stanza")
+	e := NewError(ErrorTypeWait, ErrorPolicyViolation, "")
+	switch s := v.(type) {
+	case *IQ:
+		if s.Type == IQTypeGet || s.Type == IQTypeSet {
+			x.writeError(s, ErrorTypeWait, ErrorPolicyViolation)
+		}
+	case *Message:
+		if s.Type != MessageTypeError {
+			x.write(&Message{ID: s.ID, Type: MessageTypeError, To: s.From, From: s.To, Error: e})
+		}
+	case *Presence:
+		if s.Type != PresenceTypeError {
+			x.write(&Presence{ID: s.ID, Type: PresenceTypeError, To: s.From, From: s.To, Error: e})
+		}
+	}
+}
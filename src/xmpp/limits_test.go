@@ -0,0 +1,83 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSenderLimiterRate(t *testing.T) {
+	l := newSenderLimiter(2, 0)
+	now := time.Now()
+	msg := &Message{From: "mallory@example.com/x"}
+
+	if !l.allow(msg, now) || !l.allow(msg, now.Add(100*time.Millisecond)) {
+		t.Fatal("stanzas within the rate refused")
+	}
+	if l.allow(msg, now.Add(200*time.Millisecond)) {
+		t.Error("third stanza within a second allowed")
+	}
+	if !l.allow(&Message{From: "alice@example.com/x"}, now.Add(200*time.Millisecond)) {
+		t.Error("another sender's stanza refused")
+	}
+	// The window slides past the first stanza.
+	if !l.allow(msg, now.Add(time.Second)) {
+		t.Error("stanza after the window refused")
+	}
+	if refused, _ := l.counts(); refused != 1 {
+		t.Errorf("refused = %d, want 1", refused)
+	}
+}
+
+func TestSenderLimiterPending(t *testing.T) {
+	l := newSenderLimiter(0, 1)
+	now := time.Now()
+	from := "mallory@example.com/x"
+
+	if !l.allow(&IQ{ID: "1", Type: IQTypeGet, From: from}, now) {
+		t.Fatal("first request refused")
+	}
+	if l.allow(&IQ{ID: "2", Type: IQTypeGet, From: from}, now) {
+		t.Error("request over the pending limit allowed")
+	}
+	if !l.allow(&IQ{ID: "3", Type: IQTypeResult, From: from}, now) {
+		t.Error("result counted as a request")
+	}
+	if _, pending := l.counts(); pending != 1 {
+		t.Errorf("pending = %d, want 1", pending)
+	}
+
+	l.sent(&IQ{ID: "1", Type: IQTypeResult, To: from})
+	if !l.allow(&IQ{ID: "4", Type: IQTypeSet, From: from}, now) {
+		t.Error("request after the reply refused")
+	}
+}
+
+func TestSenderLimiterPendingExpires(t *testing.T) {
+	l := newSenderLimiter(0, 1)
+	now := time.Now()
+
+	if !l.allow(&IQ{ID: "1", Type: IQTypeGet, From: "Mallory@example.com/x"}, now) {
+		t.Fatal("first request refused")
+	}
+	// The reply's JID differs in case.
+	l.sent(&IQ{ID: "1", Type: IQTypeResult, To: "mallory@EXAMPLE.com/x"})
+	if _, pending := l.counts(); pending != 0 {
+		t.Errorf("pending = %d after the reply, want 0", pending)
+	}
+
+	from := "mallory@example.com/x"
+	if !l.allow(&IQ{ID: "2", Type: IQTypeGet, From: from}, now) {
+		t.Fatal("second request refused")
+	}
+	if l.allow(&IQ{ID: "3", Type: IQTypeGet, From: from}, now.Add(time.Second)) {
+		t.Error("request over the pending limit allowed")
+	}
+	// The unanswered request is forgotten.
+	if !l.allow(&IQ{ID: "4", Type: IQTypeGet, From: from}, now.Add(pendingRequestTTL)) {
+		t.Error("request after the unanswered one expired refused")
+	}
+	l.allow(&Message{From: "alice@example.com/x"}, now.Add(2*pendingRequestTTL))
+	if len(l.senders) != 1 {
+		t.Errorf("%d senders remembered, want 1", len(l.senders))
+	}
+}
@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"fmt"
+	"log"
+)
+
+// Interface used by the package to log what it's doing. The arguments are
+// handled in the manner of fmt.Print. It's satisfied by, for instance,
+// logrus loggers and zap's sugared logger.
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Error(v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(v ...interface{}) {}
+func (nopLogger) Info(v ...interface{})  {}
+func (nopLogger) Error(v ...interface{}) {}
+
+// Logger writing to the standard library's log package.
+type stdLogger struct{}
+
+func (stdLogger) Debug(v ...interface{}) { log.Output(2, fmt.Sprint(v...)) }
+func (stdLogger) Info(v ...interface{})  { log.Output(2, fmt.Sprint(v...)) }
+func (stdLogger) Error(v ...interface{}) { log.Output(2, "Error. "+fmt.Sprint(v...)) }
+
+// Return the logger configured for the stream. Without one nothing is logged,
+// unless LogStanzas is set in which case the standard logger is used.
+func (stream *Stream) logger() Logger {
+	if stream.config.Logger != nil {
+		return stream.config.Logger
+	}
+	if stream.config.LogStanzas {
+		return stdLogger{}
+	}
+	return nopLogger{}
+}
+
+// Return the logger configured for the XMPP instance's stream.
+func (x *XMPP) logger() Logger {
+	return x.stream.logger()
+}
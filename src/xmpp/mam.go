@@ -0,0 +1,163 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+)
+
+const (
+	NSMAM = "urn:xmpp:mam:2"
+	NSRSM = "http://jabber.org/protocol/rsm"
+)
+
+// XEP-0313: Message Archive Management
+
+// Parameters of an archive query. Zero values are not sent.
+type ArchiveQuery struct {
+	// The archive to query. Zero for the user's own archive, or e.g. a MUC
+	// room.
+	Archive JID
+
+	// Only return messages to or from this JID.
+	With JID
+
+	// Only return messages in this time range.
+	Start time.Time
+	End   time.Time
+
+	// Result Set Management (XEP-0059) paging: the maximum number of results
+	// and the archive id to page after or before.
+	Max    int
+	After  string
+	Before string
+}
+
+// The result of an archive query.
+type ArchiveResult struct {
+	Messages []*ArchivedMessage
+
+	// True if this is the last page of results.
+	Complete bool
+
+	// Archive ids of the first and last results, for paging.
+	First string
+	Last  string
+}
+
+// A message from the archive.
+type ArchivedMessage struct {
+	// The message's archive id.
+	ID      string
+	Message *Message
+}
+
+// A <result/> carried in a <message/> sent in response to a query.
+type MAMResult struct {
+	XMLName   xml.Name   `xml:"urn:xmpp:mam:2 result"`
+	QueryID   string     `xml:"queryid,attr"`
+	ID        string     `xml:"id,attr"`
+	Forwarded *Forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+type mamQuery struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2 query"`
+	QueryID string   `xml:"queryid,attr"`
+	Form    *Form    `xml:"jabber:x:data x"`
+	Set     *rsmSet  `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+type mamFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr"`
+	Set      *rsmSet  `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// XEP-0059: Result Set Management
+type rsmSet struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/rsm set"`
+	Max     int      `xml:"max,omitempty"`
+	After   string   `xml:"after,omitempty"`
+	Before  string   `xml:"before,omitempty"`
+	First   string   `xml:"first,omitempty"`
+	Last    string   `xml:"last,omitempty"`
+}
+
+// Query the message archive. Results are collected until the server
+// indicates the query is complete.
+func (x *XMPP) QueryArchive(ctx context.Context, q ArchiveQuery) (*ArchiveResult, error) {
+
+	queryID := UUID4()
+
+	form := &Form{Type: FormTypeSubmit, Fields: []FormField{{Var: "FORM_TYPE", Type: FormFieldHidden, Values: []string{NSMAM}}}}
+	if q.With != (JID{}) {
+		form.Set("with", q.With.Full())
+	}
+	if !q.Start.IsZero() {
+		form.Set("start", q.Start.UTC().Format(time.RFC3339))
+	}
+	if !q.End.IsZero() {
+		form.Set("end", q.End.UTC().Format(time.RFC3339))
+	}
+
+	query := &mamQuery{QueryID: queryID, Form: form}
+	if q.Max > 0 || q.After != "" || q.Before != "" {
+		query.Set = &rsmSet{Max: q.Max, After: q.After, Before: q.Before}
+	}
+
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: q.Archive.Full()}
+	req.PayloadEncode(query)
+
+	// Results arrive as separate messages before the IQ result, so collect
+	// them with a filter until the IQ result is in.
+	archive := q.Archive.Bare()
+	if archive == "" {
+		archive = x.JID.Bare()
+	}
+	fid, ch := x.AddFilter(MatcherFunc(
+		func(v interface{}) bool {
+			msg, ok := v.(*Message)
+			if !ok || msg.ArchiveResult == nil || msg.ArchiveResult.QueryID != queryID {
+				return false
+			}
+			return msg.From == "" || msg.From == archive
+		},
+	))
+
+	result := &ArchiveResult{}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for v := range ch {
+			r := v.(*Message).ArchiveResult
+			if r.Forwarded == nil || r.Forwarded.Message == nil {
+				continue
+			}
+			msg := r.Forwarded.Message
+			if msg.DelayInfo == nil {
+				msg.DelayInfo = r.Forwarded.Delay
+			}
+			parseMessageDelay(msg)
+			result.Messages = append(result.Messages, &ArchivedMessage{ID: r.ID, Message: msg})
+		}
+	}()
+
+	resp, err := x.SendRecvContext(ctx, req)
+	x.RemoveFilter(fid)
+	<-collected
+	if err != nil {
+		return nil, err
+	}
+
+	fin := &mamFin{}
+	if err := resp.PayloadDecode(fin); err != nil {
+		return nil, err
+	}
+	result.Complete = fin.Complete
+	if fin.Set != nil {
+		result.First = fin.Set.First
+		result.Last = fin.Set.Last
+	}
+
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package xmpp
+
+// How a JID-based matcher compares a stanza's from address with its JID.
+type JIDMatch int
+
+const (
+	// Match the full JID, so the resources must be the same too.
+	MatchFull JIDMatch = iota
+
+	// Match any resource of the JID's bare JID, e.g. every occupant of a MUC
+	// room or every client of a roster contact.
+	MatchBare
+)
+
+// Return true if from, a stanza's from attribute, is the JID.
+func (match JIDMatch) matches(jid JID, from string) bool {
+	other, err := ParseJID(from)
+	if err != nil {
+		return false
+	}
+	if match == MatchBare {
+		return other.EqualBare(jid)
+	}
+	return other.Equal(jid)
+}
+
+// Matcher for <message/> stanzas from the JID.
+func MessageFrom(jid JID, match JIDMatch) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			msg, ok := v.(*Message)
+			return ok && match.matches(jid, msg.From)
+		},
+	)
+}
+
+// Matcher for <message/> stanzas of the type, one of the MessageType*
+// constants. A message without a type matches MessageTypeNormal.
+func MessageType(t string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			msg, ok := v.(*Message)
+			if !ok {
+				return false
+			}
+			if msg.Type == "" {
+				return t == MessageTypeNormal
+			}
+			return msg.Type == t
+		},
+	)
+}
+
+// Matcher for <presence/> stanzas from the JID.
+func PresenceFrom(jid JID, match JIDMatch) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			p, ok := v.(*Presence)
+			return ok && match.matches(jid, p.From)
+		},
+	)
+}
+
+// Matcher for <iq/> stanzas of the type, one of the IQType* constants.
+func IQType(t string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			return ok && iq.Type == t
+		},
+	)
+}
+
+// Matcher for stanzas matching all the matchers, checked in order until one
+// doesn't match. No matchers match everything.
+func And(matchers ...Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			for _, m := range matchers {
+				if !m.Match(v) {
+					return false
+				}
+			}
+			return true
+		},
+	)
+}
+
+// Matcher for stanzas matching any of the matchers, checked in order until one
+// matches. No matchers match nothing.
+func Or(matchers ...Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			for _, m := range matchers {
+				if m.Match(v) {
+					return true
+				}
+			}
+			return false
+		},
+	)
+}
+
+// Matcher for stanzas the matcher doesn't match.
+func Not(m Matcher) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			return !m.Match(v)
+		},
+	)
+}
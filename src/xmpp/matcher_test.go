@@ -0,0 +1,84 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestJIDMatchers(t *testing.T) {
+	alice := JID{Node: "alice", Domain: "example.com", Resource: "home"}
+	tests := []struct {
+		m     Matcher
+		v     interface{}
+		match bool
+	}{
+		{MessageFrom(alice, MatchFull), &Message{From: "alice@example.com/home"}, true},
+		{MessageFrom(alice, MatchFull), &Message{From: "Alice@Example.com/home"}, true},
+		{MessageFrom(alice, MatchFull), &Message{From: "alice@example.com/work"}, false},
+		{MessageFrom(alice, MatchBare), &Message{From: "alice@example.com/work"}, true},
+		{MessageFrom(alice, MatchBare), &Message{From: "bob@example.com/home"}, false},
+		{MessageFrom(alice, MatchBare), &Presence{From: "alice@example.com/home"}, false},
+		{PresenceFrom(alice, MatchBare), &Presence{From: "alice@example.com"}, true},
+		{PresenceFrom(alice, MatchFull), &Presence{From: "alice@example.com"}, false},
+		{MessageType(MessageTypeChat), &Message{Type: MessageTypeChat}, true},
+		{MessageType(MessageTypeChat), &Message{}, false},
+		{MessageType(MessageTypeNormal), &Message{}, true},
+		{IQType(IQTypeGet), &IQ{Type: IQTypeGet}, true},
+		{IQType(IQTypeGet), &IQ{Type: IQTypeSet}, false},
+	}
+	for i, test := range tests {
+		if match := test.m.Match(test.v); match != test.match {
+			t.Errorf("%d: match = %v, want %v", i, match, test.match)
+		}
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	boss := JID{Node: "boss", Domain: "example.com"}
+	chat := MessageType(MessageTypeChat)
+	fromBoss := MessageFrom(boss, MatchBare)
+	tests := []struct {
+		m     Matcher
+		v     interface{}
+		match bool
+	}{
+		{And(chat, fromBoss), &Message{Type: MessageTypeChat, From: "boss@example.com/desk"}, true},
+		{And(chat, fromBoss), &Message{Type: MessageTypeChat, From: "intern@example.com/desk"}, false},
+		{And(chat, fromBoss), &Message{From: "boss@example.com/desk"}, false},
+		{And(), &Presence{}, true},
+		{Or(chat, fromBoss), &Message{From: "boss@example.com/desk"}, true},
+		{Or(chat, fromBoss), &Message{From: "intern@example.com/desk"}, false},
+		{Or(), &Message{}, false},
+		{Not(chat), &Message{}, true},
+		{Not(chat), &Message{Type: MessageTypeChat}, false},
+		{Or(And(chat, Not(fromBoss)), IQType(IQTypeGet)), &Message{Type: MessageTypeChat, From: "intern@example.com"}, true},
+		{Or(And(chat, Not(fromBoss)), IQType(IQTypeGet)), &Message{Type: MessageTypeChat, From: "boss@example.com"}, false},
+		{Or(And(chat, Not(fromBoss)), IQType(IQTypeGet)), &IQ{Type: IQTypeGet}, true},
+		{Not(Or(And(chat, Not(fromBoss)), IQType(IQTypeGet))), &IQ{Type: IQTypeSet}, true},
+	}
+	for i, test := range tests {
+		if match := test.m.Match(test.v); match != test.match {
+			t.Errorf("%d: match = %v, want %v", i, match, test.match)
+		}
+	}
+}
+
+func TestCombinatorsShortCircuit(t *testing.T) {
+	calls := 0
+	counter := func(match bool) Matcher {
+		return MatcherFunc(func(v interface{}) bool {
+			calls++
+			return match
+		})
+	}
+
+	And(counter(false), counter(true)).Match(&Message{})
+	if calls != 1 {
+		t.Errorf("And called %d matchers, want 1", calls)
+	}
+
+	calls = 0
+	Or(counter(true), counter(false)).Match(&Message{})
+	if calls != 1 {
+		t.Errorf("Or called %d matchers, want 1", calls)
+	}
+}
@@ -0,0 +1,512 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	NSMUC      = "http://jabber.org/protocol/muc"
+	NSMUCUser  = "http://jabber.org/protocol/muc#user"
+	NSMUCOwner = "http://jabber.org/protocol/muc#owner"
+	NSMUCAdmin = "http://jabber.org/protocol/muc#admin"
+
+	// Status code of an occupant presence that refers to the user.
+	MUCStatusSelfPresence = 110
+
+	// Status code of our presence when joining created the room.
+	MUCStatusRoomCreated = 201
+
+	// Status code of our presence when the room changed the nickname we
+	// joined with.
+	MUCStatusNickAssigned = 210
+
+	// Status code of the unavailable presence of an occupant changing
+	// nickname. The new nickname is in the item.
+	MUCStatusNickChanged = 303
+)
+
+// Affiliations, a user's long-lived standing with a room.
+const (
+	MUCAffiliationOwner   = "owner"
+	MUCAffiliationAdmin   = "admin"
+	MUCAffiliationMember  = "member"
+	MUCAffiliationOutcast = "outcast"
+	MUCAffiliationNone    = "none"
+)
+
+// Roles, an occupant's privileges while in a room.
+const (
+	MUCRoleModerator   = "moderator"
+	MUCRoleParticipant = "participant"
+	MUCRoleVisitor     = "visitor"
+	MUCRoleNone        = "none"
+)
+
+// XEP-0045: Multi-User Chat
+
+// Sent in the presence that joins a room.
+type MUC struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *mucHistory `xml:"history"`
+}
+
+type mucHistory struct {
+	MaxChars   *int   `xml:"maxchars,attr"`
+	MaxStanzas *int   `xml:"maxstanzas,attr"`
+	Seconds    *int   `xml:"seconds,attr"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+// Number of messages of history requested when joining a room, unless
+// JoinMUCConfig says otherwise.
+const MUCDefaultHistory = 20
+
+// How much of a room's history to replay when joining. Zero fields are not
+// sent; the room replays messages that satisfy all the limits given.
+type MUCHistory struct {
+	MaxStanzas int
+	MaxChars   int
+	Seconds    int
+	Since      time.Time
+}
+
+// Options for joining a room.
+type JoinMUCConfig struct {
+	// The room's password, if it has one.
+	Password string
+
+	// Limit the history replayed. Nil means the last MUCDefaultHistory
+	// messages.
+	History *MUCHistory
+
+	// Don't replay any history. Overrides History.
+	NoHistory bool
+}
+
+func (config *JoinMUCConfig) history() *mucHistory {
+	if config.NoHistory {
+		none := 0
+		return &mucHistory{MaxStanzas: &none}
+	}
+	if config.History == nil {
+		stanzas := MUCDefaultHistory
+		return &mucHistory{MaxStanzas: &stanzas}
+	}
+	h := &mucHistory{}
+	if config.History.MaxStanzas > 0 {
+		h.MaxStanzas = &config.History.MaxStanzas
+	}
+	if config.History.MaxChars > 0 {
+		h.MaxChars = &config.History.MaxChars
+	}
+	if config.History.Seconds > 0 {
+		h.Seconds = &config.History.Seconds
+	}
+	if !config.History.Since.IsZero() {
+		h.Since = config.History.Since.UTC().Format(time.RFC3339)
+	}
+	return h
+}
+
+// Occupant information included in presence and messages from a room.
+type MUCUser struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Items   []MUCItem   `xml:"item"`
+	Status  []MUCStatus `xml:"status"`
+}
+
+// Return true if the status code is present.
+func (u *MUCUser) HasStatus(code int) bool {
+	if u == nil {
+		return false
+	}
+	for _, s := range u.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+type MUCItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	JID         string `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+	Reason      string `xml:"reason,omitempty"`
+}
+
+type MUCStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type mucOwnerQuery struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *Form    `xml:"jabber:x:data x"`
+}
+
+type mucAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MUCItem `xml:"item"`
+}
+
+// A joined multi-user chat room.
+//
+// Occupant presence and room messages are delivered on the Presence and
+// Messages channels, which must both be consumed. Messages also receives
+// private messages from occupants; tell them apart with IsPrivate. The
+// channels are closed after Leave is called or when the stream dies.
+type MUCRoom struct {
+	XMPP *XMPP
+
+	// Bare JID of the room.
+	JID JID
+
+	// Set when joining created the room. A new room is locked until it's
+	// configured: call CreateInstant to accept the default configuration,
+	// or Configure for a reserved room.
+	Created bool
+
+	Presence chan *Presence
+	Messages chan *Message
+
+	// Our nickname and the occupants' real JIDs by nickname, zero if the
+	// room doesn't expose them.
+	lock      sync.Mutex
+	nick      string
+	occupants map[string]JID
+
+	filterID  FilterID
+	left      chan struct{}
+	leaveOnce sync.Once
+}
+
+// Join the room using the nickname. Returns once the room has confirmed we
+// have joined. If the room refuses, e.g. because the nickname is in use, its
+// error is returned as a *StanzaError; check its Condition for ErrorConflict
+// and so on. A nil config uses the defaults.
+func (x *XMPP) JoinMUC(ctx context.Context, room JID, nick string, config *JoinMUCConfig) (*MUCRoom, error) {
+
+	if config == nil {
+		config = &JoinMUCConfig{}
+	}
+
+	room = room.BareJID()
+	occupant := JID{Node: room.Node, Domain: room.Domain, Resource: nick}
+
+	fid, ch := x.AddFilter(mucRoomMatcher(room))
+
+	join := Presence{To: occupant.Full(), MUC: &MUC{Password: config.Password, History: config.history()}}
+	if err := x.writeContext(ctx, join); err != nil {
+		x.RemoveFilter(fid)
+		return nil, err
+	}
+
+	// The room sends the presence of existing occupants, then our own.
+	var occupants []*Presence
+	created := false
+	for {
+		var v interface{}
+		var ok bool
+		select {
+		case v, ok = <-ch:
+			if !ok {
+				return nil, ErrDisconnected
+			}
+		case <-ctx.Done():
+			x.RemoveFilter(fid)
+			return nil, ctx.Err()
+		}
+		p, ok := v.(*Presence)
+		if !ok {
+			continue
+		}
+		self := p.From == occupant.Full() || p.MUCUser.HasStatus(MUCStatusSelfPresence)
+		if err := p.StanzaError(); err != nil {
+			x.RemoveFilter(fid)
+			return nil, err
+		}
+		occupants = append(occupants, p)
+		if self {
+			created = p.MUCUser.HasStatus(MUCStatusRoomCreated)
+			break
+		}
+	}
+
+	r := &MUCRoom{
+		XMPP:     x,
+		JID:      room,
+		Created:  created,
+		Presence: make(chan *Presence),
+		Messages: make(chan *Message),
+
+		nick:      nick,
+		occupants: make(map[string]JID),
+		filterID:  fid,
+		left:      make(chan struct{}),
+	}
+	for _, p := range occupants {
+		r.track(p)
+	}
+	go r.dispatch(ch, occupants)
+
+	return r, nil
+}
+
+// Leave the room, returning any error sending the unavailable presence. The
+// room's channels are closed either way. Calling Leave more than once has no
+// further effect.
+func (r *MUCRoom) Leave() error {
+	var err error
+	r.leaveOnce.Do(func() {
+		occupant := JID{Node: r.JID.Node, Domain: r.JID.Domain, Resource: r.Nick()}
+		err = r.XMPP.writeContext(context.Background(), Presence{To: occupant.Full(), Type: PresenceTypeUnavailable})
+		close(r.left)
+		if removeErr := r.XMPP.RemoveFilter(r.filterID); err == nil {
+			err = removeErr
+		}
+	})
+	return err
+}
+
+// Deliver the room's stanzas to the room's channels.
+func (r *MUCRoom) dispatch(ch chan interface{}, pending []*Presence) {
+
+	defer close(r.Presence)
+	defer close(r.Messages)
+
+	for _, p := range pending {
+		select {
+		case r.Presence <- p:
+		case <-r.left:
+			return
+		}
+	}
+
+	for v := range ch {
+		switch v := v.(type) {
+		case *Presence:
+			r.track(v)
+			select {
+			case r.Presence <- v:
+			case <-r.left:
+				return
+			}
+		case *Message:
+			select {
+			case r.Messages <- v:
+			case <-r.left:
+				return
+			}
+		}
+	}
+}
+
+// Return our nickname in the room. It changes if the room renames us.
+func (r *MUCRoom) Nick() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.nick
+}
+
+// Return the nicknames of the room's occupants, including ours, sorted.
+func (r *MUCRoom) Occupants() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	nicks := make([]string, 0, len(r.occupants))
+	for nick := range r.occupants {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Return the real JID of the occupant with the nickname. ok is false if
+// there's no such occupant or the room doesn't expose its JID to us.
+func (r *MUCRoom) RealJID(nick string) (jid JID, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	jid = r.occupants[nick]
+	return jid, jid != (JID{})
+}
+
+// Send a private message to the occupant with the nickname, through the
+// room.
+func (r *MUCRoom) SendPrivateMessage(nick, body string) error {
+	occupant := JID{Node: r.JID.Node, Domain: r.JID.Domain, Resource: nick}
+	return r.XMPP.Send(&Message{
+		ID:      r.XMPP.newID(),
+		Type:    MessageTypeChat,
+		To:      occupant.Full(),
+		Body:    []MessageBody{{Value: body}},
+		MUCUser: &MUCUser{},
+	})
+}
+
+// Return true if the message from Messages is a private message from an
+// occupant rather than a message to the whole room.
+func (r *MUCRoom) IsPrivate(msg *Message) bool {
+	if msg.Type == MessageTypeGroupchat || msg.Type == MessageTypeError {
+		return false
+	}
+	from, err := ParseJID(msg.From)
+	return err == nil && from.Resource != ""
+}
+
+// Update the occupants and our nickname from an occupant's presence.
+func (r *MUCRoom) track(p *Presence) {
+	from, err := ParseJID(p.From)
+	if err != nil || from.Resource == "" {
+		return
+	}
+	nick := from.Resource
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	self := p.MUCUser.HasStatus(MUCStatusSelfPresence)
+	switch p.Type {
+	case "":
+		var real JID
+		if p.MUCUser != nil && len(p.MUCUser.Items) > 0 && p.MUCUser.Items[0].JID != "" {
+			real, _ = ParseJID(p.MUCUser.Items[0].JID)
+		}
+		r.occupants[nick] = real
+		// The room may have assigned us a different nickname.
+		if self {
+			r.nick = nick
+		}
+	case PresenceTypeUnavailable:
+		delete(r.occupants, nick)
+		if (self || nick == r.nick) && p.MUCUser.HasStatus(MUCStatusNickChanged) &&
+			len(p.MUCUser.Items) > 0 && p.MUCUser.Items[0].Nick != "" {
+			r.nick = p.MUCUser.Items[0].Nick
+		}
+	}
+}
+
+// Accept the default configuration of a room we created.
+func (r *MUCRoom) CreateInstant(ctx context.Context) error {
+	return r.XMPP.SubmitRoomConfig(ctx, r.JID, &Form{Type: FormTypeSubmit})
+}
+
+// Configure a room we created, or own. fn is given a submit form with the
+// room's current configuration to change with Set. If fn returns an error
+// the configuration is cancelled, which destroys a room that was just
+// created, and the error is returned.
+func (r *MUCRoom) Configure(ctx context.Context, fn func(*Form) error) error {
+	template, err := r.XMPP.GetRoomConfig(ctx, r.JID)
+	if err != nil {
+		return err
+	}
+	form := NewSubmitForm(template)
+	if err := fn(form); err != nil {
+		r.XMPP.SubmitRoomConfig(ctx, r.JID, &Form{Type: FormTypeCancel})
+		return err
+	}
+	return r.XMPP.SubmitRoomConfig(ctx, r.JID, form)
+}
+
+// Retrieve the room's configuration form. Only the room's owners may.
+func (x *XMPP) GetRoomConfig(ctx context.Context, room JID) (*Form, error) {
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: room.Bare()}
+	req.PayloadEncode(&mucOwnerQuery{})
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	query := &mucOwnerQuery{}
+	if err := resp.PayloadDecode(query); err != nil {
+		return nil, err
+	}
+	if query.Form == nil {
+		return nil, errors.New("MUC owner query without a form")
+	}
+	return query.Form, nil
+}
+
+// Submit the room's configuration, a submit form such as one created from
+// the configuration form with NewSubmitForm, or a cancel form.
+func (x *XMPP) SubmitRoomConfig(ctx context.Context, room JID, form *Form) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: room.Bare()}
+	req.PayloadEncode(&mucOwnerQuery{Form: form})
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Change the room's subject. The room refuses unless we're allowed to.
+func (x *XMPP) SetRoomSubject(room JID, subject string) error {
+	return x.Send(&Message{ID: x.newID(), Type: MessageTypeGroupchat, To: room.Bare(), Subject: subject})
+}
+
+// Change the role of the occupant with the nickname, e.g. to
+// MUCRoleParticipant to give a visitor voice.
+func (x *XMPP) SetRole(ctx context.Context, room JID, nick, role, reason string) error {
+	return x.mucAdminSet(ctx, room, MUCItem{Nick: nick, Role: role, Reason: reason})
+}
+
+// Kick the occupant with the nickname out of the room.
+func (x *XMPP) Kick(ctx context.Context, room JID, nick, reason string) error {
+	return x.SetRole(ctx, room, nick, MUCRoleNone, reason)
+}
+
+// Change the user's affiliation with the room, e.g. to MUCAffiliationMember
+// to grant membership or MUCAffiliationNone to revoke it.
+func (x *XMPP) SetAffiliation(ctx context.Context, room, jid JID, affiliation, reason string) error {
+	return x.mucAdminSet(ctx, room, MUCItem{JID: jid.Bare(), Affiliation: affiliation, Reason: reason})
+}
+
+// Ban the user from the room.
+func (x *XMPP) Ban(ctx context.Context, room, jid JID, reason string) error {
+	return x.SetAffiliation(ctx, room, jid, MUCAffiliationOutcast, reason)
+}
+
+// Retrieve the users with the affiliation, e.g. the room's members.
+func (x *XMPP) RoomAffiliations(ctx context.Context, room JID, affiliation string) ([]MUCItem, error) {
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: room.Bare()}
+	req.PayloadEncode(&mucAdminQuery{Items: []MUCItem{{Affiliation: affiliation}}})
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	query := &mucAdminQuery{}
+	if err := resp.PayloadDecode(query); err != nil {
+		return nil, err
+	}
+	return query.Items, nil
+}
+
+func (x *XMPP) mucAdminSet(ctx context.Context, room JID, item MUCItem) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: room.Bare()}
+	req.PayloadEncode(&mucAdminQuery{Items: []MUCItem{item}})
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Matcher for presence and messages from the room or its occupants.
+func mucRoomMatcher(room JID) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			var from string
+			switch v := v.(type) {
+			case *Presence:
+				from = v.From
+			case *Message:
+				from = v.From
+			default:
+				return false
+			}
+			jid, err := ParseJID(from)
+			if err != nil {
+				return false
+			}
+			return jid.EqualBare(room)
+		},
+	)
+}
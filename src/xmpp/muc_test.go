@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMUCRoomTrack(t *testing.T) {
+	r := &MUCRoom{nick: "alice", occupants: make(map[string]JID)}
+	presences := []string{
+		`<presence from="room@muc.example.com/bob"><x xmlns="http://jabber.org/protocol/muc#user">` +
+			`<item affiliation="member" role="participant" jid="bob@example.com/pc"/></x></presence>`,
+		`<presence from="room@muc.example.com/carol"><x xmlns="http://jabber.org/protocol/muc#user">` +
+			`<item affiliation="none" role="participant"/></x></presence>`,
+		// The room assigned us a different nickname.
+		`<presence from="room@muc.example.com/Alice"><x xmlns="http://jabber.org/protocol/muc#user">` +
+			`<item affiliation="owner" role="moderator"/><status code="110"/><status code="210"/></x></presence>`,
+	}
+	for _, raw := range presences {
+		p := &Presence{}
+		if err := xml.Unmarshal([]byte(raw), p); err != nil {
+			t.Fatal(err)
+		}
+		r.track(p)
+	}
+
+	if r.Nick() != "Alice" {
+		t.Errorf("expected assigned nick, got %q", r.Nick())
+	}
+	if jid, ok := r.RealJID("bob"); !ok || jid.Full() != "bob@example.com/pc" {
+		t.Errorf("unexpected real JID for bob %v", jid)
+	}
+	if _, ok := r.RealJID("carol"); ok {
+		t.Errorf("expected no real JID for carol")
+	}
+
+	// We change nickname.
+	for _, raw := range []string{
+		`<presence from="room@muc.example.com/Alice" type="unavailable"><x xmlns="http://jabber.org/protocol/muc#user">` +
+			`<item affiliation="owner" role="moderator" nick="alice2"/><status code="303"/><status code="110"/></x></presence>`,
+		`<presence from="room@muc.example.com/alice2"><x xmlns="http://jabber.org/protocol/muc#user">` +
+			`<item affiliation="owner" role="moderator"/><status code="110"/></x></presence>`,
+	} {
+		p := &Presence{}
+		if err := xml.Unmarshal([]byte(raw), p); err != nil {
+			t.Fatal(err)
+		}
+		r.track(p)
+	}
+	if r.Nick() != "alice2" {
+		t.Errorf("expected changed nick, got %q", r.Nick())
+	}
+	if occupants := r.Occupants(); !reflect.DeepEqual(occupants, []string{"alice2", "bob", "carol"}) {
+		t.Errorf("unexpected occupants %v", occupants)
+	}
+
+	if !r.IsPrivate(&Message{Type: MessageTypeChat, From: "room@muc.example.com/bob"}) {
+		t.Error("expected a private message")
+	}
+	if r.IsPrivate(&Message{Type: MessageTypeGroupchat, From: "room@muc.example.com/bob"}) {
+		t.Error("expected a groupchat message")
+	}
+}
+
+func TestJoinMUCHistory(t *testing.T) {
+	tests := []struct {
+		config   *JoinMUCConfig
+		expected string
+	}{
+		{&JoinMUCConfig{}, `<history maxstanzas="20"></history>`},
+		{&JoinMUCConfig{NoHistory: true}, `<history maxstanzas="0"></history>`},
+		{&JoinMUCConfig{History: &MUCHistory{MaxChars: 1000, Seconds: 60}}, `<history maxchars="1000" seconds="60"></history>`},
+		{&JoinMUCConfig{History: &MUCHistory{Since: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}, `<history since="2020-01-02T03:04:05Z"></history>`},
+	}
+	for _, test := range tests {
+		b, err := xml.Marshal(&MUC{History: test.config.history()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != `<x xmlns="http://jabber.org/protocol/muc">`+test.expected+`</x>` {
+			t.Errorf("expected %s, got %s", test.expected, b)
+		}
+	}
+}
+
+func TestJoinMUCContext(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+
+	// Nothing reads the join presence, so it can't be written.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	room := JID{Node: "room", Domain: "muc.example.com"}
+	if _, err := x.JoinMUC(ctx, room, "alice", nil); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if len(x.filters) != 0 {
+		t.Errorf("%d filters left", len(x.filters))
+	}
+}
@@ -1,10 +1,13 @@
 package xmpp
 
 const (
-	nsStreams         = "http://etherx.jabber.org/streams"
-	nsClient          = "jabber:client"
-	nsTLS             = "urn:ietf:params:xml:ns:xmpp-tls"
-	nsComponentAccept = "jabber:component:accept"
-	nsErrorStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
-	nsErrorStreams    = "urn:ietf:params:xml:ns:xmpp-streams"
+	nsStreams          = "http://etherx.jabber.org/streams"
+	nsClient           = "jabber:client"
+	nsTLS              = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL             = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind             = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsStreamManagement = "urn:xmpp:sm:3"
+	nsComponentAccept  = "jabber:component:accept"
+	nsErrorStanzas     = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsErrorStreams     = "urn:ietf:params:xml:ns:xmpp-streams"
 )
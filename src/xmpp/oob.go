@@ -0,0 +1,22 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	NSOOB = "jabber:x:oob"
+)
+
+// XEP-0066: Out of Band Data
+type OOB struct {
+	XMLName xml.Name `xml:"jabber:x:oob x"`
+	URL     string   `xml:"url"`
+	Desc    string   `xml:"desc,omitempty"`
+}
+
+// Attach a URL, with an optional description, to the message. Many clients
+// only show the attachment inline if the body is the URL itself.
+func (msg *Message) AttachURL(url, desc string) {
+	msg.OOB = append(msg.OOB, OOB{URL: url, Desc: desc})
+}
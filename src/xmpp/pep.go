@@ -0,0 +1,246 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+const (
+	NSTune     = "http://jabber.org/protocol/tune"
+	NSMood     = "http://jabber.org/protocol/mood"
+	NSActivity = "http://jabber.org/protocol/activity"
+	NSNick     = "http://jabber.org/protocol/nick"
+)
+
+// XEP-0163: Personal Eventing Protocol. Items are published to the user's own
+// account, always with the id "current" so only the latest is kept.
+const pepCurrentItem = "current"
+
+// XEP-0118: User Tune. An empty Tune means nothing is playing.
+type Tune struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/tune tune"`
+	Artist  string   `xml:"artist,omitempty"`
+	Length  int      `xml:"length,omitempty"` // Seconds
+	Rating  int      `xml:"rating,omitempty"` // 1 to 10
+	Source  string   `xml:"source,omitempty"`
+	Title   string   `xml:"title,omitempty"`
+	Track   string   `xml:"track,omitempty"`
+	URI     string   `xml:"uri,omitempty"`
+}
+
+// XEP-0107: User Mood. Value is one of the moods the XEP defines, e.g.
+// "happy"; an empty Mood clears it.
+type Mood struct {
+	Value string
+	Text  string
+}
+
+func (m Mood) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{NSMood, "mood"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if m.Value != "" {
+		if err := e.EncodeElement("", xml.StartElement{Name: xml.Name{Local: m.Value}}); err != nil {
+			return err
+		}
+	}
+	if m.Text != "" {
+		if err := e.EncodeElement(m.Text, xml.StartElement{Name: xml.Name{Local: "text"}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (m *Mood) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*m = Mood{}
+	return decodeChildren(d, func(child xml.StartElement) error {
+		if child.Name.Local == "text" {
+			return d.DecodeElement(&m.Text, &child)
+		}
+		m.Value = child.Name.Local
+		return d.Skip()
+	})
+}
+
+// XEP-0108: User Activity. General is one of the activities the XEP defines,
+// e.g. "working", and Specific optionally refines it, e.g. "coding". An empty
+// Activity clears it.
+type Activity struct {
+	General  string
+	Specific string
+	Text     string
+}
+
+func (a Activity) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{NSActivity, "activity"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if a.General != "" {
+		general := xml.StartElement{Name: xml.Name{Local: a.General}}
+		if err := e.EncodeToken(general); err != nil {
+			return err
+		}
+		if a.Specific != "" {
+			if err := e.EncodeElement("", xml.StartElement{Name: xml.Name{Local: a.Specific}}); err != nil {
+				return err
+			}
+		}
+		if err := e.EncodeToken(general.End()); err != nil {
+			return err
+		}
+	}
+	if a.Text != "" {
+		if err := e.EncodeElement(a.Text, xml.StartElement{Name: xml.Name{Local: "text"}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (a *Activity) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*a = Activity{}
+	return decodeChildren(d, func(child xml.StartElement) error {
+		if child.Name.Local == "text" {
+			return d.DecodeElement(&a.Text, &child)
+		}
+		a.General = child.Name.Local
+		return decodeChildren(d, func(specific xml.StartElement) error {
+			a.Specific = specific.Name.Local
+			return d.Skip()
+		})
+	})
+}
+
+// Call fn for each child element until the end of the current element. fn
+// must consume the child.
+func decodeChildren(d *xml.Decoder, fn func(xml.StartElement) error) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err := fn(t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// XEP-0172: User Nickname
+type userNick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Nick    string   `xml:",chardata"`
+}
+
+// Publish the nickname the user would like contacts to know them by.
+func (x *XMPP) PublishNick(ctx context.Context, nick string) error {
+	_, err := x.pubSubPublish(ctx, JID{}, NSNick, pepCurrentItem, &userNick{Nick: nick})
+	return err
+}
+
+// Publish what the user is listening to.
+func (x *XMPP) PublishTune(ctx context.Context, tune Tune) error {
+	_, err := x.pubSubPublish(ctx, JID{}, NSTune, pepCurrentItem, &tune)
+	return err
+}
+
+// Publish the user's mood.
+func (x *XMPP) PublishMood(ctx context.Context, mood Mood) error {
+	_, err := x.pubSubPublish(ctx, JID{}, NSMood, pepCurrentItem, &mood)
+	return err
+}
+
+// Publish what the user is doing.
+func (x *XMPP) PublishActivity(ctx context.Context, activity Activity) error {
+	_, err := x.pubSubPublish(ctx, JID{}, NSActivity, pepCurrentItem, &activity)
+	return err
+}
+
+// A contact's tune, mood, activity or nickname. Only the field for the
+// event's node is set.
+type PEPEvent struct {
+	From     JID
+	Tune     *Tune
+	Mood     *Mood
+	Activity *Activity
+	Nick     *string
+}
+
+// Matcher instance to match <message/> stanzas with a tune, mood, activity or
+// nickname event.
+var PEPEventMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		msg, ok := v.(*Message)
+		if !ok || msg.Event == nil || msg.Event.Items == nil {
+			return false
+		}
+		switch msg.Event.Items.Node {
+		case NSTune, NSMood, NSActivity, NSNick:
+			return true
+		}
+		return false
+	},
+)
+
+// Subscribe to contacts' tunes, moods, activities and nicknames, delivered on
+// the returned channel instead of In. Interest is advertised with entity
+// capabilities, so presence must be sent (again) afterwards with a caps node
+// set. The channel is closed when the filter is removed with RemoveFilter or
+// the stream dies.
+func (x *XMPP) PEPEvents() (FilterID, <-chan *PEPEvent) {
+	for _, node := range []string{NSTune, NSMood, NSActivity, NSNick} {
+		x.AddDiscoFeature(node + "+notify")
+	}
+	events := make(chan *PEPEvent)
+	id, ch := x.AddFilter(PEPEventMatcher)
+	go func() {
+		defer close(events)
+		for v := range ch {
+			msg := v.(*Message)
+			from, err := ParseJID(msg.From)
+			if err != nil {
+				continue
+			}
+			for _, item := range msg.Event.Items.Items {
+				if event := newPEPEvent(from, msg.Event.Items.Node, &item); event != nil {
+					events <- event
+				}
+			}
+		}
+	}()
+	return id, events
+}
+
+func newPEPEvent(from JID, node string, item *PubSubEventItem) *PEPEvent {
+	event := &PEPEvent{From: from}
+	var v interface{}
+	switch node {
+	case NSTune:
+		event.Tune = &Tune{}
+		v = event.Tune
+	case NSMood:
+		event.Mood = &Mood{}
+		v = event.Mood
+	case NSActivity:
+		event.Activity = &Activity{}
+		v = event.Activity
+	case NSNick:
+		nick := &userNick{}
+		if err := item.PayloadDecode(nick); err != nil {
+			return nil
+		}
+		event.Nick = &nick.Nick
+		return event
+	}
+	if err := item.PayloadDecode(v); err != nil {
+		return nil
+	}
+	return event
+}
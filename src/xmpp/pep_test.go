@@ -0,0 +1,43 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestMoodXML(t *testing.T) {
+	b, err := xml.Marshal(&Mood{Value: "happy", Text: "Yay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `<mood xmlns="http://jabber.org/protocol/mood"><happy></happy><text>Yay</text></mood>` {
+		t.Errorf("unexpected mood %s", b)
+	}
+	mood := &Mood{}
+	if err := xml.Unmarshal(b, mood); err != nil {
+		t.Fatal(err)
+	}
+	if *mood != (Mood{Value: "happy", Text: "Yay"}) {
+		t.Errorf("unexpected mood %+v", mood)
+	}
+}
+
+func TestActivityXML(t *testing.T) {
+	raw := `<activity xmlns="http://jabber.org/protocol/activity"><working><coding/></working><text>Hacking</text></activity>`
+	activity := &Activity{}
+	if err := xml.Unmarshal([]byte(raw), activity); err != nil {
+		t.Fatal(err)
+	}
+	expected := Activity{General: "working", Specific: "coding", Text: "Hacking"}
+	if *activity != expected {
+		t.Fatalf("unexpected activity %+v", activity)
+	}
+	b, err := xml.Marshal(activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Activity{}
+	if err := xml.Unmarshal(b, decoded); err != nil || *decoded != expected {
+		t.Errorf("unexpected round trip %s", b)
+	}
+}
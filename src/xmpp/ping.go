@@ -1,13 +1,70 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"time"
 )
 
 const (
 	NSPing = "urn:xmpp:ping"
 )
 
+// XEP-0199: XMPP Ping
 type Ping struct {
 	XMLName xml.Name `xml:"urn:xmpp:ping ping"`
 }
+
+// Matcher instance to match <iq type="get"/> stanzas with a ping payload.
+var PingMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok || iq.Type != IQTypeGet {
+			return false
+		}
+		return iq.PayloadName() == xml.Name{NSPing, "ping"}
+	},
+)
+
+// Ping the entity. A nil error means a reply, possibly an error such as
+// service-unavailable from a client that doesn't support ping, was received.
+func (x *XMPP) Ping(ctx context.Context, to string) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: to}
+	req.PayloadEncode(&Ping{})
+	_, err := x.SendRecvContext(ctx, req)
+	if _, ok := err.(*StanzaError); ok {
+		return nil
+	}
+	return err
+}
+
+// Answer incoming pings. Installed for every XMPP instance.
+func (x *XMPP) answerPings() {
+	x.addResponder(PingMatcher, func(v interface{}) {
+		x.write(v.(*IQ).Reply(nil))
+	})
+}
+
+// Ping the server every interval, dropping the connection if a reply isn't
+// received within the interval.
+func (x *XMPP) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-x.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := x.Ping(ctx, x.JID.Domain)
+		cancel()
+		if err != nil {
+			// The connection is dead, so there's no point ending the stream
+			// politely. Closing it releases the receiver's blocked read.
+			x.logger().Error("Keepalive ping failed. ", err)
+			x.stream.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPingErrorReply(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	go x.receiver()
+
+	go func() {
+		req := &IQ{}
+		if err := xml.NewDecoder(server).Decode(req); err != nil {
+			return
+		}
+		fmt.Fprintf(server, `<iq type="error" id="%s" from="bob@example.com/x"><error type="cancel">`+
+			`<service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`, req.ID)
+	}()
+
+	// Any reply shows the entity is there.
+	if err := x.Ping(context.Background(), "bob@example.com/x"); err != nil {
+		t.Errorf("err = %v, want nil for an error reply", err)
+	}
+}
+
+func TestKeepaliveDropsConnection(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+
+	// The server reads but never replies.
+	go io.Copy(io.Discard, server)
+	go x.receiver()
+	go x.keepalive(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		for range x.In {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not dropped after an unanswered ping")
+	}
+}
@@ -0,0 +1,84 @@
+package xmpp
+
+import (
+	"sort"
+)
+
+// Directed presence (RFC 6121 section 4.6). Available presence sent to a
+// particular JID, e.g. to join a MUC room or to an entity not in the roster,
+// is remembered until unavailable presence is sent to it, so that changes of
+// availability can be sent to the same recipients and they can be told when
+// we go offline.
+
+// Record the recipient of a directed presence that was written.
+func (x *XMPP) trackPresence(v interface{}) {
+	var p *Presence
+	switch presence := v.(type) {
+	case Presence:
+		p = &presence
+	case *Presence:
+		p = presence
+	default:
+		return
+	}
+	if p.To == "" {
+		return
+	}
+
+	x.directedLock.Lock()
+	defer x.directedLock.Unlock()
+	switch p.Type {
+	case "":
+		if x.directed == nil {
+			x.directed = make(map[string]bool)
+		}
+		x.directed[p.To] = true
+	case PresenceTypeUnavailable:
+		delete(x.directed, p.To)
+	}
+}
+
+// Return the JIDs we've sent available presence to directly and not since
+// sent unavailable presence to, sorted.
+func (x *XMPP) DirectedPresenceRecipients() []string {
+	x.directedLock.Lock()
+	defer x.directedLock.Unlock()
+	recipients := make([]string, 0, len(x.directed))
+	for to := range x.directed {
+		recipients = append(recipients, to)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+// Send the presence to the server, for our contacts, and to every recipient of
+// directed presence. Any To in p is ignored. Unavailable presence also ends
+// the tracking of directed recipients. Returns the first error.
+func (x *XMPP) BroadcastPresence(p Presence) error {
+	p.To = ""
+	err := x.Send(p)
+	for _, to := range x.DirectedPresenceRecipients() {
+		directed := p
+		directed.To = to
+		if sendErr := x.Send(directed); err == nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// Send unavailable presence to every recipient of directed presence as the
+// stream's closing. Skipped if a write is in progress, as the stream may be
+// stuck; servers send unavailable presence on our behalf in any case.
+func (x *XMPP) leaveDirectedPresence() {
+	if !x.writeLock.TryLock() {
+		return
+	}
+	defer x.writeLock.Unlock()
+	for _, to := range x.DirectedPresenceRecipients() {
+		p := x.outgoing(&Presence{Type: PresenceTypeUnavailable, To: to})
+		if err := x.stream.Send(p); err != nil {
+			return
+		}
+	}
+}
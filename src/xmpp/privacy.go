@@ -0,0 +1,190 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+)
+
+const (
+	NSPrivacy = "jabber:iq:privacy"
+)
+
+// Privacy list item types. An item with no type matches everything.
+const (
+	PrivacyTypeJID          = "jid"
+	PrivacyTypeGroup        = "group"
+	PrivacyTypeSubscription = "subscription"
+)
+
+// Privacy list item actions.
+const (
+	PrivacyActionAllow = "allow"
+	PrivacyActionDeny  = "deny"
+)
+
+// XEP-0016: Privacy Lists
+
+// Returned when the server doesn't support privacy lists. Servers that have
+// dropped them usually support the blocking command instead.
+var ErrPrivacyNotSupported = errors.New("server does not support privacy lists")
+
+type privacyQuery struct {
+	XMLName xml.Name      `xml:"jabber:iq:privacy query"`
+	Active  *privacyName  `xml:"active"`
+	Default *privacyName  `xml:"default"`
+	Lists   []PrivacyList `xml:"list"`
+}
+
+type privacyName struct {
+	Name string `xml:"name,attr,omitempty"`
+}
+
+// A named list of rules, applied in ascending Order until one matches.
+type PrivacyList struct {
+	Name  string        `xml:"name,attr"`
+	Items []PrivacyItem `xml:"item"`
+}
+
+// A privacy rule. Type and Value say who the rule applies to, e.g. type
+// "subscription" value "none". If none of the stanza kinds is set the rule
+// applies to all of them.
+type PrivacyItem struct {
+	Type   string `xml:"type,attr,omitempty"`
+	Value  string `xml:"value,attr,omitempty"`
+	Action string `xml:"action,attr"`
+	Order  uint   `xml:"order,attr"`
+
+	Message     *struct{} `xml:"message"`
+	IQ          *struct{} `xml:"iq"`
+	PresenceIn  *struct{} `xml:"presence-in"`
+	PresenceOut *struct{} `xml:"presence-out"`
+}
+
+// Retrieve the names of the user's privacy lists and of the active and
+// default lists, "" if there is none.
+func (x *XMPP) PrivacyLists(ctx context.Context) (active, def string, names []string, err error) {
+	query, err := x.privacyGet(ctx, &privacyQuery{})
+	if err != nil {
+		return "", "", nil, err
+	}
+	if query.Active != nil {
+		active = query.Active.Name
+	}
+	if query.Default != nil {
+		def = query.Default.Name
+	}
+	for _, list := range query.Lists {
+		names = append(names, list.Name)
+	}
+	return active, def, names, nil
+}
+
+// Retrieve the privacy list's rules.
+func (x *XMPP) PrivacyList(ctx context.Context, name string) (*PrivacyList, error) {
+	query, err := x.privacyGet(ctx, &privacyQuery{Lists: []PrivacyList{{Name: name}}})
+	if err != nil {
+		return nil, err
+	}
+	for i := range query.Lists {
+		if query.Lists[i].Name == name {
+			return &query.Lists[i], nil
+		}
+	}
+	return nil, &StanzaError{Type: ErrorTypeCancel, Condition: ErrorItemNotFound}
+}
+
+// Create or replace the privacy list. Each item needs a unique Order.
+func (x *XMPP) SetPrivacyList(ctx context.Context, list *PrivacyList) error {
+	return x.privacySet(ctx, &privacyQuery{Lists: []PrivacyList{*list}})
+}
+
+// Remove the privacy list.
+func (x *XMPP) RemovePrivacyList(ctx context.Context, name string) error {
+	return x.privacySet(ctx, &privacyQuery{Lists: []PrivacyList{{Name: name}}})
+}
+
+// Make the list active for this session, or use no list if name is "".
+func (x *XMPP) SetActivePrivacyList(ctx context.Context, name string) error {
+	return x.privacySet(ctx, &privacyQuery{Active: &privacyName{name}})
+}
+
+// Make the list the default for all of the user's sessions, or use no list
+// if name is "".
+func (x *XMPP) SetDefaultPrivacyList(ctx context.Context, name string) error {
+	return x.privacySet(ctx, &privacyQuery{Default: &privacyName{name}})
+}
+
+// Call fn, in a dedicated goroutine, with the name of each privacy list the
+// server says was changed, by any of the user's resources. Retrieve the list
+// with PrivacyList to see the new rules. The push is acknowledged
+// automatically.
+func (x *XMPP) HandlePrivacyPush(fn func(name string)) FilterID {
+	return x.addResponder(x.privacyPushMatcher(), func(v interface{}) {
+		iq := v.(*IQ)
+		x.write(iq.Reply(nil))
+		push := &privacyQuery{}
+		if err := iq.PayloadDecode(push); err != nil {
+			return
+		}
+		for _, list := range push.Lists {
+			fn(list.Name)
+		}
+	})
+}
+
+// Matcher for <iq type="set"/> privacy list pushes from the user's account.
+func (x *XMPP) privacyPushMatcher() Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeSet {
+				return false
+			}
+			if iq.From != "" && iq.From != x.JID.Bare() {
+				return false
+			}
+			return iq.PayloadName() == xml.Name{NSPrivacy, "query"}
+		},
+	)
+}
+
+func (x *XMPP) privacyGet(ctx context.Context, query *privacyQuery) (*privacyQuery, error) {
+	if err := x.checkPrivacy(ctx); err != nil {
+		return nil, err
+	}
+	req := &IQ{ID: x.newID(), Type: IQTypeGet}
+	req.PayloadEncode(query)
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	result := &privacyQuery{}
+	if err := resp.PayloadDecode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (x *XMPP) privacySet(ctx context.Context, query *privacyQuery) error {
+	if err := x.checkPrivacy(ctx); err != nil {
+		return err
+	}
+	req := &IQ{ID: x.newID(), Type: IQTypeSet}
+	req.PayloadEncode(query)
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Return ErrPrivacyNotSupported if the server doesn't advertise privacy
+// lists.
+func (x *XMPP) checkPrivacy(ctx context.Context) error {
+	ok, err := x.ServerSupports(ctx, NSPrivacy)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPrivacyNotSupported
+	}
+	return nil
+}
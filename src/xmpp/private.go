@@ -0,0 +1,99 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+)
+
+const (
+	NSPrivate = "jabber:iq:private"
+)
+
+// XEP-0049: Private XML Storage
+
+type privateQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:private query"`
+	Payload []byte   `xml:",innerxml"`
+}
+
+// Retrieve the element with the name from the user's private storage. It's
+// decoded into a new value of the type registered for the name with
+// RegisterElement, if any, or returned as an *Extension otherwise. If nothing
+// is stored under the name, nil is returned with no error.
+func (x *XMPP) PrivateGet(ctx context.Context, element xml.Name) (interface{}, error) {
+
+	ext, err := x.privateGet(ctx, element)
+	if err != nil || ext == nil {
+		return nil, err
+	}
+
+	if v := newRegisteredElement(element); v != nil {
+		if err := ext.Decode(v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return ext, nil
+}
+
+// Retrieve the element with the name from private storage, or nil if nothing
+// is stored.
+func (x *XMPP) privateGet(ctx context.Context, element xml.Name) (*Extension, error) {
+
+	query, err := xml.Marshal(&Extension{XMLName: element})
+	if err != nil {
+		return nil, err
+	}
+	req := &IQ{ID: x.newID(), Type: IQTypeGet}
+	req.PayloadEncode(&privateQuery{Payload: query})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &privateQuery{}
+	if err := resp.PayloadDecode(result); err != nil {
+		return nil, err
+	}
+	ext := &Extension{}
+	if err := xml.Unmarshal(result.Payload, ext); err != nil {
+		return nil, err
+	}
+	if ext.empty() {
+		return nil, nil
+	}
+	return ext, nil
+}
+
+// Store the element in the user's private storage, replacing whatever was
+// stored under its name. v is encoded with xml.Marshal and must be in a
+// namespace of its own.
+func (x *XMPP) PrivateSet(ctx context.Context, v interface{}) error {
+
+	payload, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req := &IQ{ID: x.newID(), Type: IQTypeSet}
+	req.PayloadEncode(&privateQuery{Payload: payload})
+
+	_, err = x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Return true if the element has no attributes and no content other than
+// whitespace.
+func (ext *Extension) empty() bool {
+	if len(ext.Attr) > 0 {
+		return false
+	}
+	for _, tok := range ext.Tokens {
+		data, ok := tok.(xml.CharData)
+		if !ok || len(bytes.TrimSpace(data)) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+)
+
+const (
+	NSPubSub      = "http://jabber.org/protocol/pubsub"
+	NSPubSubEvent = "http://jabber.org/protocol/pubsub#event"
+)
+
+// XEP-0060: Publish-Subscribe
+
+// Event notification sent by a pubsub service in a <message/>.
+type PubSubEvent struct {
+	XMLName xml.Name          `xml:"http://jabber.org/protocol/pubsub#event event"`
+	Items   *PubSubEventItems `xml:"items"`
+
+	// The service that sent the notification. Set when delivered by
+	// PubSubEvents.
+	From string `xml:"-"`
+}
+
+// Items published to, or retracted from, a node.
+type PubSubEventItems struct {
+	Node    string              `xml:"node,attr"`
+	Items   []PubSubEventItem   `xml:"item"`
+	Retract []PubSubEventItemID `xml:"retract"`
+}
+
+type PubSubEventItem struct {
+	ID        string `xml:"id,attr,omitempty"`
+	Publisher string `xml:"publisher,attr,omitempty"`
+	Payload   string `xml:",innerxml"`
+}
+
+// Decode the item's payload into the given value. See xml.Unmarshal for how
+// the value is decoded.
+func (item *PubSubEventItem) PayloadDecode(v interface{}) error {
+	return xml.Unmarshal([]byte(item.Payload), v)
+}
+
+type PubSubEventItemID struct {
+	ID string `xml:"id,attr"`
+}
+
+type pubsubRequest struct {
+	XMLName   xml.Name         `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Publish   *pubsubPublish   `xml:"publish"`
+	Subscribe *pubsubSubscribe `xml:"subscribe"`
+	Items     *pubsubItems     `xml:"items"`
+}
+
+type pubsubPublish struct {
+	Node  string       `xml:"node,attr"`
+	Items []pubsubItem `xml:"item"`
+}
+
+type pubsubItem struct {
+	ID      string `xml:"id,attr,omitempty"`
+	Payload string `xml:",innerxml"`
+}
+
+type pubsubItems struct {
+	Node  string       `xml:"node,attr"`
+	Items []pubsubItem `xml:"item"`
+}
+
+type pubsubSubscribe struct {
+	Node string `xml:"node,attr"`
+	JID  string `xml:"jid,attr"`
+}
+
+// Publish an item to the node of the pubsub service, returning the item id
+// assigned by the service. The item is encoded with xml.Marshal. A zero
+// service JID publishes to the user's own account, i.e. PEP.
+func (x *XMPP) PubSubPublish(ctx context.Context, service JID, node string, item interface{}) (string, error) {
+	return x.pubSubPublish(ctx, service, node, "", item)
+}
+
+func (x *XMPP) pubSubPublish(ctx context.Context, service JID, node, id string, item interface{}) (string, error) {
+
+	payload, err := xml.Marshal(item)
+	if err != nil {
+		return "", err
+	}
+
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: service.Full()}
+	req.PayloadEncode(&pubsubRequest{
+		Publish: &pubsubPublish{Node: node, Items: []pubsubItem{{ID: id, Payload: string(payload)}}},
+	})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	// The service may omit the item id if we supplied one.
+	result := &pubsubRequest{}
+	resp.PayloadDecode(result)
+	if result.Publish != nil && len(result.Publish.Items) > 0 && result.Publish.Items[0].ID != "" {
+		return result.Publish.Items[0].ID, nil
+	}
+	return id, nil
+}
+
+// Subscribe our bare JID to the node of the pubsub service.
+func (x *XMPP) PubSubSubscribe(ctx context.Context, service JID, node string) error {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: service.Full()}
+	req.PayloadEncode(&pubsubRequest{
+		Subscribe: &pubsubSubscribe{Node: node, JID: x.JID.Bare()},
+	})
+
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Retrieve the item with the id from the node of the pubsub service, decoding
+// it into v with xml.Unmarshal. A zero service JID means the user's own
+// account.
+func (x *XMPP) pubSubItem(ctx context.Context, service JID, node, id string, v interface{}) error {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: service.Bare()}
+	req.PayloadEncode(&pubsubRequest{
+		Items: &pubsubItems{Node: node, Items: []pubsubItem{{ID: id}}},
+	})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	result := &pubsubRequest{}
+	if err := resp.PayloadDecode(result); err != nil {
+		return err
+	}
+	if result.Items != nil {
+		for _, item := range result.Items.Items {
+			if item.ID == id {
+				return xml.Unmarshal([]byte(item.Payload), v)
+			}
+		}
+	}
+	return &StanzaError{Type: ErrorTypeCancel, Condition: ErrorItemNotFound}
+}
+
+// Deliver pubsub event notifications on the returned channel instead of In.
+// The channel is closed when the filter is removed with RemoveFilter or the
+// stream dies.
+func (x *XMPP) PubSubEvents() (FilterID, <-chan *PubSubEvent) {
+	events := make(chan *PubSubEvent)
+	id, ch := x.AddFilter(PubSubEventMatcher)
+	go func() {
+		defer close(events)
+		for v := range ch {
+			msg := v.(*Message)
+			event := msg.Event
+			event.From = msg.From
+			events <- event
+		}
+	}()
+	return id, events
+}
+
+// Matcher instance to match <message/> stanzas with a pubsub event.
+var PubSubEventMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		msg, ok := v.(*Message)
+		return ok && msg.Event != nil
+	},
+)
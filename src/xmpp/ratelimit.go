@@ -0,0 +1,70 @@
+package xmpp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the rate stanzas are sent, by the sender goroutine
+// and SendRecvContext.
+type rateLimiter struct {
+	rate  float64 // Tokens added per second.
+	burst float64 // Bucket size.
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: perSecond, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Take a token at time now, returning how long to wait before it may be used.
+func (r *rateLimiter) reserve(now time.Time) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// Block until a token is available.
+func (r *rateLimiter) wait() {
+	if d := r.reserve(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Block until a token is available or the context is done, in which case
+// the token is given back and ctx.Err() returned.
+func (r *rateLimiter) waitContext(ctx context.Context) error {
+	d := r.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.lock.Lock()
+		r.tokens++
+		r.lock.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,37 @@
+package xmpp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(2, 3)
+	now := time.Unix(0, 0)
+
+	// The burst is available straight away.
+	for i := 0; i < 3; i++ {
+		if d := r.reserve(now); d != 0 {
+			t.Fatalf("burst token %d: wait %v", i, d)
+		}
+	}
+
+	// Then tokens arrive every half second.
+	if d := r.reserve(now); d != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms", d)
+	}
+	if d := r.reserve(now); d != time.Second {
+		t.Errorf("wait = %v, want 1s", d)
+	}
+
+	// An idle bucket refills only up to the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if d := r.reserve(now); d != 0 {
+			t.Fatalf("refilled token %d: wait %v", i, d)
+		}
+	}
+	if d := r.reserve(now); d == 0 {
+		t.Error("bucket refilled beyond its burst")
+	}
+}
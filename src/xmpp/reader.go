@@ -0,0 +1,57 @@
+package xmpp
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const defaultMaxStanzaSize = 1 << 20
+
+// Returned, and the stream ended, when a stanza is larger than the stream's
+// MaxStanzaSize.
+var ErrStanzaTooLarge = errors.New("xmpp: stanza exceeds maximum size")
+
+// Reads the stream's connection, enforcing the stanza size limit and read
+// timeout.
+//
+// Reading fails once more than max bytes have been read since the last
+// reset. The stream resets it as each stanza starts. The decoder reads ahead,
+// so the count is approximate, but it is bounded.
+//
+// If timeout is set, the connection's read deadline is pushed back before
+// every read so the read fails if nothing arrives for that long. If trace is
+// set, it's passed everything read.
+type streamReader struct {
+	conn    net.Conn
+	n       int64
+	max     int64
+	timeout time.Duration
+	trace   func([]byte)
+}
+
+func (r *streamReader) reset() {
+	r.n = 0
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.max >= 0 {
+		if r.n >= r.max {
+			return 0, ErrStanzaTooLarge
+		}
+		if remaining := r.max - r.n; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	if r.timeout > 0 {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.conn.Read(p)
+	r.n += int64(n)
+	if r.trace != nil && n > 0 {
+		r.trace(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,50 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	NSReceipts = "urn:xmpp:receipts"
+)
+
+// XEP-0184: Message Delivery Receipts
+
+// Attach to an outgoing message, which must have an ID, to request a receipt.
+type ReceiptRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts request"`
+}
+
+// Receipt for the message with the ID.
+type Receipt struct {
+	XMLName xml.Name `xml:"urn:xmpp:receipts received"`
+	ID      string   `xml:"id,attr"`
+}
+
+// Send a receipt for the message if it requests one.
+func (x *XMPP) sendReceipt(msg *Message) {
+	if msg.ReceiptRequest == nil || msg.ID == "" || msg.From == "" {
+		return
+	}
+	if msg.Type == MessageTypeError || msg.Type == MessageTypeGroupchat || msg.Carbon != "" {
+		return
+	}
+	x.write(&Message{ID: x.newID(), To: msg.From, Receipt: &Receipt{ID: msg.ID}})
+}
+
+// Deliver the receipt for the message with the id on the returned channel
+// instead of In. Remove the filter with RemoveFilter once the receipt has
+// arrived or is no longer of interest.
+func (x *XMPP) AwaitReceipt(id string) (FilterID, chan interface{}) {
+	return x.AddFilter(ReceiptMatcher(id))
+}
+
+// Matcher to identify a receipt for the message with the given id.
+func ReceiptMatcher(id string) Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			msg, ok := v.(*Message)
+			return ok && msg.Receipt != nil && msg.Receipt.ID == id
+		},
+	)
+}
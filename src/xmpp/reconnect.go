@@ -0,0 +1,419 @@
+package xmpp
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State of a ReconnectingClient's connection.
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// Config structure used to create a ReconnectingClient.
+type ReconnectConfig struct {
+	// Wait before the first reconnection attempt. The wait doubles after
+	// each failed attempt up to MaxBackoff. Defaults to 1 second.
+	MinBackoff time.Duration
+
+	// Longest wait between reconnection attempts. Defaults to 5 minutes.
+	MaxBackoff time.Duration
+
+	// Called with each new connection before any of its stanzas are passed
+	// on, e.g. to add filters and handlers again; those added to a previous
+	// connection are gone with it. Nothing is received until it returns, so
+	// it mustn't wait for a reply, e.g. with SendRecv.
+	OnConnect func(*XMPP)
+}
+
+// A client connection that reconnects, with exponential backoff and jitter,
+// whenever the connection is lost. If stream management is enabled in the
+// ClientConfig the previous session is resumed when the server allows it.
+//
+// Stanzas from every connection are delivered on In, and stanzas sent on Out
+// go to whichever connection is current. Filters and handlers belong to a
+// single connection, see ReconnectConfig.OnConnect.
+//
+// Reconnection stops, and In is closed, when Close is called, authentication
+// fails, the stream is ended cleanly (e.g. by closing the current XMPP), or
+// the server sends a stream error that retrying won't fix, such as conflict
+// when another client takes over the resource. The error is delivered on In
+// and returned by Err.
+type ReconnectingClient struct {
+	// Channel of incoming stanzas and errors, as XMPP.In.
+	In chan interface{}
+
+	// Channel of outgoing stanzas, as XMPP.Out. Stanzas sent while
+	// disconnected wait for the next connection.
+	Out chan interface{}
+
+	// Channel of connection state changes. It's buffered; if the application
+	// falls behind, changes are dropped rather than stalling the connection.
+	State chan ConnectionState
+
+	addr         string
+	jid          JID
+	password     string
+	streamConfig *StreamConfig
+	config       *ClientConfig
+	reconnect    ReconnectConfig
+
+	// Dials and logs in; connect unless replaced by tests.
+	connectFunc func(prev *XMPP) (*XMPP, error)
+
+	// Host named by the see-other-host stream error that ended the last
+	// attempt, tried next instead of addr.
+	redirect string
+
+	lock       sync.Mutex
+	x          *XMPP
+	reconnects int
+	err        error
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Create a client connected to addr that reconnects whenever the connection
+// is lost. Connecting starts straight away in the background.
+func NewReconnectingClient(addr string, jid JID, password string, streamConfig *StreamConfig, config *ClientConfig, reconnect *ReconnectConfig) *ReconnectingClient {
+	c := newReconnectingClient(addr, jid, password, streamConfig, config, reconnect)
+	go c.run()
+	return c
+}
+
+func newReconnectingClient(addr string, jid JID, password string, streamConfig *StreamConfig, config *ClientConfig, reconnect *ReconnectConfig) *ReconnectingClient {
+
+	if config == nil {
+		config = &ClientConfig{}
+	}
+
+	c := &ReconnectingClient{
+		In:           make(chan interface{}),
+		Out:          make(chan interface{}),
+		State:        make(chan ConnectionState, 8),
+		addr:         addr,
+		jid:          jid,
+		password:     password,
+		streamConfig: streamConfig,
+		config:       config,
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if reconnect != nil {
+		c.reconnect = *reconnect
+	}
+	if c.reconnect.MinBackoff <= 0 {
+		c.reconnect.MinBackoff = time.Second
+	}
+	if c.reconnect.MaxBackoff <= 0 {
+		c.reconnect.MaxBackoff = 5 * time.Minute
+	}
+	c.connectFunc = c.connect
+	return c
+}
+
+// Return the current connection, or nil while disconnected.
+func (c *ReconnectingClient) XMPP() *XMPP {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.x
+}
+
+// Return the current connection's Stats, with the number of times the client
+// has reconnected. The counters start again on each connection; they're zero
+// while disconnected.
+func (c *ReconnectingClient) Stats() Stats {
+	c.lock.Lock()
+	x, reconnects := c.x, c.reconnects
+	c.lock.Unlock()
+	var stats Stats
+	if x != nil {
+		stats = x.Stats()
+	}
+	stats.Reconnects = reconnects
+	return stats
+}
+
+// Return the error that stopped reconnection, or nil if the client is still
+// running or was closed with Close.
+func (c *ReconnectingClient) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close the current connection and stop reconnecting. Waits until In has
+// been closed.
+func (c *ReconnectingClient) Close() {
+	c.closeOnce.Do(func() { close(c.closing) })
+	<-c.done
+}
+
+func (c *ReconnectingClient) setState(state ConnectionState) {
+	select {
+	case c.State <- state:
+	default:
+	}
+}
+
+func (c *ReconnectingClient) run() {
+
+	defer close(c.done)
+	defer close(c.In)
+
+	var prev *XMPP
+	var pending interface{}
+	backoff := c.reconnect.MinBackoff
+
+	for {
+		c.setState(StateConnecting)
+		x, err := c.connectFunc(prev)
+		c.redirect = seeOtherHost(err)
+		if err != nil {
+			c.setState(StateDisconnected)
+			if _, ok := err.(*SASLError); ok || !retryable(err) {
+				c.stop(err)
+				c.deliver(err)
+				return
+			}
+			if !c.deliver(err) || !c.wait(backoff) {
+				return
+			}
+			backoff = c.nextBackoff(backoff)
+			continue
+		}
+
+		backoff = c.reconnect.MinBackoff
+		c.lock.Lock()
+		c.x = x
+		if prev != nil {
+			c.reconnects++
+		}
+		c.lock.Unlock()
+		c.setState(StateConnected)
+
+		pending, err = c.pump(x, pending)
+		c.redirect = seeOtherHost(err)
+
+		c.lock.Lock()
+		c.x = nil
+		c.lock.Unlock()
+		c.setState(StateDisconnected)
+		prev = x
+
+		select {
+		case <-c.closing:
+			return
+		default:
+		}
+		if !retryable(err) {
+			c.stop(err)
+			return
+		}
+		if !c.wait(backoff) {
+			return
+		}
+	}
+}
+
+// Record the error that stopped reconnection.
+func (c *ReconnectingClient) stop(err error) {
+	c.lock.Lock()
+	c.err = err
+	c.lock.Unlock()
+}
+
+// Return the wait after the attempt that waited d failed.
+func (c *ReconnectingClient) nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > c.reconnect.MaxBackoff {
+		d = c.reconnect.MaxBackoff
+	}
+	return d
+}
+
+// Return true if a connection that ended with the error is worth making
+// again. Clean ends of the stream and stream errors naming a problem with the
+// account or what was sent, e.g. conflict, not-authorized or
+// policy-violation, would only end the same way.
+func retryable(err error) bool {
+	if err == ErrStreamClosed {
+		return false
+	}
+	serr, ok := err.(*StreamError)
+	if !ok {
+		return true
+	}
+	switch serr.Condition {
+	case StreamErrorConnectionTimeout, StreamErrorInternalServerError,
+		StreamErrorRemoteConnectionFailed, StreamErrorReset,
+		StreamErrorResourceConstraint, StreamErrorSeeOtherHost,
+		StreamErrorSystemShutdown, StreamErrorUndefinedCondition:
+		return true
+	}
+	return false
+}
+
+// Return the host a see-other-host stream error names, or "".
+func seeOtherHost(err error) string {
+	if serr, ok := err.(*StreamError); ok && serr.Condition == StreamErrorSeeOtherHost {
+		return serr.SeeOtherHost
+	}
+	return ""
+}
+
+// Return the ClientConfig for a new connection, which calls OnConnect before
+// the connection starts.
+func (c *ReconnectingClient) clientConfig() *ClientConfig {
+	config := *c.config
+	config.onStart = c.reconnect.OnConnect
+	return &config
+}
+
+// Dial and log in, resuming prev's session if possible.
+func (c *ReconnectingClient) connect(prev *XMPP) (*XMPP, error) {
+	var stream *Stream
+	var err error
+	if c.redirect != "" {
+		stream, err = newRedirectedStream(c.redirect, c.jid.Domain, c.streamConfig)
+	} else {
+		stream, err = NewStream(c.addr, c.streamConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := c.clientConfig()
+	var x *XMPP
+	if config.StreamManagement && prev != nil && prev.Resumable() {
+		x, err = ResumeClientXMPP(stream, prev, c.password, config)
+	} else {
+		x, err = NewClientXMPP(stream, c.jid, c.password, config)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// Pass stanzas between the client's channels and the connection until the
+// connection is lost or the client closed. Stanzas are sent at the rate limit's
+// pace. A stanza that couldn't be sent is returned to be sent on the next
+// connection, with the error that ended the connection.
+func (c *ReconnectingClient) pump(x *XMPP, pending interface{}) (interface{}, error) {
+
+	// Closing x.Out stops its sender, which ends the stream.
+	closing := c.closing
+	defer func() {
+		if closing != nil {
+			close(x.Out)
+		}
+	}()
+
+	// Stop waiting on the rate limit when the client is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var last error
+	dropped := false
+	for {
+		if pending != nil && closing != nil && !dropped {
+			if err := x.writeContext(ctx, pending); err == nil {
+				pending = nil
+			} else if ctx.Err() == nil {
+				// The receiver will notice the connection has gone. The
+				// connection is dropped, not ended, whatever it reports.
+				x.Close()
+				x.stream.Close()
+				last, dropped = err, true
+			}
+		}
+
+		// Nothing more is sent once the stream is ending.
+		out := c.Out
+		if pending != nil || closing == nil {
+			out = nil
+		}
+
+		select {
+		case v, ok := <-x.In:
+			if !ok {
+				return pending, last
+			}
+			if err, ok := v.(error); ok && !dropped {
+				last = err
+			}
+			select {
+			case c.In <- v:
+			case <-c.closing:
+			}
+		case v := <-out:
+			pending = v
+		case <-closing:
+			// Keep reading In until the server has ended its stream, or
+			// give up waiting and drop the connection.
+			closing = nil
+			close(x.Out)
+			go func() {
+				timer := time.NewTimer(10 * time.Second)
+				defer timer.Stop()
+				select {
+				case <-x.done:
+				case <-timer.C:
+				}
+				x.stream.Close()
+			}()
+		}
+	}
+}
+
+// Deliver v on In. Returns false if the client was closed instead.
+func (c *ReconnectingClient) deliver(v interface{}) bool {
+	select {
+	case c.In <- v:
+		return true
+	case <-c.closing:
+		return false
+	}
+}
+
+// Wait for around d, with jitter. Returns false if the client was closed
+// instead.
+func (c *ReconnectingClient) wait(d time.Duration) bool {
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closing:
+		return false
+	}
+}
@@ -0,0 +1,130 @@
+package xmpp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// Return a started connection that receives the script, after the stream
+// header, and discards whatever is sent to it.
+func newTestConnection(t *testing.T, script string, config *ClientConfig) *XMPP {
+	x, server := newTestXMPP()
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		io.WriteString(server, `<stream:stream xmlns:stream="http://etherx.jabber.org/streams">`+script)
+		io.Copy(io.Discard, server)
+	}()
+	if _, err := x.stream.dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	configureClient(x, config)
+	x.start()
+	return x
+}
+
+// Run a client whose connections come from connect, and return what it
+// delivered on In before closing it.
+func runTestReconnectingClient(c *ReconnectingClient, connect func(n int) (*XMPP, error)) []interface{} {
+	n := 0
+	c.connectFunc = func(prev *XMPP) (*XMPP, error) {
+		n++
+		return connect(n)
+	}
+	go c.run()
+	var received []interface{}
+	for v := range c.In {
+		received = append(received, v)
+	}
+	return received
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	c := newReconnectingClient("", JID{}, "", nil, nil, &ReconnectConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	d := c.reconnect.MinBackoff
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d = c.nextBackoff(d); d != want {
+			t.Errorf("backoff = %v, want %v", d, want)
+		}
+	}
+}
+
+func TestReconnectStops(t *testing.T) {
+	tests := []struct {
+		script string
+		err    func(error) bool
+	}{
+		{
+			`<stream:error><conflict xmlns="urn:ietf:params:xml:ns:xmpp-streams"/></stream:error>`,
+			func(err error) bool {
+				serr, ok := err.(*StreamError)
+				return ok && serr.Condition == StreamErrorConflict
+			},
+		},
+		{
+			`</stream:stream>`,
+			func(err error) bool { return err == ErrStreamClosed },
+		},
+	}
+	for _, test := range tests {
+		c := newReconnectingClient("", JID{}, "", nil, nil, &ReconnectConfig{MinBackoff: time.Millisecond})
+		connects := 0
+		received := runTestReconnectingClient(c, func(n int) (*XMPP, error) {
+			connects = n
+			return newTestConnection(t, test.script, c.clientConfig()), nil
+		})
+		if connects != 1 {
+			t.Errorf("%s: connected %d times, want once", test.script, connects)
+		}
+		if len(received) != 1 || !test.err(received[0].(error)) {
+			t.Errorf("%s: received %v", test.script, received)
+		}
+		if !test.err(c.Err()) {
+			t.Errorf("%s: Err() = %v", test.script, c.Err())
+		}
+	}
+}
+
+func TestReconnectRetries(t *testing.T) {
+	connected := 0
+	handled := make(chan string, 1)
+	c := newReconnectingClient("", JID{}, "", nil, nil, &ReconnectConfig{
+		MinBackoff: time.Millisecond,
+		OnConnect: func(x *XMPP) {
+			connected++
+			x.HandleMessage(func(msg *Message) { handled <- msg.ID })
+		},
+	})
+
+	// The server sends a message and redirects us elsewhere, then the other
+	// host rejects the password.
+	redirect := ""
+	received := runTestReconnectingClient(c, func(n int) (*XMPP, error) {
+		if n == 1 {
+			return newTestConnection(t, `<message id="m1"/><stream:error><see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams">other.example.com</see-other-host></stream:error>`, c.clientConfig()), nil
+		}
+		redirect = c.redirect
+		return nil, &SASLError{Condition: "not-authorized"}
+	})
+	if len(received) != 2 {
+		t.Fatalf("received %v", received)
+	}
+	if serr, ok := received[0].(*StreamError); !ok || serr.Condition != StreamErrorSeeOtherHost {
+		t.Errorf("received %v, want see-other-host", received[0])
+	}
+	if redirect != "other.example.com" {
+		t.Errorf("reconnected to %q, want other.example.com", redirect)
+	}
+	if id := <-handled; id != "m1" {
+		t.Errorf("OnConnect handler received %s, want m1", id)
+	}
+	if _, ok := received[1].(*SASLError); !ok {
+		t.Errorf("received %v, want *SASLError", received[1])
+	}
+	if _, ok := c.Err().(*SASLError); !ok {
+		t.Errorf("Err() = %v, want *SASLError", c.Err())
+	}
+	if connected != 1 {
+		t.Errorf("OnConnect called %d times, want once", connected)
+	}
+}
@@ -1,7 +1,12 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 )
 
 const (
@@ -16,8 +21,8 @@ type RegisterQuery struct {
 	Username     string              `xml:"username"`
 	Password     string              `xml:"password"`
 	XForm        AdHocXForm          `xml:"x"`
-	Registered   *RegisterRegistered `xmp:"registered"`
-	Remove       *RegisterRemove     `xmp:"remove"`
+	Registered   *RegisterRegistered `xml:"registered"`
+	Remove       *RegisterRemove     `xml:"remove"`
 }
 
 type RegisterRegistered struct {
@@ -27,3 +32,182 @@ type RegisterRegistered struct {
 type RegisterRemove struct {
 	XMLName xml.Name `xml:"remove"`
 }
+
+// The registration fields a server asks for.
+type registerFields struct {
+	XMLName      xml.Name            `xml:"jabber:iq:register query"`
+	Instructions string              `xml:"instructions"`
+	Registered   *RegisterRegistered `xml:"registered"`
+	Key          string              `xml:"key"`
+	Form         *Form               `xml:"jabber:x:data x"`
+	Fields       []Extension         `xml:",any"`
+}
+
+// A registration request.
+type registerSubmit struct {
+	XMLName xml.Name        `xml:"jabber:iq:register query"`
+	Fields  []registerField `xml:",any"`
+	Form    *Form
+	Remove  *RegisterRemove
+}
+
+type registerField struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// Register a new account with the server over the stream, which must not have
+// been used yet. The fields are the registration fields the server asks for,
+// usually at least username and password, or the vars of its form if it uses
+// a data form. The server's error, e.g. conflict if the username is taken, is
+// returned as a *StanzaError. The stream is ended afterwards; log in to the
+// new account over a new stream.
+//
+// Only the TLS options of the config are used.
+func Register(stream *Stream, server string, fields map[string]string, config *ClientConfig) error {
+
+	if config == nil {
+		config = &ClientConfig{}
+	}
+	defer stream.Close()
+
+	for {
+		if err := startClient(stream, JID{Domain: server}); err != nil {
+			return err
+		}
+
+		f := new(features)
+		if err := stream.Decode(f, nil); err != nil {
+			return err
+		}
+
+		if f.StartTLS != nil && f.StartTLS.Required != nil && config.NoTLS {
+			return errors.New("server requires TLS but NoTLS is set")
+		}
+		if f.StartTLS != nil && !config.NoTLS && !stream.isTLS() {
+			stream.logger().Info("Start TLS")
+			if err := startTLS(stream, server, config); err != nil {
+				return err
+			}
+			continue // Restart
+		}
+		break
+	}
+
+	// Ask for the fields the server needs.
+	newID := config.idGenerator()
+	req := &IQ{ID: newID(), Type: IQTypeGet, To: server}
+	req.PayloadEncode(&registerSubmit{})
+	resp, err := registerIQ(stream, req)
+	if err != nil {
+		return err
+	}
+	query := &registerFields{}
+	if err := resp.PayloadDecode(query); err != nil {
+		return err
+	}
+
+	submit, err := fillRegistration(query, fields)
+	if err != nil {
+		return err
+	}
+	req = &IQ{ID: newID(), Type: IQTypeSet, To: server}
+	if err := req.PayloadEncode(submit); err != nil {
+		return err
+	}
+	if _, err := registerIQ(stream, req); err != nil {
+		return err
+	}
+
+	return stream.SendEnd(&xml.EndElement{xml.Name{"stream", "stream"}})
+}
+
+// Send a registration IQ on the stream before there's an XMPP to do it, and
+// wait for the reply.
+func registerIQ(stream *Stream, req *IQ) (*IQ, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp := &IQ{}
+	if err := stream.Decode(resp, nil); err != nil {
+		return nil, err
+	}
+	if resp.ID != req.ID {
+		return nil, fmt.Errorf("unexpected registration response: %s %s", resp.Type, resp.ID)
+	}
+	if err := resp.StanzaError(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Build the registration request for the server's query from the given
+// fields, checking that every field the server needs has a value.
+func fillRegistration(query *registerFields, fields map[string]string) (*registerSubmit, error) {
+
+	var missing []string
+
+	if query.Form != nil {
+		form := NewSubmitForm(query.Form)
+		for name, value := range fields {
+			form.Set(name, value)
+		}
+		for _, field := range query.Form.Fields {
+			if field.Required != nil && form.Value(field.Var) == "" {
+				missing = append(missing, field.Var)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("registration requires %s", strings.Join(missing, ", "))
+		}
+		return &registerSubmit{Form: form}, nil
+	}
+
+	// Legacy registration: the server lists the fields it needs as empty
+	// elements, all of which are required.
+	for _, field := range query.Fields {
+		if field.XMLName.Space != NSRegister {
+			continue
+		}
+		if _, ok := fields[field.XMLName.Local]; !ok {
+			missing = append(missing, field.XMLName.Local)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("registration requires %s", strings.Join(missing, ", "))
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	submit := &registerSubmit{}
+	for _, name := range names {
+		submit.Fields = append(submit.Fields, registerField{xml.Name{NSRegister, name}, fields[name]})
+	}
+	if query.Key != "" {
+		submit.Fields = append(submit.Fields, registerField{xml.Name{NSRegister, "key"}, query.Key})
+	}
+	return submit, nil
+}
+
+// Change the account's password.
+func (x *XMPP) ChangePassword(ctx context.Context, password string) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: x.JID.Domain}
+	req.PayloadEncode(&registerSubmit{Fields: []registerField{
+		{xml.Name{NSRegister, "username"}, x.JID.Node},
+		{xml.Name{NSRegister, "password"}, password},
+	}})
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
+
+// Delete the account from the server. The server closes the stream once it's
+// done.
+func (x *XMPP) CancelRegistration(ctx context.Context) error {
+	req := &IQ{ID: x.newID(), Type: IQTypeSet, To: x.JID.Domain}
+	req.PayloadEncode(&registerSubmit{Remove: &RegisterRemove{}})
+	_, err := x.SendRecvContext(ctx, req)
+	return err
+}
@@ -0,0 +1,66 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestFillLegacyRegistration(t *testing.T) {
+	query := &registerFields{}
+	raw := `<query xmlns="jabber:iq:register"><instructions>Choose a name</instructions>` +
+		`<username/><password/><email/></query>`
+	if err := xml.Unmarshal([]byte(raw), query); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fillRegistration(query, map[string]string{"username": "alice", "password": "secret"}); err == nil || !strings.Contains(err.Error(), "email") {
+		t.Errorf("expected missing email error, got %v", err)
+	}
+
+	submit, err := fillRegistration(query, map[string]string{"username": "alice", "password": "secret", "email": "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(submit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &registerFields{}
+	if err := xml.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, field := range decoded.Fields {
+		if field.XMLName.Space == NSRegister && len(field.Tokens) == 1 {
+			values[field.XMLName.Local] = string(field.Tokens[0].(xml.CharData))
+		}
+	}
+	if len(values) != 3 || values["username"] != "alice" || values["email"] != "a@example.com" {
+		t.Errorf("unexpected request %s", data)
+	}
+}
+
+func TestFillFormRegistration(t *testing.T) {
+	query := &registerFields{}
+	raw := `<query xmlns="jabber:iq:register"><x xmlns="jabber:x:data" type="form">` +
+		`<field type="hidden" var="FORM_TYPE"><value>jabber:iq:register</value></field>` +
+		`<field type="text-single" var="username"><required/></field>` +
+		`<field type="text-private" var="password"><required/></field>` +
+		`</x></query>`
+	if err := xml.Unmarshal([]byte(raw), query); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fillRegistration(query, map[string]string{"username": "alice"}); err == nil {
+		t.Error("expected missing password error")
+	}
+
+	submit, err := fillRegistration(query, map[string]string{"username": "alice", "password": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submit.Form == nil || submit.Form.Type != FormTypeSubmit || submit.Form.Value("password") != "secret" || submit.Form.Value("FORM_TYPE") != NSRegister {
+		t.Errorf("unexpected form %+v", submit.Form)
+	}
+}
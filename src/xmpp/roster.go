@@ -1,12 +1,14 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 )
 
 const (
 	NSRoster = "jabber:iq:roster"
 
+	RosterSubscriptionNone   = "none"
 	RosterSubscriptionBoth   = "both"
 	RosterSubscriptionFrom   = "from"
 	RosterSubscriptionTo     = "to"
@@ -24,3 +26,56 @@ type RosterItem struct {
 	Subscription string   `xml:"subscription,attr"`
 	Groupes      []string `xml:"group"`
 }
+
+// Retrieve the user's roster from the server.
+func (x *XMPP) GetRoster(ctx context.Context) ([]RosterItem, error) {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet}
+	req.PayloadEncode(&RosterQuery{})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &RosterQuery{}
+	if err := resp.PayloadDecode(query); err != nil {
+		return nil, err
+	}
+
+	return query.Items, nil
+}
+
+// Call fn, in a dedicated goroutine, for each item in a roster push from the
+// server. The push is acknowledged automatically. Pushes that don't come from
+// the user's own account are ignored by the handler and delivered to In as
+// usual.
+func (x *XMPP) HandleRosterPush(fn func(item RosterItem)) FilterID {
+	return x.addResponder(x.rosterPushMatcher(), func(v interface{}) {
+		iq := v.(*IQ)
+		x.write(iq.Reply(nil))
+		query := &RosterQuery{}
+		if err := iq.PayloadDecode(query); err != nil {
+			return
+		}
+		for _, item := range query.Items {
+			fn(item)
+		}
+	})
+}
+
+// Matcher for <iq type="set"/> roster pushes from the user's account.
+func (x *XMPP) rosterPushMatcher() Matcher {
+	return MatcherFunc(
+		func(v interface{}) bool {
+			iq, ok := v.(*IQ)
+			if !ok || iq.Type != IQTypeSet {
+				return false
+			}
+			if iq.From != "" && iq.From != x.JID.Bare() {
+				return false
+			}
+			return iq.PayloadName() == xml.Name{NSRoster, "query"}
+		},
+	)
+}
@@ -1,7 +1,206 @@
 package xmpp
 
-import "encoding/base64"
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// Returned when none of the server's SASL mechanisms are supported.
+var ErrNoSASLMechanism = errors.New("no supported SASL mechanism found")
+
+// Returned when a client certificate is configured with no password to fall
+// back on, but the server doesn't offer SASL EXTERNAL. A certificate the server
+// rejects is reported as a *SASLError with the EXTERNAL mechanism instead.
+var ErrNoSASLExternal = errors.New("client certificate configured but server does not offer SASL EXTERNAL")
+
+// SASL authentication failure reported by the server, e.g. not-authorized for
+// bad credentials.
+type SASLError struct {
+	Mechanism string
+	// Defined condition, e.g. "not-authorized".
+	Condition string
+	// Optional descriptive text.
+	Text string
+}
+
+func (e *SASLError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("Authentication (%s) failed: %s", e.Mechanism, e.Condition)
+	}
+	return fmt.Sprintf("Authentication (%s) failed: %s, %s", e.Mechanism, e.Condition, e.Text)
+}
+
+// Authenticate using the first of our mechanisms that the server offers. Only
+// one mechanism is tried; a failure is returned as is rather than falling
+// through to a weaker mechanism. If the TLS config has a client certificate
+// and the server offers EXTERNAL, the certificate is used in preference to the
+// password.
+func authenticate(stream *Stream, mechanisms []string, user, password string, config *ClientConfig) error {
+	handler, err := selectAuthHandler(mechanisms, password, config)
+	if err != nil {
+		return err
+	}
+	if err := handler.Fn(stream, user, password); err != nil {
+		return err
+	}
+	stream.logger().Info(fmt.Sprintf("Authentication (%s) successful", handler.Mechanism))
+	return nil
+}
+
+// Return the handler for the mechanism to authenticate with, given the
+// mechanisms the server offers.
+func selectAuthHandler(mechanisms []string, password string, config *ClientConfig) (authHandler, error) {
+	var handlers []authHandler
+	switch {
+	case config.Anonymous:
+		handlers = []authHandler{anonymousAuthHandler}
+	case len(config.SASLMechanisms) > 0:
+		for _, mechanism := range config.SASLMechanisms {
+			if handler, ok := findAuthHandler(mechanism); ok {
+				handlers = append(handlers, handler)
+			}
+		}
+	case hasClientCertificate(config):
+		if !stringSliceContains(mechanisms, "EXTERNAL") && password == "" {
+			return authHandler{}, ErrNoSASLExternal
+		}
+		handlers = append([]authHandler{externalAuthHandler}, authHandlers...)
+	default:
+		handlers = authHandlers
+	}
+	for _, handler := range handlers {
+		if stringSliceContains(mechanisms, handler.Mechanism) {
+			return handler, nil
+		}
+	}
+	return authHandler{}, ErrNoSASLMechanism
+}
+
+// Return the handler for the mechanism, if it's one we support.
+func findAuthHandler(mechanism string) (authHandler, bool) {
+	for _, handler := range append(authHandlers, externalAuthHandler, anonymousAuthHandler) {
+		if handler.Mechanism == mechanism {
+			return handler, true
+		}
+	}
+	return authHandler{}, false
+}
+
+func hasClientCertificate(config *ClientConfig) bool {
+	tlsConfig := config.TLSConfig
+	return tlsConfig != nil && (len(tlsConfig.Certificates) > 0 || tlsConfig.GetClientCertificate != nil)
+}
+
+type authHandler struct {
+	Mechanism string
+	Fn        func(*Stream, string, string) error
+}
+
+// Supported mechanisms, in order of preference.
+var authHandlers = []authHandler{
+	{"SCRAM-SHA-1", authenticateSCRAMSHA1},
+	{"PLAIN", authenticatePlain},
+}
+
+// Mechanisms used only when configured.
+var (
+	externalAuthHandler  = authHandler{"EXTERNAL", authenticateExternal}
+	anonymousAuthHandler = authHandler{"ANONYMOUS", authenticateAnonymous}
+)
+
+func authenticatePlain(stream *Stream, user, password string) error {
+	auth := saslAuth{Mechanism: "PLAIN", Text: saslEncodePlain(user, password)}
+	if err := stream.Send(&auth); err != nil {
+		return err
+	}
+	return authenticateResponse(stream, "PLAIN")
+}
+
+// Authenticate with the client certificate presented during the TLS
+// handshake. No authorization identity is sent, so the server derives the
+// account from the certificate.
+func authenticateExternal(stream *Stream, user, password string) error {
+	auth := saslAuth{Mechanism: "EXTERNAL", Text: "="}
+	if err := stream.Send(&auth); err != nil {
+		return err
+	}
+	return authenticateResponse(stream, "EXTERNAL")
+}
+
+// Log in without credentials. The server assigns a temporary account.
+func authenticateAnonymous(stream *Stream, user, password string) error {
+	auth := saslAuth{Mechanism: "ANONYMOUS", Text: "="}
+	if err := stream.Send(&auth); err != nil {
+		return err
+	}
+	return authenticateResponse(stream, "ANONYMOUS")
+}
+
+func authenticateResponse(stream *Stream, mechanism string) error {
+	name, _, err := saslNext(stream, mechanism)
+	if err != nil {
+		return err
+	}
+	if name != "success" {
+		return fmt.Errorf("Unexpected: %s", name)
+	}
+	return nil
+}
+
+// Read the server's next SASL element, returning its name ("challenge" or
+// "success") and decoded data. A <failure/> is returned as a *SASLError.
+func saslNext(stream *Stream, mechanism string) (string, []byte, error) {
+	se, err := stream.Next()
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch se.Name {
+	case xml.Name{nsSASL, "challenge"}, xml.Name{nsSASL, "success"}:
+		var v struct {
+			Text string `xml:",chardata"`
+		}
+		if err := stream.Decode(&v, se); err != nil {
+			return "", nil, err
+		}
+		data, err := base64.StdEncoding.DecodeString(v.Text)
+		if err != nil {
+			return "", nil, err
+		}
+		return se.Name.Local, data, nil
+	case xml.Name{nsSASL, "failure"}:
+		f := new(saslFailure)
+		if err := stream.Decode(f, se); err != nil {
+			return "", nil, err
+		}
+		return "", nil, &SASLError{Mechanism: mechanism, Condition: f.Condition.XMLName.Local, Text: f.Text}
+	default:
+		stream.Skip()
+		return "", nil, fmt.Errorf("Unexpected: %s", se.Name)
+	}
+}
 
 func saslEncodePlain(user, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
 }
+
+type saslAuth struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl auth"`
+	Mechanism string   `xml:"mechanism,attr"`
+	Text      string   `xml:",chardata"`
+}
+
+type saslResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Text    string   `xml:",chardata"`
+}
+
+type saslFailure struct {
+	XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
+	Condition struct {
+		XMLName xml.Name
+	} `xml:",any"`
+	Text string `xml:"text"`
+}
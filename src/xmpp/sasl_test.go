@@ -0,0 +1,34 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestSelectAuthHandler(t *testing.T) {
+	withCert := &tls.Config{Certificates: []tls.Certificate{{}}}
+	tests := []struct {
+		offered   []string
+		password  string
+		config    *ClientConfig
+		mechanism string
+		err       error
+	}{
+		{[]string{"PLAIN", "SCRAM-SHA-1"}, "pw", &ClientConfig{}, "SCRAM-SHA-1", nil},
+		{[]string{"PLAIN"}, "pw", &ClientConfig{}, "PLAIN", nil},
+		{[]string{"DIGEST-MD5"}, "pw", &ClientConfig{}, "", ErrNoSASLMechanism},
+		{[]string{"PLAIN"}, "pw", &ClientConfig{SASLMechanisms: []string{"SCRAM-SHA-1"}}, "", ErrNoSASLMechanism},
+		{[]string{"PLAIN", "SCRAM-SHA-1"}, "pw", &ClientConfig{SASLMechanisms: []string{"X-UNKNOWN", "PLAIN"}}, "PLAIN", nil},
+		{[]string{"PLAIN", "EXTERNAL"}, "", &ClientConfig{TLSConfig: withCert}, "EXTERNAL", nil},
+		{[]string{"PLAIN"}, "pw", &ClientConfig{TLSConfig: withCert}, "PLAIN", nil},
+		{[]string{"PLAIN"}, "", &ClientConfig{TLSConfig: withCert}, "", ErrNoSASLExternal},
+		{[]string{"PLAIN", "ANONYMOUS"}, "", &ClientConfig{Anonymous: true}, "ANONYMOUS", nil},
+		{[]string{"PLAIN"}, "", &ClientConfig{Anonymous: true}, "", ErrNoSASLMechanism},
+	}
+	for i, test := range tests {
+		handler, err := selectAuthHandler(test.offered, test.password, test.config)
+		if err != test.err || handler.Mechanism != test.mechanism {
+			t.Errorf("%d: expected %q, %v; got %q, %v", i, test.mechanism, test.err, handler.Mechanism, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Returned when the server's final SCRAM message does not prove knowledge of
+// the password. Unlike a *SASLError this means the server itself could not be
+// trusted, e.g. a man-in-the-middle, rather than the credentials being wrong.
+var ErrSCRAMServerSignature = errors.New("SCRAM server signature verification failed")
+
+func authenticateSCRAMSHA1(stream *Stream, user, password string) error {
+
+	const mechanism = "SCRAM-SHA-1"
+
+	nonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	c := &scramClient{hash: sha1.New, user: user, password: password, nonce: nonce}
+
+	auth := saslAuth{Mechanism: mechanism, Text: base64.StdEncoding.EncodeToString([]byte(c.clientFirst()))}
+	if err := stream.Send(&auth); err != nil {
+		return err
+	}
+
+	name, serverFirst, err := saslNext(stream, mechanism)
+	if err != nil {
+		return err
+	}
+	if name != "challenge" {
+		return fmt.Errorf("Unexpected: %s", name)
+	}
+
+	clientFinal, err := c.clientFinal(string(serverFirst))
+	if err != nil {
+		return err
+	}
+	resp := saslResponse{Text: base64.StdEncoding.EncodeToString([]byte(clientFinal))}
+	if err := stream.Send(&resp); err != nil {
+		return err
+	}
+
+	// The server-final-message normally arrives as the <success/> payload but
+	// may also be sent as a final challenge.
+	name, serverFinal, err := saslNext(stream, mechanism)
+	if err != nil {
+		return err
+	}
+	if name == "challenge" {
+		if err := stream.Send(&saslResponse{}); err != nil {
+			return err
+		}
+		if name, _, err = saslNext(stream, mechanism); err != nil {
+			return err
+		}
+	}
+	if name != "success" {
+		return fmt.Errorf("Unexpected: %s", name)
+	}
+
+	return c.verifyServerFinal(string(serverFinal))
+}
+
+// Client side of a SCRAM exchange (RFC 5802), without channel binding.
+type scramClient struct {
+	hash     func() hash.Hash
+	user     string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+const scramGS2Header = "n,,"
+
+func (c *scramClient) clientFirst() string {
+	c.clientFirstBare = "n=" + scramEscape(c.user) + ",r=" + c.nonce
+	return scramGS2Header + c.clientFirstBare
+}
+
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+
+	attrs := scramParse(serverFirst)
+	if e, ok := attrs["e"]; ok {
+		return "", fmt.Errorf("SCRAM server error: %s", e)
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", errors.New("SCRAM server nonce is invalid")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return "", errors.New("SCRAM server salt is invalid")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return "", errors.New("SCRAM iteration count is invalid")
+	}
+
+	c.saltedPassword = scramHi(c.hash, []byte(c.password), salt, iterations)
+	clientKey := scramHMAC(c.hash, c.saltedPassword, []byte("Client Key"))
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	proof := scramHMAC(c.hash, storedKey, []byte(c.authMessage))
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+
+	attrs := scramParse(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM server error: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return ErrSCRAMServerSignature
+	}
+
+	serverKey := scramHMAC(c.hash, c.saltedPassword, []byte("Server Key"))
+	expected := scramHMAC(c.hash, serverKey, []byte(c.authMessage))
+	if subtle.ConstantTimeCompare(signature, expected) != 1 {
+		return ErrSCRAMServerSignature
+	}
+	return nil
+}
+
+// Parse a SCRAM message's comma-separated "k=v" attributes.
+func scramParse(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		if len(part) > 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+	return attrs
+}
+
+// Escape a username for a SCRAM message.
+func scramEscape(s string) string {
+	s = strings.Replace(s, "=", "=3D", -1)
+	return strings.Replace(s, ",", "=2C", -1)
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// The Hi() function from RFC 5802, i.e. PBKDF2 with HMAC as the PRF and a
+// single block of output.
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	u := scramHMAC(h, password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(h, password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
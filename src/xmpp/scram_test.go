@@ -0,0 +1,35 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+// Example exchange from RFC 5802, section 5.
+func TestSCRAMSHA1(t *testing.T) {
+	c := &scramClient{hash: sha1.New, user: "user", password: "pencil", nonce: "fyko+d2lbbFgONRv9qkxdawL"}
+	if c.clientFirst() != "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL" {
+		t.Fatal(c.clientFirst())
+	}
+	final, err := c.clientFinal("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=" {
+		t.Fatal(final)
+	}
+	if err := c.verifyServerFinal("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyServerFinal("v=AAAApqV8S7suAoZWja4dJRkFsKQ="); err != ErrSCRAMServerSignature {
+		t.Fatal(err)
+	}
+}
+
+func TestSCRAMBadNonce(t *testing.T) {
+	c := &scramClient{hash: sha1.New, user: "user", password: "pencil", nonce: "fyko+d2lbbFgONRv9qkxdawL"}
+	c.clientFirst()
+	if _, err := c.clientFinal("r=somethingelse,s=QSXCR+Q6sek8bf92,i=4096"); err == nil {
+		t.Fail()
+	}
+}
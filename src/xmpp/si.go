@@ -0,0 +1,259 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	NSSI             = "http://jabber.org/protocol/si"
+	NSSIFileTransfer = "http://jabber.org/protocol/si/profile/file-transfer"
+	NSFeatureNeg     = "http://jabber.org/protocol/feature-neg"
+)
+
+// How long to wait for the bytestream once a file offer is accepted.
+const fileTransferTimeout = time.Minute
+
+// XEP-0095: Stream Initiation
+type si struct {
+	XMLName  xml.Name  `xml:"http://jabber.org/protocol/si si"`
+	ID       string    `xml:"id,attr,omitempty"`
+	MIMEType string    `xml:"mime-type,attr,omitempty"`
+	Profile  string    `xml:"profile,attr,omitempty"`
+	File     *siFile   `xml:"http://jabber.org/protocol/si/profile/file-transfer file"`
+	Feature  siFeature `xml:"http://jabber.org/protocol/feature-neg feature"`
+}
+
+// XEP-0096: SI File Transfer
+type siFile struct {
+	Name string `xml:"name,attr"`
+	Size int64  `xml:"size,attr"`
+	Hash string `xml:"hash,attr,omitempty"`
+	Date string `xml:"date,attr,omitempty"`
+	Desc string `xml:"desc,omitempty"`
+}
+
+type siFeature struct {
+	Form Form `xml:"jabber:x:data x"`
+}
+
+// Description of a file sent with SendFile.
+type FileMeta struct {
+	Name string
+	Size int64
+
+	// MD5 of the file's content in hex, optional.
+	Hash string
+
+	// Last modification time, optional.
+	Date time.Time
+
+	Desc     string
+	MIMEType string
+}
+
+// Returned by SendFile when the recipient declines the file.
+var ErrFileDeclined = errors.New("file transfer declined")
+
+// Returned when no stream method is supported by both sides.
+var ErrNoValidStreams = errors.New("no valid stream methods for file transfer")
+
+// Stream methods offered for file transfer, in order of preference.
+var fileTransferMethods = []string{NSBytestreams, NSIBB}
+
+// Offer the file to the entity and, if it's accepted, send it over a
+// bytestream. Blocks until the data is sent or the transfer fails.
+func (x *XMPP) SendFile(ctx context.Context, to JID, r io.Reader, meta FileMeta) error {
+	offer := &si{
+		ID:       UUID4(),
+		MIMEType: meta.MIMEType,
+		Profile:  NSSIFileTransfer,
+		File: &siFile{
+			Name: meta.Name,
+			Size: meta.Size,
+			Hash: meta.Hash,
+			Desc: meta.Desc,
+		},
+	}
+	if !meta.Date.IsZero() {
+		offer.File.Date = meta.Date.UTC().Format(time.RFC3339)
+	}
+	options := make([]FormOption, 0, len(fileTransferMethods))
+	for _, method := range fileTransferMethods {
+		options = append(options, FormOption{Value: method})
+	}
+	offer.Feature.Form = Form{
+		Type:   FormTypeForm,
+		Fields: []FormField{{Var: "stream-method", Type: FormFieldListSingle, Options: options}},
+	}
+
+	req, err := x.newIQSet(to, offer)
+	if err != nil {
+		return err
+	}
+	resp, err := x.SendRecvContext(ctx, req)
+	if serr, ok := err.(*StanzaError); ok {
+		switch serr.Condition {
+		case ErrorForbidden:
+			return ErrFileDeclined
+		case ErrorBadRequest:
+			return ErrNoValidStreams
+		}
+	}
+	if err != nil {
+		return err
+	}
+	accepted := &si{}
+	if err := resp.PayloadDecode(accepted); err != nil {
+		return err
+	}
+
+	var w io.WriteCloser
+	switch method := accepted.Feature.Form.Value("stream-method"); method {
+	case NSBytestreams:
+		w, err = x.sendBytestream(ctx, to, offer.ID)
+	case NSIBB:
+		w, err = x.openIBB(ctx, to, offer.ID, x.bytestreamConfig().IBBBlockSize)
+	default:
+		return fmt.Errorf("Unexpected: stream method %q", method)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// A file another entity offers to send. Accept or decline it.
+type FileOffer struct {
+	From JID
+	SID  string
+	File FileMeta
+
+	// Stream methods the sender supports.
+	Methods []string
+
+	x  *XMPP
+	iq *IQ
+}
+
+// Accept the offer and wait for the sender to open the bytestream. Read the
+// file from it until io.EOF, then close it.
+func (offer *FileOffer) Accept(ctx context.Context) (*Bytestream, error) {
+	method := ""
+	for _, m := range fileTransferMethods {
+		if stringSliceContains(offer.Methods, m) {
+			method = m
+			break
+		}
+	}
+	if method == "" {
+		resp := offer.iq.ReplyError(&StanzaError{Type: ErrorTypeCancel, Condition: ErrorBadRequest})
+		resp.Error.Payload += `<no-valid-streams xmlns="` + NSSI + `"/>`
+		offer.x.write(resp)
+		return nil, ErrNoValidStreams
+	}
+
+	// Expect the stream before the sender can open it.
+	ch, cancel := offer.x.expectBytestream(offer.From, offer.SID)
+	timer := time.AfterFunc(fileTransferTimeout, cancel)
+	defer timer.Stop()
+
+	accepted := &si{}
+	accepted.Feature.Form = Form{Type: FormTypeSubmit, Fields: []FormField{{Var: "stream-method", Values: []string{method}}}}
+	if err := offer.x.write(offer.iq.Reply(accepted)); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	select {
+	case s, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("Unexpected: no bytestream from %s", offer.From)
+		}
+		return s, nil
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+}
+
+// Decline the offer.
+func (offer *FileOffer) Decline() error {
+	return offer.x.write(offer.iq.ReplyError(&StanzaError{Type: ErrorTypeCancel, Condition: ErrorForbidden, Text: "Offer Declined"}))
+}
+
+// Matcher instance to match <iq type="set"/> file transfer offers.
+var FileOfferMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok || iq.Type != IQTypeSet || iq.PayloadName() != (xml.Name{NSSI, "si"}) {
+			return false
+		}
+		offer := &si{}
+		return iq.PayloadDecode(offer) == nil && offer.Profile == NSSIFileTransfer && offer.File != nil
+	},
+)
+
+// Return a channel of incoming file offers, each of which must be accepted
+// or declined. The file transfer features are advertised in disco#info. Pass
+// the FilterID to RemoveFilter to stop receiving offers; the channel is
+// closed then or when the stream dies.
+func (x *XMPP) FileOffers() (FilterID, <-chan *FileOffer) {
+	for _, feature := range []string{NSSI, NSSIFileTransfer, NSBytestreams, NSIBB} {
+		x.AddDiscoFeature(feature)
+	}
+	id, in := x.AddConsumingFilter(FileOfferMatcher)
+	offers := make(chan *FileOffer)
+	go func() {
+		defer close(offers)
+		for v := range in {
+			if offer := x.newFileOffer(v.(*IQ)); offer != nil {
+				offers <- offer
+			}
+		}
+	}()
+	return id, offers
+}
+
+func (x *XMPP) newFileOffer(iq *IQ) *FileOffer {
+	req := &si{}
+	if err := iq.PayloadDecode(req); err != nil || req.ID == "" {
+		x.writeError(iq, ErrorTypeModify, ErrorBadRequest)
+		return nil
+	}
+	from, err := ParseJID(iq.From)
+	if err != nil {
+		x.writeError(iq, ErrorTypeModify, ErrorJIDMalformed)
+		return nil
+	}
+	offer := &FileOffer{
+		From: from,
+		SID:  req.ID,
+		File: FileMeta{
+			Name:     req.File.Name,
+			Size:     req.File.Size,
+			Hash:     req.File.Hash,
+			Desc:     req.File.Desc,
+			MIMEType: req.MIMEType,
+		},
+		x:  x,
+		iq: iq,
+	}
+	if req.File.Date != "" {
+		offer.File.Date, _ = time.Parse(time.RFC3339, req.File.Date)
+	}
+	if field := req.Feature.Form.Field("stream-method"); field != nil {
+		for _, option := range field.Options {
+			offer.Methods = append(offer.Methods, option.Value)
+		}
+	}
+	return offer
+}
@@ -0,0 +1,51 @@
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSendFile(t *testing.T) {
+	alice, bob := newTestXMPPPair()
+	defer alice.stream.Close()
+	alice.bytestreams = &BytestreamConfig{Listen: "127.0.0.1:0", NoProxyDiscovery: true}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	meta := FileMeta{Name: "numbers.txt", Size: int64(len(data)), Desc: "Some numbers"}
+
+	_, offers := bob.FileOffers()
+	received := make(chan []byte)
+	go func() {
+		offer := <-offers
+		if offer.File.Name != meta.Name || offer.File.Size != meta.Size || offer.File.Desc != meta.Desc {
+			t.Errorf("unexpected file %+v", offer.File)
+		}
+		s, err := offer.Accept(context.Background())
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		defer s.Close()
+		got, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- got
+
+		// A second offer is declined.
+		(<-offers).Decline()
+	}()
+
+	if err := alice.SendFile(context.Background(), bob.JID, bytes.NewReader(data), meta); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, expected %d", len(got), len(data))
+	}
+	if err := alice.SendFile(context.Background(), bob.JID, bytes.NewReader(data), meta); err != ErrFileDeclined {
+		t.Errorf("expected ErrFileDeclined, got %v", err)
+	}
+}
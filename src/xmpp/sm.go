@@ -0,0 +1,264 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// XEP-0198: Stream Management
+
+const defaultSMAckInterval = 30 * time.Second
+
+// Stream management state for an XMPP instance.
+type streamManagement struct {
+	lock        sync.Mutex
+	id          string
+	resume      bool
+	ackInterval time.Duration
+
+	// Number of stanzas handled from and sent to the server. Both wrap at
+	// 2^32 as per the XEP.
+	inbound  uint32
+	outbound uint32
+
+	// Stanzas sent but not yet acknowledged by the server, oldest first.
+	unacked []interface{}
+}
+
+// Record an outgoing element. Only stanzas are counted.
+func (sm *streamManagement) sent(v interface{}) {
+	if !isStanza(v) {
+		return
+	}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.outbound++
+	sm.unacked = append(sm.unacked, v)
+}
+
+// Record an incoming stanza as handled.
+func (sm *streamManagement) handled() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.inbound++
+}
+
+// Drop stanzas the server says it has handled.
+func (sm *streamManagement) acked(h uint32) error {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	n := sm.outbound - h
+	if n > uint32(len(sm.unacked)) {
+		return fmt.Errorf("stream management ack for %d stanzas, only %d sent", h, sm.outbound)
+	}
+	sm.unacked = append([]interface{}{}, sm.unacked[len(sm.unacked)-int(n):]...)
+	return nil
+}
+
+// Return the number of unacknowledged stanzas.
+func (sm *streamManagement) pending() int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return len(sm.unacked)
+}
+
+// Return the number of stanzas received from the server and handled, as sent
+// in stream management acknowledgements. Always 0 if stream management is not
+// enabled.
+func (x *XMPP) Handled() uint32 {
+	if x.sm == nil {
+		return 0
+	}
+	x.sm.lock.Lock()
+	defer x.sm.lock.Unlock()
+	return x.sm.inbound
+}
+
+// Return true if stream management is enabled and the server agreed the
+// stream can be resumed.
+func (x *XMPP) Resumable() bool {
+	return x.sm != nil && x.sm.resume && x.sm.id != ""
+}
+
+// Handle a stream management element sent by the server.
+func (x *XMPP) handleStreamManagement(start *xml.StartElement) error {
+	switch start.Name.Local {
+	case "r":
+		if err := x.stream.Skip(); err != nil {
+			return err
+		}
+		if x.sm != nil {
+			x.write(&smAnswer{H: x.Handled()})
+		}
+	case "a":
+		a := smAnswer{}
+		if err := x.stream.Decode(&a, start); err != nil {
+			return err
+		}
+		if x.sm != nil {
+			if err := x.sm.acked(a.H); err != nil {
+				x.logger().Error(err)
+			}
+		}
+	default:
+		x.logger().Error("Unexpected stream management element: ", start.Name.Local)
+		return x.stream.Skip()
+	}
+	return nil
+}
+
+func isStanza(v interface{}) bool {
+	switch v.(type) {
+	case IQ, *IQ, Message, *Message, Presence, *Presence:
+		return true
+	}
+	return false
+}
+
+// Return true if the top-level element is a stanza, whatever type it's
+// decoded into.
+func isStanzaName(name xml.Name) bool {
+	switch name.Local {
+	case "iq", "message", "presence":
+		return true
+	}
+	return false
+}
+
+func enableStreamManagement(stream *Stream) (*streamManagement, error) {
+
+	if err := stream.Send(&smEnable{Resume: true}); err != nil {
+		return nil, err
+	}
+
+	se, err := stream.Next()
+	if err != nil {
+		return nil, err
+	}
+	switch se.Name {
+	case xml.Name{nsStreamManagement, "enabled"}:
+		e := smEnabled{}
+		if err := stream.Decode(&e, se); err != nil {
+			return nil, err
+		}
+		return &streamManagement{id: e.ID, resume: e.Resume, ackInterval: defaultSMAckInterval}, nil
+	case xml.Name{nsStreamManagement, "failed"}:
+		f := smFailure{}
+		if err := stream.Decode(&f, se); err != nil {
+			return nil, err
+		}
+		return nil, &f
+	default:
+		stream.Skip()
+		return nil, fmt.Errorf("Unexpected: %s", se.Name)
+	}
+}
+
+// Resume prev's session on the stream and return the new XMPP instance, ready
+// to be started.
+func resumeStream(stream *Stream, prev *XMPP) (*XMPP, error) {
+
+	prev.sm.lock.Lock()
+	defer prev.sm.lock.Unlock()
+
+	if err := stream.Send(&smResume{PrevID: prev.sm.id, H: prev.sm.inbound}); err != nil {
+		return nil, err
+	}
+
+	se, err := stream.Next()
+	if err != nil {
+		return nil, err
+	}
+	switch se.Name {
+	case xml.Name{nsStreamManagement, "resumed"}:
+	case xml.Name{nsStreamManagement, "failed"}:
+		f := smFailure{}
+		if err := stream.Decode(&f, se); err != nil {
+			return nil, err
+		}
+		return nil, &f
+	default:
+		stream.Skip()
+		return nil, fmt.Errorf("Unexpected: %s", se.Name)
+	}
+
+	r := smResumed{}
+	if err := stream.Decode(&r, se); err != nil {
+		return nil, err
+	}
+
+	sm := &streamManagement{
+		id:          prev.sm.id,
+		resume:      true,
+		ackInterval: prev.sm.ackInterval,
+		inbound:     prev.sm.inbound,
+		outbound:    prev.sm.outbound,
+		unacked:     append([]interface{}{}, prev.sm.unacked...),
+	}
+	sm.acked(r.H)
+
+	// Replay whatever the server didn't receive. Writing re-counts them.
+	unacked := sm.unacked
+	sm.outbound -= uint32(len(unacked))
+	sm.unacked = nil
+
+	x := newXMPP(prev.JID, stream)
+	x.sm = sm
+	for _, v := range unacked {
+		if err := x.write(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return x, nil
+}
+
+type smFeature struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 sm"`
+}
+
+type smEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+	Resume  bool     `xml:"resume,attr,omitempty"`
+}
+
+type smEnabled struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID      string   `xml:"id,attr"`
+	Resume  bool     `xml:"resume,attr"`
+}
+
+type smResume struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// A <failed/> response to enable or resume.
+type smFailure struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	Condition struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (f *smFailure) Error() string {
+	return fmt.Sprintf("Stream management failed: %s", f.Condition.XMLName.Local)
+}
@@ -0,0 +1,129 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestEnableStreamManagement(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := &Stream{conn: client, dec: xml.NewDecoder(client), config: &StreamConfig{}}
+
+	go func() {
+		enable := &smEnable{}
+		if err := xml.NewDecoder(server).Decode(enable); err != nil || !enable.Resume {
+			t.Errorf("unexpected enable %+v, %v", enable, err)
+		}
+		fmt.Fprint(server, `<enabled xmlns="urn:xmpp:sm:3" id="sm-1" resume="true"/>`)
+	}()
+
+	sm, err := enableStreamManagement(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.id != "sm-1" || !sm.resume {
+		t.Errorf("unexpected state %+v", sm)
+	}
+}
+
+func TestStreamManagementAcks(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	x.sm = &streamManagement{id: "sm-1", resume: true}
+	go x.receiver()
+	dec := xml.NewDecoder(server)
+
+	// Three stanzas go out unacknowledged.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 1; i <= 3; i++ {
+			x.write(&Message{ID: fmt.Sprint(i)})
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		if err := dec.Decode(&Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-written
+	if n := x.sm.pending(); n != 3 {
+		t.Errorf("pending = %d, want 3", n)
+	}
+
+	// The server has handled two of them, and asks how many of its own
+	// stanzas were handled.
+	// One of its stanzas fails to decode, but still counts.
+	go fmt.Fprint(server, `<message id="in-1"/><message id="in-2"/>`+
+		`<message id="in-3"><x xmlns="http://jabber.org/protocol/muc#user"><status code="bad"/></x></message>`+
+		`<a xmlns="urn:xmpp:sm:3" h="2"/><r xmlns="urn:xmpp:sm:3"/>`)
+	for i := 0; i < 3; i++ {
+		v := <-x.In
+		if _, ok := v.(*DecodeError); ok != (i == 2) {
+			t.Errorf("received %T", v)
+		}
+	}
+	a := &smAnswer{}
+	if err := dec.Decode(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.H != 3 {
+		t.Errorf("answered h = %d, want 3", a.H)
+	}
+	if n := x.sm.pending(); n != 1 {
+		t.Errorf("pending = %d after the ack, want 1", n)
+	}
+}
+
+func TestResumeStream(t *testing.T) {
+	prev := newXMPP(JID{Node: "alice", Domain: "example.com", Resource: "test"}, nil)
+	prev.sm = &streamManagement{
+		id:       "sm-1",
+		resume:   true,
+		inbound:  5,
+		outbound: 3,
+		unacked:  []interface{}{&Message{ID: "1"}, &Message{ID: "2"}, &Message{ID: "3"}},
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := &Stream{conn: client, dec: xml.NewDecoder(client), config: &StreamConfig{}}
+
+	// The server has handled the first stanza, so the others are sent again.
+	replayed := make(chan string, 2)
+	go func() {
+		dec := xml.NewDecoder(server)
+		resume := &smResume{}
+		if err := dec.Decode(resume); err != nil || resume.PrevID != "sm-1" || resume.H != 5 {
+			t.Errorf("unexpected resume %+v, %v", resume, err)
+		}
+		fmt.Fprint(server, `<resumed xmlns="urn:xmpp:sm:3" previd="sm-1" h="1"/>`)
+		for i := 0; i < 2; i++ {
+			msg := &Message{}
+			if err := dec.Decode(msg); err != nil {
+				t.Error(err)
+				return
+			}
+			replayed <- msg.ID
+		}
+	}()
+
+	x, err := resumeStream(stream, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"2", "3"} {
+		if id := <-replayed; id != want {
+			t.Errorf("replayed %s, want %s", id, want)
+		}
+	}
+	if !x.Resumable() || x.Handled() != 5 {
+		t.Errorf("resumable = %v, handled = %d", x.Resumable(), x.Handled())
+	}
+	if x.sm.outbound != 3 || x.sm.pending() != 2 {
+		t.Errorf("outbound = %d, pending = %d, want 3 and 2", x.sm.outbound, x.sm.pending())
+	}
+}
@@ -1,7 +1,9 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"runtime"
 )
 
 const (
@@ -15,3 +17,60 @@ type SoftwareVersion struct {
 	Version string   `xml:"version,omitempty"`
 	OS      string   `xml:"os,omitempty"`
 }
+
+// Matcher for <iq type="get"/> software version requests.
+var SoftwareVersionMatcher = MatcherFunc(
+	func(v interface{}) bool {
+		iq, ok := v.(*IQ)
+		if !ok || iq.Type != IQTypeGet {
+			return false
+		}
+		return iq.PayloadName() == xml.Name{NSJabberClient, "query"}
+	},
+)
+
+// Return the operating system and architecture the program is running on, for
+// use as SetVersion's os.
+func RuntimeOS() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// Request the name and version of the software the entity is running.
+func (x *XMPP) SoftwareVersion(ctx context.Context, jid JID) (*SoftwareVersion, error) {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: jid.Full()}
+	req.PayloadEncode(&SoftwareVersion{})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	version := &SoftwareVersion{}
+	if err := resp.PayloadDecode(version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// Answer software version requests with the name and version. The OS is only
+// included if os is not empty; pass RuntimeOS() to report the one the program
+// is running on. The first call installs the responder and advertises the
+// feature in disco#info; later calls change the answer.
+func (x *XMPP) SetVersion(name, version, os string) {
+	x.discoLock.Lock()
+	answering := x.softwareVersion != nil
+	x.softwareVersion = &SoftwareVersion{Name: name, Version: version, OS: os}
+	x.discoLock.Unlock()
+
+	if answering {
+		return
+	}
+	x.AddDiscoFeature(NSJabberClient)
+	x.addResponder(SoftwareVersionMatcher, func(v interface{}) {
+		x.discoLock.Lock()
+		version := *x.softwareVersion
+		x.discoLock.Unlock()
+		x.write(v.(*IQ).Reply(&version))
+	})
+}
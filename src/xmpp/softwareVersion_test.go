@@ -0,0 +1,47 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSetVersion(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	x.HandleIQ(func(iq *IQ) {
+		t.Errorf("version request %s passed to HandleIQ", iq.ID)
+	})
+	go x.receiver()
+	dec := xml.NewDecoder(server)
+
+	request := func(id string) *IQ {
+		go fmt.Fprintf(server, `<iq type="get" id="%s" from="bob@example.com/x"><query xmlns="jabber:iq:version"/></iq>`, id)
+		reply := &IQ{}
+		if err := dec.Decode(reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.ID != id || reply.Type != IQTypeResult {
+			t.Fatalf("unexpected reply %+v", reply)
+		}
+		return reply
+	}
+
+	x.SetVersion("bot", "1.0", "")
+	reply := request("1")
+	if strings.Contains(reply.Payload, "os") {
+		t.Errorf("OS included without being passed: %s", reply.Payload)
+	}
+	version := &SoftwareVersion{}
+	if err := reply.PayloadDecode(version); err != nil || version.Name != "bot" || version.Version != "1.0" {
+		t.Errorf("unexpected version %+v, %v", version, err)
+	}
+
+	// A second call changes the answer.
+	x.SetVersion("bot", "2.0", RuntimeOS())
+	version = &SoftwareVersion{}
+	if err := request("2").PayloadDecode(version); err != nil || version.Version != "2.0" || version.OS != RuntimeOS() {
+		t.Errorf("unexpected version %+v, %v", version, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"time"
 )
 
 const (
@@ -12,9 +13,19 @@ const (
 	IQTypeResult = "result"
 	IQTypeError  = "error"
 
-	MessageTypeNormal = "normal"
-	MessageTypeChat   = "chat"
-	MessageTypeError  = "error"
+	MessageTypeNormal    = "normal"
+	MessageTypeChat      = "chat"
+	MessageTypeGroupchat = "groupchat"
+	MessageTypeHeadline  = "headline"
+	MessageTypeError     = "error"
+
+	PresenceTypeUnavailable  = "unavailable"
+	PresenceTypeSubscribe    = "subscribe"
+	PresenceTypeSubscribed   = "subscribed"
+	PresenceTypeUnsubscribe  = "unsubscribe"
+	PresenceTypeUnsubscribed = "unsubscribed"
+	PresenceTypeProbe        = "probe"
+	PresenceTypeError        = "error"
 )
 
 // XMPP <iq/> stanza.
@@ -28,6 +39,36 @@ type IQ struct {
 	Error   *Error   `xml:"error"`
 }
 
+// Create a get IQ with a new UUID4 id, addressed to the JID (no to attribute
+// if it's the zero JID), with the payload encoded as by PayloadEncode.
+func NewIQGet(to JID, payload interface{}) (*IQ, error) {
+	return newIQ(UUID4(), IQTypeGet, to, payload)
+}
+
+// Create a set IQ with a new UUID4 id, addressed to the JID (no to attribute
+// if it's the zero JID), with the payload encoded as by PayloadEncode.
+func NewIQSet(to JID, payload interface{}) (*IQ, error) {
+	return newIQ(UUID4(), IQTypeSet, to, payload)
+}
+
+// Create a set IQ as NewIQSet, with an id from the instance's IDGenerator.
+func (x *XMPP) newIQSet(to JID, payload interface{}) (*IQ, error) {
+	return newIQ(x.newID(), IQTypeSet, to, payload)
+}
+
+func newIQ(id, iqType string, to JID, payload interface{}) (*IQ, error) {
+	iq := &IQ{ID: id, Type: iqType}
+	if to != (JID{}) {
+		iq.To = to.Full()
+	}
+	if payload != nil {
+		if err := iq.PayloadEncode(payload); err != nil {
+			return nil, err
+		}
+	}
+	return iq, nil
+}
+
 // Encode the value to an XML string and set as the payload. See xml.Marshal
 // for how the value is encoded.
 func (iq *IQ) PayloadEncode(v interface{}) error {
@@ -65,6 +106,26 @@ func (iq *IQ) Response(iqType string) *IQ {
 	return &IQ{ID: iq.ID, Type: iqType, From: iq.To, To: iq.From}
 }
 
+// Create the result IQ answering a get or set, with the result encoded as
+// by PayloadEncode. An empty result is sent if it's nil, and an
+// internal-server-error if it can't be encoded.
+func (iq *IQ) Reply(result interface{}) *IQ {
+	resp := iq.Response(IQTypeResult)
+	if result != nil {
+		if err := resp.PayloadEncode(result); err != nil {
+			return iq.ReplyError(&StanzaError{Type: ErrorTypeCancel, Condition: ErrorInternalServerError})
+		}
+	}
+	return resp
+}
+
+// Create the error IQ answering a get or set.
+func (iq *IQ) ReplyError(e *StanzaError) *IQ {
+	resp := iq.Response(IQTypeError)
+	resp.Error = NewErrorWithCode(e.Code, e.Type, e.Condition, e.Text)
+	return resp
+}
+
 // XMPP <message/> stanza.
 type Message struct {
 	XMLName xml.Name      `xml:"message"`
@@ -74,17 +135,55 @@ type Message struct {
 	From    string        `xml:"from,attr,omitempty"`
 	Subject string        `xml:"subject,omitempty"`
 	Body    []MessageBody `xml:"body,omitempty"`
-	Thread  string        `xml:"thread,omitempty"`
+	Thread  *Thread       `xml:"thread"`
 	Error   *Error        `xml:"error"`
 	Lang    string        `xml:"xml:lang,attr,omitempty"`
 
+	OOB []OOB `xml:"jabber:x:oob x"` // XEP-0066
+
 	Confirm *Confirm `xml:"confirm"` // XEP-0070
 
+	HTML *XHTMLIM `xml:"http://jabber.org/protocol/xhtml-im html"` // XEP-0071
+
 	Active    *Active    `xml:"active"`    // XEP-0085
 	Composing *Composing `xml:"composing"` // XEP-0085
 	Paused    *Paused    `xml:"paused"`    // XEP-0085
 	Inactive  *Inactive  `xml:"inactive"`  // XEP-0085
 	Gone      *Gone      `xml:"gone"`      // XEP-0085
+
+	Event *PubSubEvent `xml:"http://jabber.org/protocol/pubsub#event event"` // XEP-0060
+
+	MUCUser *MUCUser `xml:"http://jabber.org/protocol/muc#user x"` // XEP-0045
+
+	Nick string `xml:"http://jabber.org/protocol/nick nick,omitempty"` // XEP-0172
+
+	CarbonSent     *Carbon `xml:"urn:xmpp:carbons:2 sent"`     // XEP-0280
+	CarbonReceived *Carbon `xml:"urn:xmpp:carbons:2 received"` // XEP-0280
+
+	// Set if the message was unwrapped from a carbon copy (XEP-0280).
+	Carbon CarbonDirection `xml:"-"`
+
+	ArchiveResult *MAMResult `xml:"urn:xmpp:mam:2 result"` // XEP-0313
+
+	ReceiptRequest *ReceiptRequest `xml:"urn:xmpp:receipts request"`  // XEP-0184
+	Receipt        *Receipt        `xml:"urn:xmpp:receipts received"` // XEP-0184
+
+	Attention *Attention `xml:"urn:xmpp:attention:0 attention"` // XEP-0224
+
+	Replace *Replace `xml:"urn:xmpp:message-correct:0 replace"` // XEP-0308
+
+	StanzaIDs []StanzaID `xml:"urn:xmpp:sid:0 stanza-id"` // XEP-0359
+	OriginID  *OriginID  `xml:"urn:xmpp:sid:0 origin-id"` // XEP-0359
+
+	DelayInfo   *Delay       `xml:"urn:xmpp:delay delay"` // XEP-0203
+	LegacyDelay *LegacyDelay `xml:"jabber:x:delay x"`     // XEP-0091
+
+	// Time the message was originally sent if its delivery was delayed, e.g.
+	// offline storage or MUC history. Nil for live messages.
+	Delay *time.Time `xml:"-"`
+
+	// Child elements not decoded into any of the fields above.
+	Extensions []Extension `xml:",any"`
 }
 
 type MessageBody struct {
@@ -92,17 +191,68 @@ type MessageBody struct {
 	Value string `xml:",chardata"`
 }
 
+// The conversation a message belongs to. A thread started from another one
+// names it as its parent.
+type Thread struct {
+	ID     string `xml:",chardata"`
+	Parent string `xml:"parent,attr,omitempty"`
+}
+
 // XMPP <presence/> stanza.
 type Presence struct {
-	XMLName xml.Name `xml:"presence"`
-	ID      string   `xml:"id,attr,omitempty"`
-	Type    string   `xml:"type,attr,omitempty"`
-	To      string   `xml:"to,attr,omitempty"`
-	From    string   `xml:"from,attr,omitempty"`
-	Show    string   `xml:"show"`            // away, chat, dnd, xa
-	Status  string   `xml:"status"`          // sb []clientText
-	Photo   string   `xml:"photo,omitempty"` // Avatar
-	Nick    string   `xml:"nick,omitempty"`  // Nickname
+	XMLName  xml.Name     `xml:"presence"`
+	ID       string       `xml:"id,attr,omitempty"`
+	Type     string       `xml:"type,attr,omitempty"`
+	To       string       `xml:"to,attr,omitempty"`
+	From     string       `xml:"from,attr,omitempty"`
+	Show     PresenceShow `xml:"show,omitempty"`
+	Status   string       `xml:"status,omitempty"` // sb []clientText
+	Priority int8         `xml:"priority,omitempty"`
+	Photo    string       `xml:"photo,omitempty"`                                // Avatar
+	Nick     string       `xml:"http://jabber.org/protocol/nick nick,omitempty"` // XEP-0172
+	Error    *Error       `xml:"error"`
+
+	MUC     *MUC     `xml:"http://jabber.org/protocol/muc x"`      // XEP-0045
+	MUCUser *MUCUser `xml:"http://jabber.org/protocol/muc#user x"` // XEP-0045
+
+	Caps *EntityCaps `xml:"http://jabber.org/protocol/caps c"` // XEP-0115
+
+	IdleInfo *Idle `xml:"urn:xmpp:idle:1 idle"` // XEP-0319
+
+	// Time the user went idle, if their client says. Nil if they're active
+	// or it's not known.
+	IdleSince *time.Time `xml:"-"`
+
+	// Child elements not decoded into any of the fields above.
+	Extensions []Extension `xml:",any"`
+}
+
+// Availability sub-state of a <presence/>. Empty means simply available.
+type PresenceShow string
+
+const (
+	PresenceShowAway PresenceShow = "away"
+	PresenceShowChat PresenceShow = "chat"
+	PresenceShowDND  PresenceShow = "dnd"
+	PresenceShowXA   PresenceShow = "xa"
+)
+
+// Return true if show is empty or one of the PresenceShow constants.
+func (show PresenceShow) Valid() bool {
+	switch show {
+	case "", PresenceShowAway, PresenceShowChat, PresenceShowDND, PresenceShowXA:
+		return true
+	}
+	return false
+}
+
+// Return an error if the presence's fields have values the protocol doesn't
+// allow. Presences are checked before they're sent.
+func (p *Presence) Validate() error {
+	if !p.Show.Valid() {
+		return fmt.Errorf("invalid presence show %q", p.Show)
+	}
+	return nil
 }
 
 // XMPP <error/>. May occur as a top-level stanza or embedded in another
@@ -195,4 +345,158 @@ var (
 	ErrorConflict              = ErrorCondition{nsErrorStanzas, "conflict"}
 	ErrorNotAcceptable         = ErrorCondition{nsErrorStanzas, "not-acceptable"}
 	ErrorForbidden             = ErrorCondition{nsErrorStanzas, "forbidden"}
+	ErrorBadRequest            = ErrorCondition{nsErrorStanzas, "bad-request"}
+	ErrorGone                  = ErrorCondition{nsErrorStanzas, "gone"}
+	ErrorInternalServerError   = ErrorCondition{nsErrorStanzas, "internal-server-error"}
+	ErrorItemNotFound          = ErrorCondition{nsErrorStanzas, "item-not-found"}
+	ErrorJIDMalformed          = ErrorCondition{nsErrorStanzas, "jid-malformed"}
+	ErrorNotAllowed            = ErrorCondition{nsErrorStanzas, "not-allowed"}
+	ErrorPolicyViolation       = ErrorCondition{nsErrorStanzas, "policy-violation"}
+	ErrorRecipientUnavailable  = ErrorCondition{nsErrorStanzas, "recipient-unavailable"}
+	ErrorRedirect              = ErrorCondition{nsErrorStanzas, "redirect"}
+	ErrorRegistrationRequired  = ErrorCondition{nsErrorStanzas, "registration-required"}
+	ErrorRemoteServerTimeout   = ErrorCondition{nsErrorStanzas, "remote-server-timeout"}
+	ErrorResourceConstraint    = ErrorCondition{nsErrorStanzas, "resource-constraint"}
+	ErrorSubscriptionRequired  = ErrorCondition{nsErrorStanzas, "subscription-required"}
+	ErrorUndefinedCondition    = ErrorCondition{nsErrorStanzas, "undefined-condition"}
+	ErrorUnexpectedRequest     = ErrorCondition{nsErrorStanzas, "unexpected-request"}
 )
+
+// Stanza error types.
+const (
+	ErrorTypeAuth     = "auth"
+	ErrorTypeCancel   = "cancel"
+	ErrorTypeContinue = "continue"
+	ErrorTypeModify   = "modify"
+	ErrorTypeWait     = "wait"
+)
+
+// A stanza error parsed into its parts, for use as a Go error. Compare
+// Condition with the Error* conditions to find out what went wrong.
+type StanzaError struct {
+	Type      string // One of the ErrorType constants.
+	Condition ErrorCondition
+	Text      string
+	Code      string // Legacy error code, if the sender included one.
+}
+
+func (e *StanzaError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("[%s] %s", e.Type, e.Condition.Local)
+	}
+	return fmt.Sprintf("[%s] %s, %s", e.Type, e.Condition.Local, e.Text)
+}
+
+// Return the error parsed into a StanzaError. The condition is
+// undefined-condition if the payload doesn't contain one.
+func (e Error) StanzaError() *StanzaError {
+	condition := e.Condition()
+	if condition == (ErrorCondition{}) {
+		condition = ErrorUndefinedCondition
+	}
+	return &StanzaError{Type: e.Type, Condition: condition, Text: e.Text(), Code: e.Code}
+}
+
+// Return the error of an <iq type="error"/> as a StanzaError, or nil if the
+// IQ isn't an error.
+func (iq *IQ) StanzaError() *StanzaError {
+	if iq.Type != IQTypeError {
+		return nil
+	}
+	if iq.Error == nil {
+		return &StanzaError{Condition: ErrorUndefinedCondition}
+	}
+	return iq.Error.StanzaError()
+}
+
+// Return the error of a <message type="error"/> as a StanzaError, or nil if
+// the message isn't an error.
+func (msg *Message) StanzaError() *StanzaError {
+	if msg.Type != MessageTypeError {
+		return nil
+	}
+	if msg.Error == nil {
+		return &StanzaError{Condition: ErrorUndefinedCondition}
+	}
+	return msg.Error.StanzaError()
+}
+
+// Return the error of a <presence type="error"/> as a StanzaError, or nil if
+// the presence isn't an error.
+func (p *Presence) StanzaError() *StanzaError {
+	if p.Type != PresenceTypeError {
+		return nil
+	}
+	if p.Error == nil {
+		return &StanzaError{Condition: ErrorUndefinedCondition}
+	}
+	return p.Error.StanzaError()
+}
+
+// A child element of a Message or Presence that isn't otherwise modelled, so
+// it can be inspected or sent on. IQ payloads are kept as raw XML instead; see
+// IQ.Payload.
+type Extension struct {
+	XMLName xml.Name
+	Attr    []xml.Attr  // Namespace declarations are left out.
+	Tokens  []xml.Token // The element's content.
+}
+
+func (ext *Extension) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	ext.XMLName = start.Name
+	ext.Attr = stripNamespaceDecls(start.Attr)
+	ext.Tokens = nil
+	for depth := 0; ; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			t.Attr = stripNamespaceDecls(t.Attr)
+			tok = t
+		case xml.EndElement:
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+		ext.Tokens = append(ext.Tokens, xml.CopyToken(tok))
+	}
+}
+
+func (ext Extension) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: ext.XMLName, Attr: ext.Attr}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, tok := range ext.Tokens {
+		if err := e.EncodeToken(tok); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// Decode the extension into the given value, as xml.Unmarshal would.
+func (ext *Extension) Decode(v interface{}) error {
+	data, err := xml.Marshal(ext)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// Return the attributes without any namespace declarations. The decoder has
+// already applied them to the names, and the encoder adds its own.
+func stripNamespaceDecls(attrs []xml.Attr) []xml.Attr {
+	var stripped []xml.Attr
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" || attr.Name == (xml.Name{"", "xmlns"}) {
+			continue
+		}
+		stripped = append(stripped, attr)
+	}
+	return stripped
+}
@@ -0,0 +1,38 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+const (
+	NSStanzaID = "urn:xmpp:sid:0"
+)
+
+// XEP-0359: Unique and Stable Stanza IDs
+
+// An id assigned to a message by an entity that handled it, e.g. the user's
+// server when archiving it or a MUC room.
+type StanzaID struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	By      string   `xml:"by,attr"`
+	ID      string   `xml:"id,attr"`
+}
+
+// An id assigned to a message by its sender, kept even if the message's own id
+// attribute is changed along the way.
+type OriginID struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 origin-id"`
+	ID      string   `xml:"id,attr"`
+}
+
+// Return the stanza id assigned by the entity, or "" if there isn't one. Only
+// ask about entities known to assign stanza ids, i.e. the user's own bare JID
+// for its archive or a MUC room; anyone else's could be forged by the sender.
+func (msg *Message) StanzaIDBy(by JID) string {
+	for _, sid := range msg.StanzaIDs {
+		if jid, err := ParseJID(sid.By); err == nil && jid.Equal(by) {
+			return sid.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestStanzaError(t *testing.T) {
+	raw := `<iq type="error" id="1"><error type="cancel" code="404">` +
+		`<item-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/>` +
+		`<text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">No such node</text>` +
+		`</error></iq>`
+	iq := &IQ{}
+	if err := xml.Unmarshal([]byte(raw), iq); err != nil {
+		t.Fatal(err)
+	}
+	err := iq.StanzaError()
+	if err == nil {
+		t.Fatal("expected a StanzaError")
+	}
+	if err.Type != ErrorTypeCancel || err.Condition != ErrorItemNotFound || err.Text != "No such node" || err.Code != "404" {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if err.Error() != "[cancel] item-not-found, No such node" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	iq = &IQ{Type: IQTypeError}
+	if err := iq.StanzaError(); err == nil || err.Condition != ErrorUndefinedCondition {
+		t.Errorf("expected undefined-condition, got %v", err)
+	}
+
+	iq = &IQ{Type: IQTypeResult}
+	if err := iq.StanzaError(); err != nil {
+		t.Errorf("expected no error for a result, got %v", err)
+	}
+}
+
+func TestMessageExtensions(t *testing.T) {
+	raw := `<message xmlns="jabber:client" to="a@example.com"><body>hi</body>` +
+		`<x xmlns="urn:example:ext" xmlns:p="urn:example:p" a="1" p:b="2"><y>text</y></x></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(raw), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Extensions) != 1 {
+		t.Fatalf("expected 1 extension, got %d", len(msg.Extensions))
+	}
+	ext := msg.Extensions[0]
+	if ext.XMLName != (xml.Name{"urn:example:ext", "x"}) || len(ext.Attr) != 2 {
+		t.Errorf("unexpected extension %#v", ext)
+	}
+
+	// Re-encoding the message keeps the extension, which decodes the same.
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := &Message{}
+	if err := xml.Unmarshal(data, again); err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Extensions) != 1 {
+		t.Fatalf("extension lost in %s", data)
+	}
+	var x struct {
+		A string `xml:"a,attr"`
+		B string `xml:"urn:example:p b,attr"`
+		Y string `xml:"urn:example:ext y"`
+	}
+	if err := again.Extensions[0].Decode(&x); err != nil {
+		t.Fatal(err)
+	}
+	if x.A != "1" || x.B != "2" || x.Y != "text" {
+		t.Errorf("unexpected decode %+v from %s", x, data)
+	}
+}
+
+func TestPresenceFields(t *testing.T) {
+	data, err := xml.Marshal(&Presence{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<presence></presence>" {
+		t.Errorf("empty fields not omitted: %s", data)
+	}
+
+	p := &Presence{}
+	if err := xml.Unmarshal([]byte(`<presence><show>dnd</show><priority>-5</priority></presence>`), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Show != PresenceShowDND || p.Priority != -5 || p.Validate() != nil {
+		t.Errorf("unexpected %+v", p)
+	}
+
+	if err := xml.Unmarshal([]byte(`<presence><priority>128</priority></presence>`), &Presence{}); err == nil {
+		t.Error("expected an out of range priority to fail")
+	}
+	if err := (&Presence{Show: "dn d"}).Validate(); err == nil {
+		t.Error("expected an invalid show to fail")
+	}
+}
+
+func TestMessageThread(t *testing.T) {
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(`<message><thread parent="p1">t2</thread></message>`), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Thread == nil || msg.Thread.ID != "t2" || msg.Thread.Parent != "p1" {
+		t.Errorf("unexpected thread %+v", msg.Thread)
+	}
+
+	data, _ := xml.Marshal(&Message{Thread: &Thread{ID: "t1"}})
+	if string(data) != `<message><thread>t1</thread></message>` {
+		t.Errorf("unexpected %s", data)
+	}
+}
+
+func TestXHTMLIM(t *testing.T) {
+	raw := `<message><body>hi there</body><html xmlns="http://jabber.org/protocol/xhtml-im">` +
+		`<body xmlns="http://www.w3.org/1999/xhtml"><p>hi <em>there</em></p></body></html></message>`
+	msg := &Message{}
+	if err := xml.Unmarshal([]byte(raw), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.HTML == nil || len(msg.HTML.Bodies) != 1 || msg.HTML.Bodies[0].Content != "<p>hi <em>there</em></p>" {
+		t.Fatalf("unexpected html %+v", msg.HTML)
+	}
+	if err := msg.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	msg.HTML.Bodies[0].Content = "<p>hi <em>there</p>"
+	if err := msg.Validate(); err == nil {
+		t.Error("expected malformed XHTML to fail")
+	}
+	msg.HTML.Bodies[0].Content = "<p>hi</p>"
+	msg.Body = nil
+	if err := msg.Validate(); err == nil {
+		t.Error("expected XHTML without a plain body to fail")
+	}
+}
+
+func TestMessageOOB(t *testing.T) {
+	msg := &Message{Body: []MessageBody{{Value: "https://example.com/a.png"}}}
+	msg.AttachURL("https://example.com/a.png", "A picture")
+	b, err := xml.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Message{}
+	if err := xml.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.OOB) != 1 || decoded.OOB[0].URL != "https://example.com/a.png" || decoded.OOB[0].Desc != "A picture" {
+		t.Errorf("unexpected oob %+v from %s", decoded.OOB, b)
+	}
+}
+
+func TestNick(t *testing.T) {
+	b, err := xml.Marshal(&Presence{Type: PresenceTypeSubscribe, Nick: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `<presence type="subscribe"><nick xmlns="http://jabber.org/protocol/nick">Alice</nick></presence>` {
+		t.Errorf("unexpected presence %s", b)
+	}
+	msg := &Message{}
+	raw := `<message><body>hi</body><nick xmlns="http://jabber.org/protocol/nick">Bob</nick></message>`
+	if err := xml.Unmarshal([]byte(raw), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Nick != "Bob" {
+		t.Errorf("unexpected nick %q", msg.Nick)
+	}
+}
+
+func TestIQReply(t *testing.T) {
+	req := &IQ{ID: "1", Type: IQTypeGet, From: "alice@example.com/test", To: "example.com"}
+
+	resp := req.Reply(&LastActivity{Seconds: 5})
+	if resp.ID != "1" || resp.Type != IQTypeResult || resp.To != req.From || resp.From != req.To {
+		t.Errorf("unexpected reply %+v", resp)
+	}
+	last := &LastActivity{}
+	if err := resp.PayloadDecode(last); err != nil || last.Seconds != 5 {
+		t.Errorf("payload = %q, %v", resp.Payload, err)
+	}
+	if resp := req.Reply(nil); resp.Payload != "" {
+		t.Errorf("payload = %q, want empty", resp.Payload)
+	}
+
+	resp = req.ReplyError(&StanzaError{Type: ErrorTypeCancel, Condition: ErrorItemNotFound, Text: "No such node"})
+	if resp.ID != "1" || resp.Type != IQTypeError || resp.To != req.From {
+		t.Errorf("unexpected reply %+v", resp)
+	}
+	err := resp.StanzaError()
+	if err == nil || err.Type != ErrorTypeCancel || err.Condition != ErrorItemNotFound || err.Text != "No such node" {
+		t.Errorf("error = %+v", err)
+	}
+
+	// A result that can't be encoded is answered with an error.
+	err = req.Reply(make(chan int)).StanzaError()
+	if err == nil || err.Type != ErrorTypeCancel || err.Condition != ErrorInternalServerError {
+		t.Errorf("error = %+v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package xmpp
+
+import (
+	"time"
+)
+
+// Counts of elements of each kind.
+type StanzaCounts struct {
+	IQ       uint64
+	Message  uint64
+	Presence uint64
+
+	// Any other element, e.g. stream management requests or elements
+	// registered with RegisterElement.
+	Other uint64
+}
+
+// Add the element to the counts.
+func (c *StanzaCounts) count(v interface{}) {
+	switch v.(type) {
+	case IQ, *IQ:
+		c.IQ++
+	case Message, *Message:
+		c.Message++
+	case Presence, *Presence:
+		c.Presence++
+	default:
+		c.Other++
+	}
+}
+
+// Snapshot of an XMPP's counters, returned by Stats.
+type Stats struct {
+	// Elements written to and read from the stream.
+	Sent     StanzaCounts
+	Received StanzaCounts
+
+	// Replies SendRecv has waited for, how long they took altogether and
+	// the longest one.
+	RoundTrips    uint64
+	RoundTripTime time.Duration
+	MaxRoundTrip  time.Duration
+
+	// Filters currently added.
+	Filters int
+
+	// With ComponentConfig's sender limits, the stanzas refused for
+	// exceeding them and the IQ requests waiting for our reply.
+	Refused         uint64
+	PendingRequests int
+
+	// Times the connection has been replaced. Only set by
+	// ReconnectingClient.Stats.
+	Reconnects int
+}
+
+// Return a copy of the XMPP's counters.
+func (x *XMPP) Stats() Stats {
+	x.statsLock.Lock()
+	stats := x.stats
+	x.statsLock.Unlock()
+
+	x.filterLock.Lock()
+	stats.Filters = len(x.filters)
+	x.filterLock.Unlock()
+
+	if x.limits != nil {
+		stats.Refused, stats.PendingRequests = x.limits.counts()
+	}
+
+	return stats
+}
+
+// Count an element written to the stream and pass it to the hook, if any.
+func (x *XMPP) countSent(v interface{}) {
+	x.statsLock.Lock()
+	x.stats.Sent.count(v)
+	x.statsLock.Unlock()
+	if x.onStanza != nil {
+		x.onStanza(v, true)
+	}
+}
+
+// Count an element read from the stream and pass it to the hook, if any.
+func (x *XMPP) countReceived(v interface{}) {
+	x.statsLock.Lock()
+	x.stats.Received.count(v)
+	x.statsLock.Unlock()
+	if x.onStanza != nil {
+		x.onStanza(v, false)
+	}
+}
+
+// Record how long SendRecv waited for a reply.
+func (x *XMPP) countRoundTrip(d time.Duration) {
+	x.statsLock.Lock()
+	defer x.statsLock.Unlock()
+	x.stats.RoundTrips++
+	x.stats.RoundTripTime += d
+	if d > x.stats.MaxRoundTrip {
+		x.stats.MaxRoundTrip = d
+	}
+}
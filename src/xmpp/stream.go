@@ -2,12 +2,16 @@ package xmpp
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Stream configuration.
@@ -18,12 +22,57 @@ type StreamConfig struct {
 	// causes incoming stanzas to be XML-parsed a second time.
 	LogStanzas bool
 
-	// The dommain connection for certificate validation.
+	// Indent stanzas logged by LogStanzas, one element per line, with this
+	// string for each level, e.g. "  ". Only the log is indented; what's
+	// sent to the server is unchanged.
+	LogIndent string
+
+	// Domain the server's certificate must be valid for, also sent with SNI,
+	// when the stream is upgraded with STARTTLS. Defaults to the domain of
+	// the JID logging in, which is what servers are expected to present a
+	// certificate for even when reached through SRV records or another host.
 	ConnectionDomain string
+
+	// Largest stanza, in bytes, that will be read. A larger stanza is an
+	// error that ends the stream, rather than being read into memory.
+	// Defaults to 1MB; negative means no limit.
+	MaxStanzaSize int64
+
+	// Fail reading, ending the stream, if nothing arrives for this long. Set
+	// it comfortably above any keepalive interval so a quiet but healthy
+	// connection isn't dropped. 0 means no timeout.
+	ReadTimeout time.Duration
+
+	// TLS configuration for connections that are encrypted from the start,
+	// e.g. wss:// WebSockets or DirectTLS. If nil, a default configuration
+	// is used.
+	TLSConfig *tls.Config
+
+	// Encrypt the connection with TLS from the first byte (XEP-0368), usually
+	// on port 5223, rather than upgrading it with STARTTLS. The server's
+	// certificate must be valid for ConnectionDomain or, if that's empty,
+	// the host dialled by NewStream or the JID's domain for NewClientStream.
+	DirectTLS bool
+
+	// Called with the XML read from and written to the connection, exactly
+	// as it's read before decoding and written after encoding, to trace what
+	// goes over the wire. TLS and compression have been removed. The chunks
+	// don't line up with stanzas. The byte slice must not be modified or
+	// kept after the call returns.
+	OnRecvRaw func([]byte)
+	OnSendRaw func([]byte)
+
+	// Logger for the stream and the XMPP instance using it. Nothing is logged
+	// if nil, unless LogStanzas is set in which case the standard log package
+	// is used.
+	Logger Logger
 }
 
 type Stream struct {
 	conn              net.Conn
+	addr              string
+	redirected        bool
+	reader            *streamReader
 	dec               *xml.Decoder
 	config            *StreamConfig
 	stanzaBuf         string
@@ -38,23 +87,185 @@ func NewStream(addr string, config *StreamConfig) (*Stream, error) {
 		config = &StreamConfig{}
 	}
 
-	log.Println("Connecting to", addr)
+	stream := &Stream{config: config}
+	stream.logger().Info("Connecting to ", addr)
 
-	conn, err := net.Dial("tcp", addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := stream.dial(context.Background(), addr, host)
 	if err != nil {
 		return nil, err
 	}
 
-	stream := &Stream{conn: conn, dec: xml.NewDecoder(conn), config: config}
-	if config.ConnectionDomain == "" {
-		config.ConnectionDomain = strings.SplitN(addr, ":", 2)[0]
+	return stream, stream.start(conn, addr)
+}
+
+// Create a XML stream connection to the JID's home server, found with
+// HomeServerAddrs. Each address is tried in turn until one connects; Addr
+// reports which one it was.
+func NewClientStream(jid JID, config *StreamConfig) (*Stream, error) {
+	return newClientStream(context.Background(), jid, config)
+}
+
+func newClientStream(ctx context.Context, jid JID, config *StreamConfig) (*Stream, error) {
+
+	if config == nil {
+		config = &StreamConfig{}
+	}
+
+	lookup := HomeServerAddrs
+	if config.DirectTLS {
+		lookup = HomeServerDirectTLSAddrs
+	}
+	addrs, err := lookup(jid)
+	if err != nil {
+		return nil, err
 	}
 
+	stream := &Stream{config: config}
+	for _, addr := range addrs {
+		stream.logger().Info("Connecting to ", addr)
+		var conn net.Conn
+		conn, err = stream.dial(ctx, addr, jid.Domain)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			stream.logger().Error("Connecting to ", addr, " failed. ", err)
+			continue
+		}
+		return stream, stream.start(conn, addr)
+	}
+	return nil, err
+}
+
+// Dial the address, and start TLS straight away if the config asks for it.
+// The server's certificate must be valid for serverName unless the config
+// names another.
+func (stream *Stream) dial(ctx context.Context, addr, serverName string) (net.Conn, error) {
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil || !stream.config.DirectTLS {
+		return conn, err
+	}
+
+	var tlsConfig *tls.Config
+	if stream.config.TLSConfig != nil {
+		tlsConfig = stream.config.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = stream.config.ConnectionDomain
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"xmpp-client"}
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Return true if the stream's connection is encrypted with TLS.
+func (stream *Stream) isTLS() bool {
+	_, ok := stream.conn.(*tls.Conn)
+	return ok
+}
+
+// Start the stream's XML document over a new connection.
+func (stream *Stream) start(conn net.Conn, addr string) error {
+	stream.setConn(conn)
+	stream.addr = addr
+	if _, ok := conn.(streamFramer); ok {
+		return nil
+	}
 	if err := stream.send([]byte("<?xml version='1.0' encoding='utf-8'?>")); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Use conn for the stream from now on, reading it with a new decoder.
+func (stream *Stream) setConn(conn net.Conn) {
+	max := stream.config.MaxStanzaSize
+	if max == 0 {
+		max = defaultMaxStanzaSize
+	}
+	stream.conn = conn
+	stream.reader = &streamReader{conn: conn, max: max, timeout: stream.config.ReadTimeout, trace: stream.config.OnRecvRaw}
+	stream.dec = xml.NewDecoder(stream.reader)
+}
+
+// Return the host:port the stream connected to.
+func (stream *Stream) Addr() string {
+	return stream.addr
+}
+
+// Return true if the server redirected the stream to another host, which Addr
+// then returns.
+func (stream *Stream) Redirected() bool {
+	return stream.redirected
+}
+
+// Replace the connection with one to the see-other-host target, a host with
+// an optional port. The old connection is closed.
+func (stream *Stream) redirect(target, domain string) error {
+	addr := redirectAddr(target, stream.config.clientPort())
+	stream.logger().Info("Connecting to ", addr)
+	conn, err := stream.dial(context.Background(), addr, domain)
+	if err != nil {
+		return err
+	}
+	stream.conn.Close()
+	stream.redirected = true
+	return stream.start(conn, addr)
+}
+
+// Create a XML stream connection to a see-other-host target, a host with an
+// optional port, for the JID domain.
+func newRedirectedStream(target, domain string, config *StreamConfig) (*Stream, error) {
+
+	if config == nil {
+		config = &StreamConfig{}
+	}
+
+	stream := &Stream{config: config, redirected: true}
+	addr := redirectAddr(target, config.clientPort())
+	stream.logger().Info("Connecting to ", addr)
+
+	conn, err := stream.dial(context.Background(), addr, domain)
+	if err != nil {
 		return nil, err
 	}
 
-	return stream, nil
+	return stream, stream.start(conn, addr)
+}
+
+// Return the port clients connect to by default.
+func (config *StreamConfig) clientPort() int {
+	if config.DirectTLS {
+		return ClientDirectTLSPort
+	}
+	return ClientPort
+}
+
+// Return the host:port of a see-other-host target, using port if it has none.
+func redirectAddr(target string, port int) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"), strconv.Itoa(port))
 }
 
 // Upgrade the stream's underlying net connection to TLS.
@@ -65,8 +276,7 @@ func (stream *Stream) UpgradeTLS(config *tls.Config) error {
 		return err
 	}
 
-	stream.conn = conn
-	stream.dec = xml.NewDecoder(stream.conn)
+	stream.setConn(conn)
 
 	return nil
 }
@@ -75,16 +285,22 @@ func (stream *Stream) UpgradeTLS(config *tls.Config) error {
 func (stream *Stream) SendStart(start *xml.StartElement) (*xml.StartElement, error) {
 
 	// Write start of outgoing doc.
-	buf := new(bytes.Buffer)
-	if err := writeXMLStartElement(buf, start); err != nil {
-		return nil, err
-	}
-	if err := stream.send(buf.Bytes()); err != nil {
-		return nil, err
+	if framer, ok := stream.conn.(streamFramer); ok {
+		if err := framer.frameStart(start); err != nil {
+			return nil, err
+		}
+	} else {
+		buf := new(bytes.Buffer)
+		if err := writeXMLStartElement(buf, start); err != nil {
+			return nil, err
+		}
+		if err := stream.send(buf.Bytes()); err != nil {
+			return nil, err
+		}
 	}
 
 	// Read and return start of incoming doc.
-	rstart, err := nextStartElement(stream.dec)
+	rstart, err := stream.nextStartElement()
 	if err != nil {
 		return nil, err
 	}
@@ -104,6 +320,9 @@ func (stream *Stream) SendStart(start *xml.StartElement) (*xml.StartElement, err
 
 // Send the end element that closes the stream.
 func (stream *Stream) SendEnd(end *xml.EndElement) error {
+	if framer, ok := stream.conn.(streamFramer); ok {
+		return framer.frameEnd()
+	}
 	buf := new(bytes.Buffer)
 	if err := writeXMLEndElement(buf, end); err != nil {
 		return err
@@ -114,35 +333,68 @@ func (stream *Stream) SendEnd(end *xml.EndElement) error {
 	return nil
 }
 
+// Close the stream's underlying net connection.
+func (stream *Stream) Close() error {
+	return stream.conn.Close()
+}
+
 // Send a stanza. Used to write a complete, top-level element.
 func (stream *Stream) Send(v interface{}) error {
-	if stream.config.LogStanzas {
+	// Framed connections need each element in a single write.
+	_, framed := stream.conn.(streamFramer)
+	if stream.config.LogStanzas || framed {
 		bytes, err := xml.Marshal(v)
 		if err != nil {
 			return err
 		}
 		return stream.send(bytes)
 	}
-	enc := xml.NewEncoder(stream.conn)
+	enc := xml.NewEncoder(streamWriter{stream})
 	return enc.Encode(v)
 }
 
 func (stream *Stream) send(b []byte) error {
 	if stream.config.LogStanzas {
-		log.Println("send:", string(b))
+		stream.logger().Debug("send: ", stream.indent(string(b)))
 	}
-	if _, err := stream.conn.Write(b); err != nil {
+	if _, err := (streamWriter{stream}).Write(b); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Return the XML indented for logging, if the stream's config asks for it.
+func (stream *Stream) indent(s string) string {
+	if stream.config.LogIndent == "" {
+		return s
+	}
+	return IndentXML(s, stream.config.LogIndent)
+}
+
+// Writes to the stream's connection, passing what's written to the
+// OnSendRaw hook.
+type streamWriter struct {
+	stream *Stream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	n, err := w.stream.conn.Write(p)
+	if trace := w.stream.config.OnSendRaw; trace != nil && n > 0 {
+		trace(p[:n])
+	}
+	return n, err
+}
+
 // Find start of next stanza.
 // Bad things are very likely to happen if a call to Next() is successful but
 // you don't actually decode or skip the element.
 func (stream *Stream) Next() (*xml.StartElement, error) {
 
-	start, err := nextStartElement(stream.dec)
+	if stream.reader != nil {
+		stream.reader.reset()
+	}
+
+	start, err := stream.nextStartElement()
 	if err != nil {
 		return nil, err
 	}
@@ -153,20 +405,31 @@ func (stream *Stream) Next() (*xml.StartElement, error) {
 			return nil, err
 		}
 		stream.stanzaBuf = xml
-		log.Println("recv:", stream.stanzaBuf)
+		stream.logger().Debug("recv: ", stream.indent(stream.stanzaBuf))
+	}
+
+	// A stream error ends the stream.
+	if start.Name == (xml.Name{nsStreams, "error"}) {
+		serr := &StreamError{}
+		if stream.config.LogStanzas {
+			err = xml.Unmarshal([]byte(stream.stanzaBuf), serr)
+		} else {
+			err = stream.dec.DecodeElement(serr, start)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, serr
 	}
 
 	return start, nil
 }
 
-func nextStartElement(dec *xml.Decoder) (*xml.StartElement, error) {
+func (stream *Stream) nextStartElement() (*xml.StartElement, error) {
 	for {
-		t, err := dec.Token()
+		t, err := stream.dec.Token()
 		if err != nil {
-			if err == io.EOF {
-				err = io.ErrUnexpectedEOF
-			}
-			return nil, err
+			return nil, connectionError(err)
 		}
 		switch e := t.(type) {
 		case xml.StartElement:
@@ -179,10 +442,131 @@ func nextStartElement(dec *xml.Decoder) (*xml.StartElement, error) {
 			}
 			return &e, nil
 		case xml.EndElement:
-			log.Printf("EOF due to %s\n", e.Name)
-			return nil, io.EOF
+			stream.logger().Debug("EOF due to ", e.Name.Local)
+			return nil, ErrStreamClosed
+		}
+	}
+}
+
+// Returned, and delivered on In, when the other end ends the stream cleanly
+// with </stream:stream>.
+var ErrStreamClosed = errors.New("xmpp: stream closed")
+
+// Stream error conditions.
+var (
+	StreamErrorBadFormat              = ErrorCondition{nsErrorStreams, "bad-format"}
+	StreamErrorBadNamespacePrefix     = ErrorCondition{nsErrorStreams, "bad-namespace-prefix"}
+	StreamErrorConflict               = ErrorCondition{nsErrorStreams, "conflict"}
+	StreamErrorConnectionTimeout      = ErrorCondition{nsErrorStreams, "connection-timeout"}
+	StreamErrorHostGone               = ErrorCondition{nsErrorStreams, "host-gone"}
+	StreamErrorHostUnknown            = ErrorCondition{nsErrorStreams, "host-unknown"}
+	StreamErrorImproperAddressing     = ErrorCondition{nsErrorStreams, "improper-addressing"}
+	StreamErrorInternalServerError    = ErrorCondition{nsErrorStreams, "internal-server-error"}
+	StreamErrorInvalidFrom            = ErrorCondition{nsErrorStreams, "invalid-from"}
+	StreamErrorInvalidNamespace       = ErrorCondition{nsErrorStreams, "invalid-namespace"}
+	StreamErrorInvalidXML             = ErrorCondition{nsErrorStreams, "invalid-xml"}
+	StreamErrorNotAuthorized          = ErrorCondition{nsErrorStreams, "not-authorized"}
+	StreamErrorNotWellFormed          = ErrorCondition{nsErrorStreams, "not-well-formed"}
+	StreamErrorPolicyViolation        = ErrorCondition{nsErrorStreams, "policy-violation"}
+	StreamErrorRemoteConnectionFailed = ErrorCondition{nsErrorStreams, "remote-connection-failed"}
+	StreamErrorReset                  = ErrorCondition{nsErrorStreams, "reset"}
+	StreamErrorResourceConstraint     = ErrorCondition{nsErrorStreams, "resource-constraint"}
+	StreamErrorRestrictedXML          = ErrorCondition{nsErrorStreams, "restricted-xml"}
+	StreamErrorSeeOtherHost           = ErrorCondition{nsErrorStreams, "see-other-host"}
+	StreamErrorSystemShutdown         = ErrorCondition{nsErrorStreams, "system-shutdown"}
+	StreamErrorUndefinedCondition     = ErrorCondition{nsErrorStreams, "undefined-condition"}
+	StreamErrorUnsupportedEncoding    = ErrorCondition{nsErrorStreams, "unsupported-encoding"}
+	StreamErrorUnsupportedFeature     = ErrorCondition{nsErrorStreams, "unsupported-feature"}
+	StreamErrorUnsupportedStanzaType  = ErrorCondition{nsErrorStreams, "unsupported-stanza-type"}
+	StreamErrorUnsupportedVersion     = ErrorCondition{nsErrorStreams, "unsupported-version"}
+)
+
+// A <stream:error/>, returned, and delivered on In, when the server ends
+// the stream because of an error. Unlike errors in stanzas (StanzaError) the
+// stream can't be used afterwards. Compare Condition with the StreamError*
+// conditions.
+type StreamError struct {
+	Condition ErrorCondition
+	Text      string
+
+	// The host, and optional port, to connect to instead, given with
+	// see-other-host.
+	SeeOtherHost string
+}
+
+func (e *StreamError) Error() string {
+	if e.Text == "" {
+		return "xmpp: stream error: " + e.Condition.Local
+	}
+	return "xmpp: stream error: " + e.Condition.Local + ", " + e.Text
+}
+
+// Decode the condition and text from the <stream:error/>.
+func (e *StreamError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*e = StreamError{}
+	err := decodeChildren(d, func(child xml.StartElement) error {
+		if child.Name.Space != nsErrorStreams {
+			return d.Skip()
+		}
+		switch child.Name.Local {
+		case "text":
+			return d.DecodeElement(&e.Text, &child)
+		case "see-other-host":
+			e.Condition = ErrorCondition(child.Name)
+			return d.DecodeElement(&e.SeeOtherHost, &child)
+		}
+		e.Condition = ErrorCondition(child.Name)
+		return d.Skip()
+	})
+	if err == nil && e.Condition == (ErrorCondition{}) {
+		e.Condition = StreamErrorUndefinedCondition
+	}
+	return err
+}
+
+// Returned, and delivered on In, when the connection fails or is closed
+// without the stream being ended. Err is the underlying error, e.g. a
+// net.Error or io.ErrUnexpectedEOF.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return "xmpp: connection lost: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// Implement net.Error so read timeouts can still be recognised.
+func (e *ConnectionError) Timeout() bool {
+	nerr, ok := e.Err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+func (e *ConnectionError) Temporary() bool {
+	return false
+}
+
+// Wrap an error reading the stream in a ConnectionError, unless the data
+// itself was bad.
+func connectionError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if serr, ok := err.(*xml.SyntaxError); ok {
+		// The decoder reports the connection closing mid-element as a
+		// syntax error.
+		if serr.Msg != "unexpected EOF" {
+			return err
 		}
+		err = io.ErrUnexpectedEOF
 	}
+	if err == ErrStanzaTooLarge {
+		return err
+	}
+	return &ConnectionError{err}
 }
 
 // Skip reads tokens until it reaches the end element of the most recent start
@@ -199,6 +583,10 @@ func (stream *Stream) Skip() error {
 // If start is not nil, the stanza for the start element that's already been
 // consumed is read. A nil start will read the next stanza in the stream.
 // See xml.Decoder.DecodeElement for decoding rules.
+//
+// If the element is well-formed but can't be decoded into v, the rest of the
+// element is skipped and a *DecodeError is returned; the stream remains
+// usable. Any other error means the stream is broken.
 func (stream *Stream) Decode(v interface{}, start *xml.StartElement) error {
 
 	// Explicity lookup next start element to ensure stream is validated,
@@ -212,10 +600,56 @@ func (stream *Stream) Decode(v interface{}, start *xml.StartElement) error {
 	}
 
 	if stream.config.LogStanzas {
-		return xml.Unmarshal([]byte(stream.stanzaBuf), v)
+		if err := xml.Unmarshal([]byte(stream.stanzaBuf), v); err != nil {
+			return &DecodeError{start.Name, err}
+		}
+		return nil
+	}
+
+	r := &resyncDecoder{v: v}
+	if err := stream.dec.DecodeElement(r, start); err != nil {
+		return err
+	}
+	if r.err != nil {
+		return &DecodeError{start.Name, r.err}
 	}
+	return nil
+}
+
+// Returned when a stanza could not be decoded. The stanza was skipped.
+type DecodeError struct {
+	Name xml.Name
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode <%s/>: %s", e.Name.Local, e.Err)
+}
+
+// Decodes an element into v. If that fails part way through, the rest of the
+// element is consumed so the decoder is left at the end of the element, ready
+// for the next one.
+type resyncDecoder struct {
+	v   interface{}
+	err error
+}
 
-	return stream.dec.DecodeElement(v, start)
+func (r *resyncDecoder) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if r.err = d.DecodeElement(r.v, &start); r.err == nil {
+		return nil
+	}
+	if _, ok := r.err.(*xml.SyntaxError); ok {
+		return r.err
+	}
+	// The decoder reports io.EOF once the element's end has been reached.
+	for {
+		if _, err := d.Token(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
 }
 
 // Collect the element with the start that's already been consumed into a
@@ -0,0 +1,159 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeErrorSkipsStanza(t *testing.T) {
+	const data = `<iq id="1"><item n="bad"><x/></item></iq><iq id="2"><item n="2"/></iq>`
+	stream := &Stream{dec: xml.NewDecoder(strings.NewReader(data)), config: &StreamConfig{}}
+
+	var v struct {
+		ID   string `xml:"id,attr"`
+		Item struct {
+			N int `xml:"n,attr"`
+		} `xml:"item"`
+	}
+
+	err := stream.Decode(&v, nil)
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("err = %v, want *DecodeError", err)
+	}
+
+	if err := stream.Decode(&v, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != "2" || v.Item.N != 2 {
+		t.Errorf("decoded %+v, want second stanza", v)
+	}
+}
+
+func TestMaxStanzaSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		io.WriteString(server, `<message><body>ok</body></message>`)
+		io.WriteString(server, `<message><body>`+strings.Repeat("x", 5000)+`</body></message>`)
+	}()
+
+	stream := &Stream{config: &StreamConfig{MaxStanzaSize: 1000}}
+	stream.setConn(client)
+
+	var msg Message
+	if err := stream.Decode(&msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Decode(&msg, nil); err != ErrStanzaTooLarge {
+		t.Errorf("err = %v, want ErrStanzaTooLarge", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stream := &Stream{config: &StreamConfig{ReadTimeout: 20 * time.Millisecond}}
+	stream.setConn(client)
+
+	_, err := stream.Next()
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("err = %v, want timeout", err)
+	}
+}
+
+func TestStreamClosed(t *testing.T) {
+	stream := &Stream{dec: xml.NewDecoder(strings.NewReader(`<stream:stream xmlns:stream="http://etherx.jabber.org/streams"></stream:stream>`)), config: &StreamConfig{}}
+	if _, err := stream.dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Next(); err != ErrStreamClosed {
+		t.Errorf("err = %v, want ErrStreamClosed", err)
+	}
+
+	// The connection is closed without ending the stream, mid-stanza.
+	stream = &Stream{dec: xml.NewDecoder(strings.NewReader(`<stream:stream xmlns:stream="http://etherx.jabber.org/streams"><message`)), config: &StreamConfig{}}
+	if _, err := stream.dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := stream.Next()
+	if cerr, ok := err.(*ConnectionError); !ok || cerr.Err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want *ConnectionError", err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	const data = `<stream:stream xmlns:stream="http://etherx.jabber.org/streams">` +
+		`<stream:error><see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams">[2001:41D0:1:A49b::1]:9222</see-other-host>` +
+		`<text xmlns="urn:ietf:params:xml:ns:xmpp-streams">Moved</text></stream:error>`
+	stream := &Stream{dec: xml.NewDecoder(strings.NewReader(data)), config: &StreamConfig{}}
+	if _, err := stream.dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := stream.Next()
+	serr, ok := err.(*StreamError)
+	if !ok {
+		t.Fatalf("err = %v, want *StreamError", err)
+	}
+	if serr.Condition != StreamErrorSeeOtherHost || serr.SeeOtherHost != "[2001:41D0:1:A49b::1]:9222" || serr.Text != "Moved" {
+		t.Errorf("unexpected stream error %+v", serr)
+	}
+}
+
+func TestRedirectAddr(t *testing.T) {
+	tests := []struct {
+		target, addr string
+	}{
+		{"example.net", "example.net:5222"},
+		{"example.net:9222", "example.net:9222"},
+		{"192.0.2.1", "192.0.2.1:5222"},
+		{"[2001:41D0:1:A49b::1]", "[2001:41D0:1:A49b::1]:5222"},
+		{"[2001:41D0:1:A49b::1]:9222", "[2001:41D0:1:A49b::1]:9222"},
+	}
+	for _, test := range tests {
+		if addr := redirectAddr(test.target, ClientPort); addr != test.addr {
+			t.Errorf("redirectAddr(%q) = %q, want %q", test.target, addr, test.addr)
+		}
+	}
+}
+
+func TestRawTrace(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	const recv = `<message id="in"><body>hello</body></message>`
+	go func() {
+		defer server.Close()
+		io.WriteString(server, recv)
+		io.Copy(io.Discard, server)
+	}()
+
+	var sent, received bytes.Buffer
+	stream := &Stream{config: &StreamConfig{
+		OnSendRaw: func(b []byte) { sent.Write(b) },
+		OnRecvRaw: func(b []byte) { received.Write(b) },
+	}}
+	stream.setConn(client)
+
+	var msg Message
+	if err := stream.Decode(&msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if received.String() != recv {
+		t.Errorf("received %q, want %q", received.String(), recv)
+	}
+
+	if err := stream.Send(&Message{ID: "out"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<message id="out"></message>`; sent.String() != want {
+		t.Errorf("sent %q, want %q", sent.String(), want)
+	}
+}
@@ -0,0 +1,25 @@
+package xmpp
+
+// Presence subscription management (RFC 6121). Subscription requests are
+// always addressed to the contact's bare JID.
+
+// Request a subscription to the contact's presence.
+func (x *XMPP) Subscribe(to JID) {
+	x.Out <- Presence{Type: PresenceTypeSubscribe, To: to.Bare()}
+}
+
+// Cancel our subscription to the contact's presence.
+func (x *XMPP) Unsubscribe(to JID) {
+	x.Out <- Presence{Type: PresenceTypeUnsubscribe, To: to.Bare()}
+}
+
+// Approve the contact's request to subscribe to our presence.
+func (x *XMPP) ApproveSubscription(from JID) {
+	x.Out <- Presence{Type: PresenceTypeSubscribed, To: from.Bare()}
+}
+
+// Deny the contact's request to subscribe to our presence, or cancel a
+// previously approved subscription.
+func (x *XMPP) DenySubscription(from JID) {
+	x.Out <- Presence{Type: PresenceTypeUnsubscribed, To: from.Bare()}
+}
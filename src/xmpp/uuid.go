@@ -20,6 +20,14 @@ func UUID4() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
 }
 
+// Return a new stanza id from the instance's IDGenerator.
+func (x *XMPP) newID() string {
+	if x.idGenerator != nil {
+		return x.idGenerator()
+	}
+	return UUID4()
+}
+
 func SessionID() string {
 	var bytes = make([]byte, 15)
 	if _, err := rand.Read(bytes); err != nil {
@@ -1,7 +1,10 @@
 package xmpp
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/xml"
+	"strings"
 )
 
 const (
@@ -10,6 +13,74 @@ const (
 
 // XEP-0054 vCard
 type VCard struct {
-	XMLName xml.Name `xml:"vcard-temp vCard"`
-	// TODO Must complete truct
+	XMLName  xml.Name     `xml:"vcard-temp vCard"`
+	FN       string       `xml:"FN,omitempty"`
+	Nickname string       `xml:"NICKNAME,omitempty"`
+	Email    []VCardEmail `xml:"EMAIL"`
+	Photo    *VCardPhoto  `xml:"PHOTO"`
+}
+
+type VCardEmail struct {
+	UserID string `xml:"USERID"`
+}
+
+// Photo, with the image data already decoded from base64.
+type VCardPhoto struct {
+	// MIME type of the image, e.g. "image/png".
+	Type string
+	Data []byte
+}
+
+type vcardPhotoXML struct {
+	Type   string `xml:"TYPE,omitempty"`
+	BinVal string `xml:"BINVAL,omitempty"`
+}
+
+// Encode the image data as base64.
+func (p *VCardPhoto) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(vcardPhotoXML{Type: p.Type, BinVal: base64.StdEncoding.EncodeToString(p.Data)}, start)
+}
+
+// Decode the base64 image data.
+func (p *VCardPhoto) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := vcardPhotoXML{}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	// BINVAL is often folded over several lines.
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v.BinVal), ""))
+	if err != nil {
+		return err
+	}
+	p.Type = v.Type
+	p.Data = data
+	return nil
+}
+
+// Retrieve the vCard of the user's bare JID.
+func (x *XMPP) GetVCard(ctx context.Context, jid JID) (*VCard, error) {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeGet, To: jid.Bare()}
+	req.PayloadEncode(&VCard{})
+
+	resp, err := x.SendRecvContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	vcard := &VCard{}
+	if err := resp.PayloadDecode(vcard); err != nil {
+		return nil, err
+	}
+	return vcard, nil
+}
+
+// Publish our own vCard.
+func (x *XMPP) SetVCard(ctx context.Context, vcard *VCard) error {
+
+	req := &IQ{ID: x.newID(), Type: IQTypeSet}
+	req.PayloadEncode(vcard)
+
+	_, err := x.SendRecvContext(ctx, req)
+	return err
 }
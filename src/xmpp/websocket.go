@@ -0,0 +1,421 @@
+package xmpp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nsFraming = "urn:ietf:params:xml:ns:xmpp-framing"
+
+	// Defined by RFC 6455 for computing Sec-WebSocket-Accept.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocket opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// Implemented by connections that frame the stream themselves rather than
+// carrying a single XML document, e.g. WebSockets. The stream's start and end
+// tags are replaced by whatever the framing uses.
+type streamFramer interface {
+	frameStart(start *xml.StartElement) error
+	frameEnd() error
+}
+
+// Create a XML stream over a WebSocket (RFC 7395). The url is the server's
+// ws:// or wss:// endpoint. The resulting Stream is used with NewClientXMPP in
+// the same way as a TCP one; there's no STARTTLS since a wss:// connection is
+// already encrypted, using config.TLSConfig if set.
+func NewWebSocketStream(rawurl string, config *StreamConfig) (*Stream, error) {
+
+	if config == nil {
+		config = &StreamConfig{}
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &Stream{config: config}
+	stream.logger().Info("Connecting to ", rawurl)
+
+	conn, err := dialWebSocket(u, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, stream.start(conn, u.Host)
+}
+
+// A WebSocket client connection carrying XMPP, presented as a net.Conn. Each
+// Write is sent as one text message. Reads return the content of the
+// server's messages with the framing's <open/> and <close/> elements replaced
+// by the equivalent stream tags.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeLock sync.Mutex
+
+	// Data read but not yet returned.
+	pending []byte
+}
+
+func dialWebSocket(u *url.URL, config *StreamConfig) (*wsConn, error) {
+
+	host := u.Host
+	var conn net.Conn
+	var err error
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		tlsConfig := &tls.Config{}
+		if config.TLSConfig != nil {
+			tlsConfig = config.TLSConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		conn, err = tls.Dial("tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported WebSocket scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := websocketHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// Upgrade the connection to a WebSocket using the xmpp subprotocol.
+func websocketHandshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "xmpp")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, errors.New("WebSocket handshake failed: bad Sec-WebSocket-Accept")
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "xmpp" {
+		return nil, errors.New("WebSocket handshake failed: server does not support the xmpp subprotocol")
+	}
+
+	return &wsConn{conn: conn, br: br}, nil
+}
+
+// The framing's replacement for the stream header.
+type wsOpen struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-framing open"`
+	To      string   `xml:"to,attr,omitempty"`
+	From    string   `xml:"from,attr,omitempty"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Version string   `xml:"version,attr,omitempty"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+}
+
+// The framing's replacement for the stream's end tag.
+type wsClose struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-framing close"`
+}
+
+func (ws *wsConn) frameStart(start *xml.StartElement) error {
+	open := wsOpen{}
+	for _, attr := range start.Attr {
+		switch attr.Name {
+		case xml.Name{"", "to"}:
+			open.To = attr.Value
+		case xml.Name{"", "from"}:
+			open.From = attr.Value
+		case xml.Name{"", "version"}:
+			open.Version = attr.Value
+		}
+	}
+	b, err := xml.Marshal(&open)
+	if err != nil {
+		return err
+	}
+	_, err = ws.Write(b)
+	return err
+}
+
+func (ws *wsConn) frameEnd() error {
+	b, err := xml.Marshal(&wsClose{})
+	if err != nil {
+		return err
+	}
+	_, err = ws.Write(b)
+	return err
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		msg, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		ws.pending = websocketTranslate(msg)
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// Send b as a single text message. Top-level elements without a namespace are
+// given the jabber:client namespace, as every message must stand alone.
+func (ws *wsConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsOpText, qualifyClientElement(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ws *wsConn) Close() error {
+	ws.writeFrame(wsOpClose, nil)
+	return ws.conn.Close()
+}
+
+func (ws *wsConn) LocalAddr() net.Addr                { return ws.conn.LocalAddr() }
+func (ws *wsConn) RemoteAddr() net.Addr               { return ws.conn.RemoteAddr() }
+func (ws *wsConn) SetDeadline(t time.Time) error      { return ws.conn.SetDeadline(t) }
+func (ws *wsConn) SetReadDeadline(t time.Time) error  { return ws.conn.SetReadDeadline(t) }
+func (ws *wsConn) SetWriteDeadline(t time.Time) error { return ws.conn.SetWriteDeadline(t) }
+
+// Read the next complete data message, answering pings along the way.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, nil)
+			return nil, io.EOF
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+
+	var header [2]byte
+	if _, err = io.ReadFull(ws.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > 1<<26 {
+		err = fmt.Errorf("WebSocket frame too large: %d bytes", length)
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write a single, final frame. Client frames are always masked.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(frame, ext[:]...)
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Replace the framing elements of a received message with the stream tags the
+// rest of the package expects.
+func websocketTranslate(msg []byte) []byte {
+
+	trimmed := bytes.TrimSpace(msg)
+	if !bytes.HasPrefix(trimmed, []byte("<open")) && !bytes.HasPrefix(trimmed, []byte("<close")) {
+		return msg
+	}
+
+	var open wsOpen
+	if err := xml.Unmarshal(trimmed, &open); err == nil {
+		attrs := []xml.Attr{
+			{xml.Name{"", "xmlns"}, nsClient},
+			{xml.Name{"xmlns", "stream"}, nsStreams},
+		}
+		if open.From != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"", "from"}, open.From})
+		}
+		if open.ID != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"", "id"}, open.ID})
+		}
+		if open.Version != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"", "version"}, open.Version})
+		}
+		if open.Lang != "" {
+			attrs = append(attrs, xml.Attr{xml.Name{"xml", "lang"}, open.Lang})
+		}
+		buf := new(bytes.Buffer)
+		writeXMLStartElement(buf, &xml.StartElement{xml.Name{"stream", "stream"}, attrs})
+		return buf.Bytes()
+	}
+
+	var end wsClose
+	if err := xml.Unmarshal(trimmed, &end); err == nil {
+		return []byte("</stream:stream>")
+	}
+
+	return msg
+}
+
+// Add the jabber:client namespace to a top-level element that has none.
+func qualifyClientElement(b []byte) []byte {
+	if len(b) == 0 || b[0] != '<' {
+		return b
+	}
+	end := bytes.IndexAny(b, " />")
+	tag := bytes.IndexByte(b, '>')
+	if end < 0 || tag < 0 {
+		return b
+	}
+	if bytes.Contains(b[:tag], []byte("xmlns=")) {
+		return b
+	}
+	name := string(b[1:end])
+	if strings.Contains(name, ":") {
+		return b
+	}
+	qualified := make([]byte, 0, len(b)+len(nsClient)+9)
+	qualified = append(qualified, b[:end]...)
+	qualified = append(qualified, ` xmlns="`+nsClient+`"`...)
+	qualified = append(qualified, b[end:]...)
+	return qualified
+}
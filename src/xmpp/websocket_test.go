@@ -0,0 +1,30 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestWebsocketTranslate(t *testing.T) {
+	for in, want := range map[string]string{
+		`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="example.com" id="abc" version="1.0"/>`: `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' id='abc' version='1.0'>`,
+		`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`:                                          `</stream:stream>`,
+		`<message xmlns="jabber:client"><body>hi</body></message>`:                                      `<message xmlns="jabber:client"><body>hi</body></message>`,
+	} {
+		if got := string(websocketTranslate([]byte(in))); got != want {
+			t.Errorf("websocketTranslate(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestQualifyClientElement(t *testing.T) {
+	for in, want := range map[string]string{
+		`<message to="a@b"><body>hi</body></message>`: `<message xmlns="jabber:client" to="a@b"><body>hi</body></message>`,
+		`<presence/>`: `<presence xmlns="jabber:client"/>`,
+		`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl">x</auth>`: `<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl">x</auth>`,
+		`<iq type="get"><query xmlns="jabber:iq:roster"/></iq>`:   `<iq xmlns="jabber:client" type="get"><query xmlns="jabber:iq:roster"/></iq>`,
+	} {
+		if got := string(qualifyClientElement([]byte(in))); got != want {
+			t.Errorf("qualifyClientElement(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
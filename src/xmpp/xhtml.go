@@ -0,0 +1,60 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	NSXHTMLIM = "http://jabber.org/protocol/xhtml-im"
+	NSXHTML   = "http://www.w3.org/1999/xhtml"
+)
+
+// XEP-0071: XHTML-IM. A formatted version of a message's body; the plain
+// body must be sent as well for clients that don't support it.
+type XHTMLIM struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/xhtml-im html"`
+	Bodies  []XHTMLBody `xml:"http://www.w3.org/1999/xhtml body"`
+}
+
+// An XHTML body. Content is the XHTML inside the <body/>, e.g.
+// "<p>Hello <em>world</em></p>".
+type XHTMLBody struct {
+	Lang    string `xml:"xml:lang,attr,omitempty"`
+	Content string `xml:",innerxml"`
+}
+
+// Return an error if a body's content isn't well-formed XML.
+func (html *XHTMLIM) Validate() error {
+	for _, body := range html.Bodies {
+		dec := xml.NewDecoder(strings.NewReader("<body>" + body.Content + "</body>"))
+		for {
+			_, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("invalid XHTML body: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+var errXHTMLWithoutBody = errors.New("XHTML-IM message without a plain body")
+
+// Return an error if the message can't be sent as it is: an XHTML body that
+// isn't well-formed or has no plain body to go with it. Messages are checked
+// before they're sent.
+func (msg *Message) Validate() error {
+	if msg.HTML == nil {
+		return nil
+	}
+	if len(msg.Body) == 0 {
+		return errXHTMLWithoutBody
+	}
+	return msg.HTML.Validate()
+}
@@ -1,9 +1,11 @@
 package xmpp
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"strings"
 )
 
 type nsMap map[string]string
@@ -47,7 +49,7 @@ func writeXMLEndElement(w io.Writer, end *xml.EndElement) error {
 // Write a xml.Name.
 func writeXMLName(w io.Writer, name xml.Name) error {
 	if name.Space == "" {
-		if _, err := fmt.Fprintf(w, name.Local); err != nil {
+		if _, err := io.WriteString(w, name.Local); err != nil {
 			return err
 		}
 	} else {
@@ -86,3 +88,56 @@ func startElementIter(dec *xml.Decoder) func() *xml.StartElement {
 		}
 	}
 }
+
+// Return the XML with each element on its own line, indented by indent for
+// each level of nesting, for logging. Text-only elements stay on one line.
+// Incomplete XML, such as a stream's start element, is indented as far as it
+// goes; anything that isn't XML is returned unchanged.
+func IndentXML(s, indent string) string {
+	dec := xml.NewDecoder(strings.NewReader(s))
+	dec.Strict = false
+	buf := new(bytes.Buffer)
+	depth := 0
+	var prev xml.Token
+	newline := func() {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+			buf.WriteString(strings.Repeat(indent, depth))
+		}
+	}
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return buf.String()
+		}
+		if err != nil {
+			return s
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			newline()
+			writeXMLStartElement(buf, &t)
+			depth++
+		case xml.EndElement:
+			depth--
+			if _, ok := prev.(xml.EndElement); ok {
+				newline()
+			}
+			writeXMLEndElement(buf, &t)
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+			xml.EscapeText(buf, t)
+		case xml.ProcInst:
+			newline()
+			fmt.Fprintf(buf, "<?%s %s?>", t.Target, t.Inst)
+		case xml.Comment:
+			newline()
+			fmt.Fprintf(buf, "<!--%s-->", t)
+		default:
+			continue
+		}
+		prev = tok
+	}
+}
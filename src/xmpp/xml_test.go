@@ -37,3 +37,22 @@ func TestWriteAttr(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestIndentXML(t *testing.T) {
+	const in = `<message to='a@example.com' type='chat'><body>1 &lt; 2</body><x xmlns='jabber:x:oob'><url>http://example.com/</url></x></message>`
+	const want = "<message to='a@example.com' type='chat'>\n" +
+		"  <body>1 &lt; 2</body>\n" +
+		"  <x xmlns='jabber:x:oob'>\n" +
+		"    <url>http://example.com/</url>\n" +
+		"  </x>\n" +
+		"</message>"
+	if got := IndentXML(in, "  "); got != want {
+		t.Errorf("IndentXML() = %q, want %q", got, want)
+	}
+	if got := IndentXML("<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>", "  "); got != "<stream:stream xmlns:stream='http://etherx.jabber.org/streams'>" {
+		t.Errorf("IndentXML() of an unclosed element = %q", got)
+	}
+	if got := IndentXML("not <xml", "  "); got != "not <xml" {
+		t.Errorf("IndentXML() of bad XML = %q", got)
+	}
+}
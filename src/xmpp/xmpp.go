@@ -1,10 +1,12 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"log"
 	"sync"
+	"time"
 )
 
 // Handles XMPP conversations over a Stream. Use NewClientXMPP or
@@ -19,8 +21,12 @@ type XMPP struct {
 	stream *Stream
 
 	// Channel of incoming messages. Values will be one of IQ, Message,
-	// Presence, Error or error. Will be closed at the end when the stream is
-	// closed or the stream's net connection dies.
+	// Presence, Error, a type registered with RegisterElement, RawStanza if
+	// the RawUnknownElements config option is set, or error. A
+	// *DecodeError is delivered in place of a stanza that couldn't be
+	// decoded. Will be closed at the end when the stream is closed or the
+	// stream's net connection dies. Its buffer size and what happens when
+	// it's full are set by the InBuffer and InOverflow config options.
 	In chan interface{}
 
 	// Channel of outgoing messages. Messages must be able to be marshaled by
@@ -31,34 +37,259 @@ type XMPP struct {
 	// Incoming stanza filters.
 	filterLock   sync.Mutex
 	nextFilterID FilterID
-	filters      []filter
+	filters      []*filter
+	filtersDone  bool // Set once the stream is gone.
+
+	// Serialises writes to the stream.
+	writeLock sync.Mutex
+	lastWrite time.Time
+	ended     bool // Set once the stream end is written.
+
+	// XEP-0198 state, nil if stream management is not enabled.
+	sm *streamManagement
+
+	// Interval between keepalive pings, 0 to disable.
+	keepaliveInterval time.Duration
+
+	// Idle time before a whitespace keepalive is sent, 0 to disable.
+	whitespaceInterval time.Duration
+
+	// Limits the rate stanzas are sent from Out, nil if unlimited.
+	rateLimit *rateLimiter
+
+	// Acknowledge messages that request a delivery receipt.
+	autoReceipts bool
+
+	// Set the from attribute of outgoing stanzas that don't have one.
+	stampFrom bool
+
+	// Recipients of directed presence.
+	directedLock sync.Mutex
+	directed     map[string]bool
+
+	// Id of the last message sent to each recipient, for corrections.
+	lastMessageLock sync.Mutex
+	lastMessageIDs  map[string]string
+
+	// XEP-0047 in-band bytestreams, set up when first used.
+	ibbOnce     sync.Once
+	ibbLock     sync.Mutex
+	ibbStreams  map[bytestreamKey]*IBBStream
+	ibbWriters  map[bytestreamKey]*ibbWriter
+	ibbExpected map[bytestreamKey]chan *IBBStream
+
+	// XEP-0065 SOCKS5 bytestreams.
+	bytestreams         *BytestreamConfig
+	bytestreamOnce      sync.Once
+	bytestreamLock      sync.Mutex
+	bytestreamExpected  map[bytestreamKey]*expectedBytestream
+	bytestreamProxyLock sync.Mutex
+	bytestreamProxyList []StreamHost
+
+	// XEP-0084 avatar images by id.
+	avatarLock sync.Mutex
+	avatars    map[string][]byte
+
+	// What to do when In is full.
+	inOverflow OverflowPolicy
+
+	// Closed when the receiver exits.
+	done chan struct{}
+
+	// Closed when the sender exits.
+	senderDone chan struct{}
+
+	// Ensures the stream is only ended once.
+	closeOnce sync.Once
+
+	// Our own disco#info identities and features.
+	discoLock       sync.Mutex
+	discoIdentities []DiscoIdentity
+	discoFeatures   []string
+	discoAnswering  bool
+
+	// The server's disco#info, once requested.
+	serverInfo *DiscoInfo
+
+	// Our software version, nil if we don't answer version requests.
+	softwareVersion *SoftwareVersion
+
+	// Entity capabilities.
+	caps *Caps
+
+	// Counters returned by Stats.
+	statsLock sync.Mutex
+	stats     Stats
+
+	// Called with every element written to or read from the stream.
+	onStanza func(v interface{}, sent bool)
+
+	// Deliver unknown top-level elements as RawStanza instead of skipping
+	// them.
+	rawUnknown bool
+
+	// Generates stanza ids, UUID4 if nil.
+	idGenerator func() string
+
+	// Limits what each sender may send us, nil if unlimited.
+	limits *senderLimiter
+
+	// Called by start before anything is sent or received.
+	onStart func(*XMPP)
 }
 
+// Create an XMPP instance for the stream. Call start once it's configured.
 func newXMPP(jid JID, stream *Stream) *XMPP {
 	x := &XMPP{
 		JID:    jid,
 		stream: stream,
 		In:     make(chan interface{}),
 		Out:    make(chan interface{}),
+		done:   make(chan struct{}),
+
+		senderDone: make(chan struct{}),
+	}
+	x.caps = &Caps{x: x, cache: make(map[string]*DiscoInfo)}
+	return x
+}
+
+// What to do with an incoming stanza when the In channel's buffer is full.
+type OverflowPolicy int
+
+const (
+	// Wait for the application to read from In. Nothing else is received,
+	// including replies for SendRecv, until it does.
+	OverflowBlock OverflowPolicy = iota
+
+	// Discard the oldest stanza waiting in In to make room. If In is
+	// unbuffered the new stanza is discarded unless the application is
+	// already waiting for it.
+	OverflowDropOldest
+)
+
+// Limit the rate stanzas are sent from Out. A rate of 0 means unlimited. Must
+// be called before start.
+func (x *XMPP) setRateLimit(perSecond float64, burst int) {
+	if perSecond > 0 {
+		x.rateLimit = newRateLimiter(perSecond, burst)
+	}
+}
+
+// Replace the In and Out channels with ones of the given buffer sizes. Must be
+// called before start.
+func (x *XMPP) setChannels(inBuffer, outBuffer int, inOverflow OverflowPolicy) {
+	x.In = make(chan interface{}, inBuffer)
+	x.Out = make(chan interface{}, outBuffer)
+	x.inOverflow = inOverflow
+}
+
+// Deliver an incoming stanza or error on In, applying the overflow policy.
+func (x *XMPP) deliver(v interface{}) {
+	if x.inOverflow != OverflowDropOldest {
+		x.In <- v
+		return
+	}
+	for {
+		select {
+		case x.In <- v:
+			return
+		default:
+		}
+		if cap(x.In) == 0 {
+			x.logger().Error("In is full, dropping stanza")
+			return
+		}
+		select {
+		case <-x.In:
+			x.logger().Error("In is full, dropped oldest stanza")
+		default:
+		}
+	}
+}
+
+// Start processing the Out and In channels.
+func (x *XMPP) start() {
+	if x.onStart != nil {
+		x.onStart(x)
 	}
+	x.answerPings()
+	x.answerEntityTime()
 	go x.sender()
 	go x.receiver()
-	return x
+	if x.keepaliveInterval > 0 {
+		go x.keepalive(x.keepaliveInterval)
+	}
 }
 
+// Send an IQ and wait for the response. Blocks until a reply arrives; use
+// SendRecvContext to bound the wait. An error reply is returned as a
+// *StanzaError.
 func (x *XMPP) SendRecv(iq *IQ) (*IQ, error) {
+	return x.SendRecvContext(context.Background(), iq)
+}
+
+// Send an IQ and wait for the response, or for the context to be done. If the
+// context is cancelled or times out first, the reply filter is removed and
+// ctx.Err() is returned. An error reply is returned as a *StanzaError. Only
+// a reply from the entity the IQ was sent to is taken; others go to In. The
+// IQ is sent at the rate limit's pace, and not at all if the context is done
+// first.
+func (x *XMPP) SendRecvContext(ctx context.Context, iq *IQ) (*IQ, error) {
 
-	fid, ch := x.AddFilter(IQResult(iq.ID))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fid, ch := x.addFilter(x.iqReplyMatcher(iq), true, false, 0)
 	defer x.RemoveFilter(fid)
 
-	x.Out <- iq
+	if err := x.writeContext(ctx, iq); err != nil {
+		return nil, err
+	}
+	sent := time.Now()
 
-	stanza := <-ch
-	reply, ok := stanza.(*IQ)
-	if !ok {
-		return nil, fmt.Errorf("Expected IQ, for %T", stanza)
+	select {
+	case stanza, ok := <-ch:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		x.countRoundTrip(time.Since(sent))
+		reply, ok := stanza.(*IQ)
+		if !ok {
+			return nil, fmt.Errorf("Expected IQ, for %T", stanza)
+		}
+		if err := reply.StanzaError(); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return reply, nil
+}
+
+// Send an element to the stream immediately, returning any marshaling or
+// write error. Unlike sending on Out, the caller finds out if the connection
+// is broken. Elements sent with Send are not ordered with respect to elements
+// still queued on Out.
+func (x *XMPP) Send(v interface{}) error {
+	return x.write(v)
+}
+
+// Queue an element on Out and return a channel that receives nil once it has
+// been written to the stream, or the error that stopped it. The element is
+// ordered with everything else sent on Out. A written element may still be
+// lost with the connection; use stream management to know it arrived. As
+// with Out, SendAck must not be called once Out is closed.
+func (x *XMPP) SendAck(v interface{}) <-chan error {
+	ack := make(chan error, 1)
+	x.Out <- &ackedElement{v: v, ack: ack}
+	return ack
+}
+
+// An element queued by SendAck.
+type ackedElement struct {
+	v   interface{}
+	ack chan error
 }
 
 // Interface used to test if a stanza matches some application-defined
@@ -76,6 +307,10 @@ func (fn MatcherFunc) Match(v interface{}) bool {
 	return fn(v)
 }
 
+// Returned when waiting for a stanza that can never arrive because the stream
+// has gone away.
+var ErrDisconnected = errors.New("xmpp: stream disconnected")
+
 // Uniquely identifies a stream filter. Used to remove a filter that's no
 // longer needed.
 type FilterID int64
@@ -89,29 +324,125 @@ type filter struct {
 	id FilterID
 	m  Matcher
 	ch chan interface{}
+
+	// Closed when the filter is removed, to release a blocked send.
+	done chan struct{}
+
+	// Remove the filter after the first stanza is delivered.
+	once bool
+
+	// Keep the stanzas it takes from other filters and In.
+	consume bool
+
+	// Removes the filter if nothing matches within the timeout.
+	timeout time.Duration
+	timer   *time.Timer
+
+	// Held while sending on ch so it can't be closed mid-send.
+	lock   sync.Mutex
+	closed bool
+}
+
+func newFilter(id FilterID, m Matcher) *filter {
+	return &filter{id: id, m: m, ch: make(chan interface{}), done: make(chan struct{})}
+}
+
+// Send a stanza to the filter's channel. Returns false, without blocking, if
+// the filter has been or is being removed.
+func (f *filter) send(v interface{}) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return false
+	}
+	select {
+	case f.ch <- v:
+		return true
+	case <-f.done:
+		return false
+	}
+}
+
+// Close the filter's channel once any send in progress has given up. Must
+// only be called once, by whoever removes the filter from the list.
+func (f *filter) close() {
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	close(f.done)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	close(f.ch)
 }
 
 // Add a filter that routes matching stanzas to the returned channel. A
 // FilterID is also returned and can be pased to RemoveFilter to remove the
-// filter again.
+// filter again. The filter observes stanzas: every matching filter receives
+// the stanza, unless a consuming filter (AddConsumingFilter) takes it, and
+// it's only delivered on In if none do.
+//
+// The channel is closed when the filter is removed or when the stream dies,
+// or straight away if the stream has already died.
+// Consumers must treat a closed filter channel as "stream gone" if they did
+// not remove the filter themselves.
 func (x *XMPP) AddFilter(m Matcher) (FilterID, chan interface{}) {
+	return x.addFilter(m, false, false, 0)
+}
+
+// Add a filter like AddFilter that removes itself, closing the channel, if no
+// stanza matches for the duration d. Each match restarts the wait.
+func (x *XMPP) AddFilterWithTimeout(m Matcher, d time.Duration) (FilterID, chan interface{}) {
+	return x.addFilter(m, false, false, d)
+}
+
+// Add a filter that delivers the first matching stanza to the returned
+// channel, then removes itself and closes the channel. The channel is also
+// closed if the stream dies before a stanza matches.
+func (x *XMPP) AddOnceFilter(m Matcher) chan interface{} {
+	_, ch := x.addFilter(m, true, false, 0)
+	return ch
+}
+
+// Add a filter like AddFilter that consumes the stanzas it matches: they
+// aren't delivered to any other filter, nor In. Every other filter observes
+// stanzas, so all those that match receive it. Consuming filters are tried
+// first, most recently added first, and the first to match takes the stanza.
+func (x *XMPP) AddConsumingFilter(m Matcher) (FilterID, chan interface{}) {
+	return x.addFilter(m, false, true, 0)
+}
+
+func (x *XMPP) addFilter(m Matcher, once, consume bool, timeout time.Duration) (FilterID, chan interface{}) {
 
 	// Protect against concurrent access.
 	x.filterLock.Lock()
 	defer x.filterLock.Unlock()
 
-	// Allocate chan and id.
-	ch := make(chan interface{})
+	// Allocate filter and id.
 	id := x.nextFilterID
 	x.nextFilterID++
+	f := newFilter(id, m)
+	f.once = once
+	f.consume = consume
+
+	// Nothing more will arrive once the stream has gone.
+	if x.filtersDone {
+		f.close()
+		return id, f.ch
+	}
+
+	if timeout > 0 {
+		f.timeout = timeout
+		f.timer = time.AfterFunc(timeout, func() { x.RemoveFilter(id) })
+	}
 
 	// Insert at head of filters list.
-	filters := make([]filter, len(x.filters)+1)
-	filters[0] = filter{id, m, ch}
+	filters := make([]*filter, len(x.filters)+1)
+	filters[0] = f
 	copy(filters[1:], x.filters)
 	x.filters = filters
 
-	return id, ch
+	return id, f.ch
 }
 
 // Remove a filter previously added with AddFilter.
@@ -128,10 +459,10 @@ func (x *XMPP) RemoveFilter(id FilterID) error {
 		}
 
 		// Close the channel.
-		close(f.ch)
+		f.close()
 
 		// Remove from list.
-		filters := make([]filter, len(x.filters)-1)
+		filters := make([]*filter, len(x.filters)-1)
 		copy(filters, x.filters[:i])
 		copy(filters[i:], x.filters[i+1:])
 		x.filters = filters
@@ -143,8 +474,46 @@ func (x *XMPP) RemoveFilter(id FilterID) error {
 	return id
 }
 
-// Matcher to identify a <iq id="..." type="result" /> stanza with the given
-// id.
+// Call fn, in a dedicated goroutine, for each stanza matching m until the
+// filter is removed or the stream dies.
+func (x *XMPP) addHandler(m Matcher, fn func(v interface{})) FilterID {
+	id, ch := x.AddFilter(m)
+	go handle(ch, fn)
+	return id
+}
+
+// Call fn as addHandler, consuming the stanzas: used for requests the
+// package answers itself, so no other handler sees them and replies too.
+func (x *XMPP) addResponder(m Matcher, fn func(v interface{})) FilterID {
+	id, ch := x.AddConsumingFilter(m)
+	go handle(ch, fn)
+	return id
+}
+
+func handle(ch chan interface{}, fn func(v interface{})) {
+	for v := range ch {
+		fn(v)
+	}
+}
+
+// Close and remove all filters. Called once the stream is gone so anyone
+// waiting on a filter channel is released.
+func (x *XMPP) closeFilters() {
+
+	// Protect against concurrent access. Holding the lock means RemoveFilter
+	// can't close any of these channels a second time.
+	x.filterLock.Lock()
+	defer x.filterLock.Unlock()
+
+	for _, f := range x.filters {
+		f.close()
+	}
+	x.filters = nil
+	x.filtersDone = true
+}
+
+// Matcher to identify the response to an IQ, a <iq id="..." type="result" />
+// or <iq id="..." type="error" /> stanza with the given id.
 func IQResult(id string) Matcher {
 	return MatcherFunc(
 		func(v interface{}) bool {
@@ -152,78 +521,403 @@ func IQResult(id string) Matcher {
 			if !ok {
 				return false
 			}
-			if iq.ID != id {
+			if iq.Type != IQTypeResult && iq.Type != IQTypeError {
 				return false
 			}
-			return true
+			return iq.ID == id
+		},
+	)
+}
+
+// Matcher to identify the reply to the request, an IQResult also checked to
+// come from the entity the request was sent to so another entity that learns
+// the id can't spoof it. The server answers on the account's behalf for
+// requests to the account or the server itself, and may leave out from or
+// use either the bare JID or the domain.
+func (x *XMPP) iqReplyMatcher(req *IQ) Matcher {
+	result := IQResult(req.ID)
+	// The server answers a malformed to itself, with an error.
+	to, err := ParseJID(req.To)
+	if req.To == "" || err != nil {
+		to = JID{}
+	}
+	own := to == (JID{}) || to.Equal(x.JID.BareJID()) || to.Equal(JID{Domain: x.JID.Domain})
+	return MatcherFunc(
+		func(v interface{}) bool {
+			if !result.Match(v) {
+				return false
+			}
+			iq := v.(*IQ)
+			if iq.From == "" {
+				return own
+			}
+			from, err := ParseJID(iq.From)
+			if err != nil {
+				return false
+			}
+			if own {
+				return from.Equal(x.JID.BareJID()) || from.Equal(JID{Domain: x.JID.Domain}) || from.Equal(x.JID)
+			}
+			return from.Equal(to)
 		},
 	)
 }
 
+// Write an element to the stream. All writes go through here so elements
+// written by different goroutines are not interleaved.
+func (x *XMPP) write(v interface{}) error {
+	switch p := v.(type) {
+	case Presence:
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	case *Presence:
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	case Message:
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	case *Message:
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	v = x.outgoing(v)
+	x.writeLock.Lock()
+	defer x.writeLock.Unlock()
+	if x.ended {
+		return ErrDisconnected
+	}
+	if err := x.stream.Send(v); err != nil {
+		return err
+	}
+	x.lastWrite = time.Now()
+	x.countSent(v)
+	if x.limits != nil {
+		x.limits.sent(v)
+	}
+	if x.sm != nil {
+		x.sm.sent(v)
+	}
+	x.trackPresence(v)
+	x.trackMessage(v)
+	return nil
+}
+
+// Write an element as write, once the rate limit allows, giving up when the
+// context is done. A write already blocked on the connection is left to
+// finish or fail in the background.
+func (x *XMPP) writeContext(ctx context.Context, v interface{}) error {
+	if x.rateLimit != nil {
+		if err := x.rateLimit.waitContext(ctx); err != nil {
+			return err
+		}
+	}
+	if ctx.Done() == nil {
+		return x.write(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- x.write(v)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Write a single space if nothing has been written for the whitespace
+// keepalive interval. Framed connections carry no whitespace between
+// elements, so nothing is written to them.
+func (x *XMPP) writeWhitespace() error {
+	if _, ok := x.stream.conn.(streamFramer); ok {
+		return nil
+	}
+	x.writeLock.Lock()
+	defer x.writeLock.Unlock()
+	if x.ended || time.Since(x.lastWrite) < x.whitespaceInterval {
+		return nil
+	}
+	if err := x.stream.send([]byte{' '}); err != nil {
+		return err
+	}
+	x.lastWrite = time.Now()
+	return nil
+}
+
+// Apply any changes to an outgoing stanza before it's sent. Stanzas are copied
+// rather than modified in place.
+func (x *XMPP) outgoing(v interface{}) interface{} {
+	from := ""
+	if x.stampFrom {
+		from = x.JID.Full()
+	}
+	switch p := v.(type) {
+	case IQ:
+		if p.From == "" {
+			p.From = from
+		}
+		return p
+	case *IQ:
+		if p.From == "" && from != "" {
+			cp := *p
+			cp.From = from
+			return &cp
+		}
+	case Message:
+		if p.From == "" {
+			p.From = from
+		}
+		return p
+	case *Message:
+		if p.From == "" && from != "" {
+			cp := *p
+			cp.From = from
+			return &cp
+		}
+	case Presence:
+		if p.From == "" {
+			p.From = from
+		}
+		return *x.caps.attach(&p)
+	case *Presence:
+		if p.From == "" && from != "" {
+			cp := *p
+			cp.From = from
+			p = &cp
+		}
+		return x.caps.attach(p)
+	}
+	return v
+}
+
+// Apply any changes to an incoming stanza before it's dispatched.
+func (x *XMPP) incoming(v interface{}) interface{} {
+	switch s := v.(type) {
+	case *Message:
+		msg := x.unwrapCarbon(s)
+		parseMessageDelay(msg)
+		if x.autoReceipts {
+			x.sendReceipt(msg)
+		}
+		return msg
+	case *Presence:
+		parsePresenceIdle(s)
+	}
+	return v
+}
+
 func (x *XMPP) sender() {
 
+	defer close(x.senderDone)
+
+	// Periodically ask the server to acknowledge what we've sent.
+	var ackRequest <-chan time.Time
+	if x.sm != nil {
+		ticker := time.NewTicker(x.sm.ackInterval)
+		defer ticker.Stop()
+		ackRequest = ticker.C
+	}
+
+	// Keep the connection from looking idle.
+	var whitespace <-chan time.Time
+	if x.whitespaceInterval > 0 {
+		ticker := time.NewTicker(x.whitespaceInterval / 2)
+		defer ticker.Stop()
+		whitespace = ticker.C
+	}
+
 	// Send outgoing elements to the stream until the channel is closed.
-	for v := range x.Out {
-		x.stream.Send(v)
+sendLoop:
+	for {
+		select {
+		case v, ok := <-x.Out:
+			if !ok {
+				break sendLoop
+			}
+			if x.rateLimit != nil {
+				x.rateLimit.wait()
+			}
+			if a, ok := v.(*ackedElement); ok {
+				a.ack <- x.write(a.v)
+			} else {
+				x.write(v)
+			}
+		case <-ackRequest:
+			if x.sm.pending() > 0 {
+				x.write(&smRequest{})
+			}
+		case <-whitespace:
+			x.writeWhitespace()
+		}
 	}
 
-	// Close the stream. Note: relies on common element name for all types of
-	// XMPP connection.
-	log.Println("Close XMPP stream")
 	x.Close()
 }
 
 func (x *XMPP) receiver() {
 
 	defer func() {
-		log.Println("Close XMPP receiver")
 		x.Close()
+		x.closeFilters()
+		close(x.done)
 		close(x.In)
 	}()
 
 	for {
 		start, err := x.stream.Next()
 		if err != nil {
-			x.In <- err
+			x.deliver(err)
 			return
 		}
 
-		var v interface{}
-		switch start.Name.Local {
-		case "error":
-			v = &Error{}
-		case "iq":
-			v = &IQ{}
-		case "message":
-			v = &Message{}
-		case "presence":
-			v = &Presence{}
-		default:
-			log.Printf("Error. Unexected element: %T %v", start, start)
+		// Stream management elements are handled internally.
+		if start.Name.Space == nsStreamManagement {
+			if err := x.handleStreamManagement(start); err != nil {
+				x.deliver(err)
+				return
+			}
+			continue
 		}
 
-		err = x.stream.Decode(v, start)
-		if err != nil {
-			log.Println("Error. Failed to decode element. ", err)
+		// Every stanza counts as handled, including one that fails to
+		// decode, so our count keeps up with the server's.
+		if x.sm != nil && isStanzaName(start.Name) {
+			x.sm.handled()
 		}
 
-		filtered := false
-		for _, filter := range x.filters {
-			if filter.m.Match(v) {
-				filter.ch <- v
-				filtered = true
+		v := newRegisteredElement(start.Name)
+		if v == nil {
+			switch start.Name.Local {
+			case "error":
+				v = &Error{}
+			case "iq":
+				v = &IQ{}
+			case "message":
+				v = &Message{}
+			case "presence":
+				v = &Presence{}
+			default:
+				if x.rawUnknown {
+					v = &RawStanza{}
+					break
+				}
+				// Skip the whole element, leaving the stream at the next.
+				x.logger().Error("Unexpected element: ", start.Name.Local)
+				if err := x.stream.Skip(); err != nil {
+					x.deliver(err)
+					return
+				}
+				continue
 			}
 		}
 
-		if !filtered {
-			x.In <- v
+		// A stanza that failed to decode is skipped and the error delivered
+		// in its place. Any other error means the stream is broken.
+		if err := x.stream.Decode(v, start); err != nil {
+			x.logger().Error("Failed to decode element. ", err)
+			x.deliver(err)
+			if _, ok := err.(*DecodeError); ok {
+				continue
+			}
+			return
+		}
+
+		// Checked before anything is done with the stanza, so refused
+		// senders get no automatic replies such as receipts.
+		if x.limits != nil && !x.limits.allow(v, time.Now()) {
+			x.countReceived(v)
+			x.refuseStanza(v)
+			continue
+		}
+
+		v = x.incoming(v)
+		x.countReceived(v)
+
+		// Filters may be added and removed while we're dispatching. The list
+		// is replaced, never modified in place, so a snapshot is safe to use,
+		// and a filter removed after the snapshot refuses the stanza rather
+		// than taking it.
+		x.filterLock.Lock()
+		filters := x.filters
+		x.filterLock.Unlock()
+
+		if !x.dispatch(filters, v) {
+			x.deliver(v)
 		}
 	}
 }
 
-func (x *XMPP) Close() {
-	log.Println("Close XMPP")
-	x.stream.SendEnd(&xml.EndElement{xml.Name{"stream", "stream"}})
+// Send a stanza to the filters that match it: the first consuming filter that
+// takes it, or else every observing one. Return true if any filter took it.
+func (x *XMPP) dispatch(filters []*filter, v interface{}) bool {
+	for _, filter := range filters {
+		if filter.consume && filter.m.Match(v) && filter.send(v) {
+			x.dispatched(filter)
+			return true
+		}
+	}
+	filtered := false
+	for _, filter := range filters {
+		if !filter.consume && filter.m.Match(v) && filter.send(v) {
+			x.dispatched(filter)
+			filtered = true
+		}
+	}
+	return filtered
+}
+
+// Update a filter that has been sent a stanza.
+func (x *XMPP) dispatched(filter *filter) {
+	if filter.once {
+		x.RemoveFilter(filter.id)
+	} else if filter.timer != nil {
+		filter.timer.Reset(filter.timeout)
+	}
+}
+
+// Close the conversation gracefully: send everything already queued on Out,
+// end the stream, and wait for the server to end its stream before closing
+// the connection. Out is closed by CloseGraceful so nothing may be sent on it
+// afterwards. In must still be read until it's closed or the wait can't
+// finish. If ctx is done first the connection is closed immediately and
+// ctx.Err() is returned.
+func (x *XMPP) CloseGraceful(ctx context.Context) error {
+
+	close(x.Out)
+
+	for _, done := range []chan struct{}{x.senderDone, x.done} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			x.stream.Close()
+			return ctx.Err()
+		}
+	}
+
+	return x.stream.Close()
 }
 
-// BUG(matt): Filter channels are not closed when the stream is closed.
+// End the stream, first sending unavailable presence to anyone we've sent
+// directed presence to. Safe to call more than once and from several
+// goroutines; only the first call sends anything, and nothing is written
+// after the end.
+func (x *XMPP) Close() {
+	x.closeOnce.Do(func() {
+		// Note: relies on common element name for all types of XMPP
+		// connection.
+		x.logger().Debug("Close XMPP")
+		x.leaveDirectedPresence()
+		x.writeLock.Lock()
+		defer x.writeLock.Unlock()
+		x.ended = true
+		x.stream.SendEnd(&xml.EndElement{xml.Name{"stream", "stream"}})
+	})
+}
@@ -0,0 +1,148 @@
+package xmpp
+
+import (
+	"errors"
+	"sync"
+)
+
+// Returned by XMPPSet when no member has the JID.
+var ErrNotMember = errors.New("xmpp: no such member of the set")
+
+// A stanza or error received by a member of an XMPPSet.
+type SetStanza struct {
+	// The member it was received by.
+	X *XMPP
+
+	// The stanza or error, as delivered on the member's In.
+	Value interface{}
+}
+
+// A set of independent XMPP instances, e.g. the components of a gateway
+// serving several domains, read through a single In channel. Each instance
+// keeps its own stream; stanzas are sent on a chosen member's Out.
+type XMPPSet struct {
+	// Channel of stanzas and errors from every member's In, tagged with the
+	// member. A member's In is read by the set from Add until Remove or until
+	// it's closed, when the member leaves the set. Closed by Close.
+	In chan *SetStanza
+
+	lock    sync.Mutex
+	members map[*XMPP]chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Create an empty set.
+func NewXMPPSet() *XMPPSet {
+	return &XMPPSet{
+		In:      make(chan *SetStanza),
+		members: make(map[*XMPP]chan struct{}),
+	}
+}
+
+// Add the XMPP to the set and start reading its In. Adding a member twice, or
+// one with the same JID as another member, is an error.
+func (s *XMPPSet) Add(x *XMPP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for member := range s.members {
+		if member.JID.Equal(x.JID) {
+			return errors.New("xmpp: set already has a member for " + x.JID.Full())
+		}
+	}
+	stop := make(chan struct{})
+	s.members[x] = stop
+	s.wg.Add(1)
+	go s.forward(x, stop)
+	return nil
+}
+
+// Pass the member's stanzas to In until its In is closed or stop is.
+func (s *XMPPSet) forward(x *XMPP, stop chan struct{}) {
+	defer s.wg.Done()
+	defer s.leave(x, stop)
+	for {
+		select {
+		case v, ok := <-x.In:
+			if !ok {
+				return
+			}
+			select {
+			case s.In <- &SetStanza{X: x, Value: v}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Remove the member, if it's still the one added with stop.
+func (s *XMPPSet) leave(x *XMPP, stop chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.members[x] == stop {
+		delete(s.members, x)
+	}
+}
+
+// Remove the member with the JID from the set and stop reading its In, which
+// the application must read itself from then on. The member's stream isn't
+// closed.
+func (s *XMPPSet) Remove(jid JID) error {
+	x := s.Get(jid)
+	if x == nil {
+		return ErrNotMember
+	}
+	s.lock.Lock()
+	stop, ok := s.members[x]
+	delete(s.members, x)
+	s.lock.Unlock()
+	if ok {
+		close(stop)
+	}
+	return nil
+}
+
+// Return the member with the JID, or nil if there isn't one.
+func (s *XMPPSet) Get(jid JID) *XMPP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for x := range s.members {
+		if x.JID.Equal(jid) {
+			return x
+		}
+	}
+	return nil
+}
+
+// Return the set's members, in no particular order.
+func (s *XMPPSet) Members() []*XMPP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := make([]*XMPP, 0, len(s.members))
+	for x := range s.members {
+		members = append(members, x)
+	}
+	return members
+}
+
+// Send the stanza on the Out channel of the member with the JID.
+func (s *XMPPSet) Send(jid JID, v interface{}) error {
+	x := s.Get(jid)
+	if x == nil {
+		return ErrNotMember
+	}
+	x.Out <- v
+	return nil
+}
+
+// End every member's stream and wait for the servers to end theirs, then
+// close In, which must be read until then.
+func (s *XMPPSet) Close() {
+	for _, x := range s.Members() {
+		x.Close()
+	}
+	s.wg.Wait()
+	close(s.In)
+}
@@ -0,0 +1,41 @@
+package xmpp
+
+import (
+	"testing"
+)
+
+func TestXMPPSet(t *testing.T) {
+	alice, bob := newTestXMPPPair()
+	go alice.sender()
+	go bob.sender()
+
+	set := NewXMPPSet()
+	if err := set.Add(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Add(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Add(alice); err == nil {
+		t.Error("added alice twice")
+	}
+
+	if err := set.Send(alice.JID, &Message{ID: "1", To: bob.JID.Full()}); err != nil {
+		t.Fatal(err)
+	}
+	s := <-set.In
+	if msg, ok := s.Value.(*Message); !ok || s.X != bob || msg.ID != "1" || msg.From != alice.JID.Full() {
+		t.Errorf("unexpected %+v from %v", s.Value, s.X.JID)
+	}
+	if err := set.Send(JID{Domain: "example.net"}, &Message{}); err != ErrNotMember {
+		t.Errorf("err = %v, want ErrNotMember", err)
+	}
+
+	// Both streams end and the set's In closes.
+	go set.Close()
+	for range set.In {
+	}
+	if members := set.Members(); len(members) != 0 {
+		t.Errorf("%d members left after Close", len(members))
+	}
+}
@@ -0,0 +1,422 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Create an XMPP instance reading from one end of a pipe. The other end is
+// returned for the test to play the server.
+func newTestXMPP() (*XMPP, net.Conn) {
+	client, server := net.Pipe()
+	stream := &Stream{conn: client, dec: xml.NewDecoder(client), config: &StreamConfig{}}
+	return newXMPP(JID{Node: "alice", Domain: "example.com", Resource: "test"}, stream), server
+}
+
+func TestFilterRemovedDuringDispatch(t *testing.T) {
+	x, server := newTestXMPP()
+	go x.receiver()
+
+	const stanzas = 2000
+	go func() {
+		defer server.Close()
+		for i := 0; i < stanzas; i++ {
+			fmt.Fprintf(server, `<message id="%d"><body>hi</body></message>`, i)
+		}
+	}()
+
+	// Repeatedly add filters for every message and remove them, sometimes
+	// after taking a stanza and sometimes while the receiver is blocked
+	// sending to them.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			all := MatcherFunc(func(v interface{}) bool { return true })
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id, ch := x.AddFilter(all)
+				if (n+i)%2 == 0 {
+					<-ch
+				}
+				x.RemoveFilter(id)
+			}
+		}(i)
+	}
+
+	for range x.In {
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSendRecvErrorReply(t *testing.T) {
+	x, server := newTestXMPP()
+	go x.receiver()
+	defer server.Close()
+
+	go func() {
+		req := &IQ{}
+		if err := xml.NewDecoder(server).Decode(req); err != nil {
+			return
+		}
+		// A request that happens to reuse the id mustn't be taken as the
+		// response.
+		fmt.Fprintf(server, `<iq type="get" id="%s"/>`, req.ID)
+		fmt.Fprintf(server, `<iq type="error" id="%s"><error type="cancel">`+
+			`<service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/>`+
+			`</error></iq>`, req.ID)
+	}()
+
+	in := make(chan interface{}, 1)
+	go func() {
+		in <- <-x.In
+	}()
+
+	_, err := x.SendRecv(&IQ{ID: UUID4(), Type: IQTypeGet})
+	serr, ok := err.(*StanzaError)
+	if !ok {
+		t.Fatalf("expected a StanzaError, got %v", err)
+	}
+	if serr.Condition != ErrorServiceUnavailable {
+		t.Errorf("unexpected condition %v", serr.Condition)
+	}
+	if iq, ok := (<-in).(*IQ); !ok || iq.Type != IQTypeGet {
+		t.Errorf("expected the get on In")
+	}
+}
+
+func TestSendRecvSpoofedReply(t *testing.T) {
+	x, server := newTestXMPP()
+	go x.receiver()
+	defer server.Close()
+
+	go func() {
+		req := &IQ{}
+		if err := xml.NewDecoder(server).Decode(req); err != nil {
+			return
+		}
+		fmt.Fprintf(server, `<iq type="result" id="%s" from="eve@example.com/x"><spoofed/></iq>`, req.ID)
+		fmt.Fprintf(server, `<iq type="result" id="%s" from="Bob@example.com/x"/>`, req.ID)
+	}()
+
+	in := make(chan interface{}, 1)
+	go func() {
+		in <- <-x.In
+	}()
+
+	reply, err := x.SendRecv(&IQ{ID: UUID4(), Type: IQTypeGet, To: "bob@example.com/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Payload != "" {
+		t.Errorf("took the spoofed reply")
+	}
+	if iq, ok := (<-in).(*IQ); !ok || iq.From != "eve@example.com/x" {
+		t.Errorf("expected the spoofed reply on In")
+	}
+}
+
+func TestIQReplyMatcher(t *testing.T) {
+	x := &XMPP{JID: JID{Node: "alice", Domain: "example.com", Resource: "test"}}
+	tests := []struct {
+		to, from string
+		match    bool
+	}{
+		{"", "", true},
+		{"", "example.com", true},
+		{"", "alice@example.com", true},
+		{"alice@example.com", "", true},
+		{"alice@example.com", "example.com", true},
+		{"example.com", "alice@example.com", true},
+		{"", "bob@example.com", false},
+		{"bob@example.com", "", false},
+		{"bob@example.com", "bob@example.com", true},
+		{"bob@example.com", "bob@example.com/x", false},
+		{"bob@example.com", "example.com", false},
+		{"pubsub.example.com", "pubsub.example.com", true},
+	}
+	for _, test := range tests {
+		m := x.iqReplyMatcher(&IQ{ID: "1", Type: IQTypeGet, To: test.to})
+		if got := m.Match(&IQ{ID: "1", Type: IQTypeResult, From: test.from}); got != test.match {
+			t.Errorf("to %q, from %q: match = %v, want %v", test.to, test.from, got, test.match)
+		}
+	}
+}
+
+type testElement struct {
+	XMLName xml.Name `xml:"urn:example:test custom"`
+	Value   string   `xml:"value,attr"`
+}
+
+func TestRegisterElement(t *testing.T) {
+	RegisterElement(xml.Name{"urn:example:test", "custom"}, testElement{})
+
+	x, server := newTestXMPP()
+	go x.receiver()
+	go func() {
+		defer server.Close()
+		server.Write([]byte(`<other xmlns="urn:example:test"/><custom xmlns="urn:example:test" value="42"/>`))
+	}()
+
+	v := <-x.In
+	e, ok := v.(*testElement)
+	if !ok {
+		t.Fatalf("expected *testElement, got %T", v)
+	}
+	if e.Value != "42" {
+		t.Errorf("unexpected value %q", e.Value)
+	}
+	for range x.In {
+	}
+}
+
+func TestRawUnknownElements(t *testing.T) {
+	x, server := newTestXMPP()
+	x.rawUnknown = true
+	go x.receiver()
+	go func() {
+		defer server.Close()
+		server.Write([]byte(`<other xmlns="urn:example:unknown" a="1"><child><deeper/></child></other><message id="after"/>`))
+	}()
+
+	raw, ok := (<-x.In).(*RawStanza)
+	if !ok {
+		t.Fatal("expected *RawStanza")
+	}
+	if raw.XMLName != (xml.Name{"urn:example:unknown", "other"}) || len(raw.Attr) != 2 || string(raw.InnerXML) != "<child><deeper/></child>" {
+		t.Errorf("unexpected raw stanza: %v %v %q", raw.XMLName, raw.Attr, raw.InnerXML)
+	}
+	if msg, ok := (<-x.In).(*Message); !ok || msg.ID != "after" {
+		t.Errorf("the stanza after the unknown element wasn't received intact")
+	}
+	for range x.In {
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	x, server := newTestXMPP()
+	go x.sender()
+
+	// Read the first message, then drop the connection.
+	go func() {
+		dec := xml.NewDecoder(server)
+		dec.Decode(&Message{})
+		server.Close()
+	}()
+
+	if err := <-x.SendAck(&Message{Body: []MessageBody{{Value: "hi"}}}); err != nil {
+		t.Fatalf("first SendAck: %v", err)
+	}
+	if err := <-x.SendAck(&Message{Body: []MessageBody{{Value: "hi"}}}); err == nil {
+		t.Fatal("SendAck after the connection closed succeeded")
+	}
+}
+
+func TestConsumingFilter(t *testing.T) {
+	x, server := newTestXMPP()
+	go x.receiver()
+
+	_, observed := x.AddFilter(MatcherFunc(func(v interface{}) bool { return true }))
+	_, consumed := x.AddConsumingFilter(MessageType(MessageTypeChat))
+
+	go func() {
+		defer server.Close()
+		fmt.Fprint(server, `<message id="1" type="chat"/><message id="2"/>`)
+	}()
+
+	if v := (<-consumed).(*Message); v.ID != "1" {
+		t.Errorf("consuming filter received %s, want 1", v.ID)
+	}
+	if v := (<-observed).(*Message); v.ID != "2" {
+		t.Errorf("observing filter received %s, want 2", v.ID)
+	}
+	for v := range x.In {
+		if _, ok := v.(error); !ok {
+			t.Errorf("unexpected %T on In", v)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	x, server := newTestXMPP()
+	var lock sync.Mutex
+	hooked := map[bool]int{}
+	x.onStanza = func(v interface{}, sent bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		hooked[sent]++
+	}
+	go x.receiver()
+
+	// Answer the IQ, then send a message.
+	go func() {
+		defer server.Close()
+		dec := xml.NewDecoder(server)
+		iq := &IQ{}
+		dec.Decode(iq)
+		fmt.Fprintf(server, `<iq id="%s" type="result"/><message/>`, iq.ID)
+	}()
+
+	if _, err := x.SendRecv(&IQ{ID: "1", Type: IQTypeGet}); err != nil {
+		t.Fatal(err)
+	}
+	for range x.In {
+	}
+
+	stats := x.Stats()
+	if stats.Sent.IQ != 1 || stats.Received.IQ != 1 || stats.Received.Message != 1 {
+		t.Errorf("unexpected counts: sent %+v, received %+v", stats.Sent, stats.Received)
+	}
+	if stats.RoundTrips != 1 || stats.RoundTripTime <= 0 || stats.MaxRoundTrip != stats.RoundTripTime {
+		t.Errorf("unexpected round trips: %d in %v, max %v", stats.RoundTrips, stats.RoundTripTime, stats.MaxRoundTrip)
+	}
+	if hooked[true] != 1 || hooked[false] != 2 {
+		t.Errorf("hook called for %d sent and %d received, want 1 and 2", hooked[true], hooked[false])
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	x, server := newTestXMPP()
+	n := 0
+	x.idGenerator = func() string {
+		n++
+		return fmt.Sprintf("test-%d", n)
+	}
+	go x.receiver()
+	defer server.Close()
+
+	if id := x.NewMessage(JID{Domain: "example.com"}).Build().ID; id != "test-1" {
+		t.Errorf("message id = %q, want test-1", id)
+	}
+
+	go func() {
+		req := &IQ{}
+		if err := xml.NewDecoder(server).Decode(req); err != nil {
+			return
+		}
+		if req.ID != "test-2" {
+			t.Errorf("ping id = %q, want test-2", req.ID)
+		}
+		fmt.Fprintf(server, `<iq type="result" id="%s"/>`, req.ID)
+	}()
+	if err := x.Ping(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendRecvContextDone(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+
+	// Nothing is sent for a context already done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := x.SendRecvContext(ctx, &IQ{ID: "1", Type: IQTypeGet}); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+
+	// Nobody reads the server end, so the write blocks past the deadline.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := x.SendRecvContext(ctx, &IQ{ID: "2", Type: IQTypeGet}); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+
+	// The rate limit's wait is bounded by the context too.
+	x.rateLimit = newRateLimiter(0.1, 1)
+	x.rateLimit.reserve(time.Now())
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := x.SendRecvContext(ctx, &IQ{ID: "3", Type: IQTypeGet}); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestResponderConsumes(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	x.answerPings()
+	handled := make(chan string, 2)
+	x.HandleIQ(func(iq *IQ) {
+		handled <- iq.ID
+	})
+	go x.receiver()
+
+	go fmt.Fprint(server, `<iq type="get" id="1"><ping xmlns="urn:xmpp:ping"/></iq>`+
+		`<iq type="get" id="2"><query xmlns="urn:example:test"/></iq>`)
+
+	reply := &IQ{}
+	if err := xml.NewDecoder(server).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != "1" || reply.Type != IQTypeResult {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if id := <-handled; id != "2" {
+		t.Errorf("HandleIQ received %s, want only 2", id)
+	}
+}
+
+func TestRosterPushConsumed(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	pushed := make(chan string, 1)
+	x.HandleRosterPush(func(item RosterItem) {
+		pushed <- item.JID
+	})
+	handled := make(chan string, 2)
+	x.HandleIQ(func(iq *IQ) {
+		handled <- iq.ID
+	})
+	go x.receiver()
+
+	go fmt.Fprint(server, `<iq type="set" id="push-1"><query xmlns="jabber:iq:roster"><item jid="bob@example.com"/></query></iq>`+
+		`<iq type="get" id="2"><query xmlns="urn:example:test"/></iq>`)
+
+	reply := &IQ{}
+	if err := xml.NewDecoder(server).Decode(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ID != "push-1" || reply.Type != IQTypeResult {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if jid := <-pushed; jid != "bob@example.com" {
+		t.Errorf("pushed %s, want bob@example.com", jid)
+	}
+	if id := <-handled; id != "2" {
+		t.Errorf("HandleIQ received %s, want only 2", id)
+	}
+}
+
+func TestCloseEndsWrites(t *testing.T) {
+	x, server := newTestXMPP()
+	defer server.Close()
+	written := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(server)
+		written <- string(b)
+	}()
+
+	x.Close()
+	x.Close()
+	if err := x.write(&Message{ID: "late"}); err != ErrDisconnected {
+		t.Errorf("write after Close = %v, want ErrDisconnected", err)
+	}
+	x.stream.Close()
+	if s := <-written; s != "</stream:stream>" {
+		t.Errorf("written %q, want only the stream end", s)
+	}
+}
@@ -35,8 +35,7 @@ func producer(args []string) {
 	flags.Parse(args)
 
 	jid := must(xmpp.ParseJID(*jidFlag)).(xmpp.JID)
-	addrs := must(xmpp.HomeServerAddrs(jid)).([]string)
-	stream := must(xmpp.NewStream(addrs[0], nil)).(*xmpp.Stream)
+	stream := must(xmpp.NewClientStream(jid, nil)).(*xmpp.Stream)
 	config := xmpp.ClientConfig{InsecureSkipVerify: *insecureFlag}
 	x := must(xmpp.NewClientXMPP(stream, jid, *passFlag, &config)).(*xmpp.XMPP)
 
@@ -73,10 +72,9 @@ func consumer(args []string) {
 	var x *xmpp.XMPP
 	if jid.Node == "" {
 		stream := must(xmpp.NewStream(*serverFlag, nil)).(*xmpp.Stream)
-		x = must(xmpp.NewComponentXMPP(stream, jid, *passFlag)).(*xmpp.XMPP)
+		x = must(xmpp.NewComponentXMPP(stream, jid, *passFlag, nil)).(*xmpp.XMPP)
 	} else {
-		addrs := must(xmpp.HomeServerAddrs(jid)).([]string)
-		stream := must(xmpp.NewStream(addrs[0], nil)).(*xmpp.Stream)
+		stream := must(xmpp.NewClientStream(jid, nil)).(*xmpp.Stream)
 		config := xmpp.ClientConfig{InsecureSkipVerify: *insecureFlag}
 		x = must(xmpp.NewClientXMPP(stream, jid, *passFlag, &config)).(*xmpp.XMPP)
 		x.Out <- xmpp.Presence{}